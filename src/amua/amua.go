@@ -12,10 +12,13 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"amua/config"
+	"amua/mailcap"
+	"amua/query"
 	"amua/util"
 
 	"github.com/deweerdt/gocui"
@@ -34,20 +37,41 @@ const (
 	CommandMailModeTo
 	CommandMailModeCc
 	CommandMailModeBcc
+	CommandMoveMode
+	CommandCopyMode
+	CommandTagMode
+	CommandUntagMode
+	CommandLimitMode
+	CommandSaveAttachmentMode
+	CommandPipeAttachmentMode
+	CommandPipeMessageMode
+	CommandNewFolderMode
+	CommandRenameFolderMode
+	CommandDeleteFolderMode
 	SendMailMode
 	MaxMode
 )
 
 type Amua struct {
-	cfg            config.Config  // the running configuration
-	mode           Mode           // the current mode the app is in
-	prevMode       Mode           // the mode the app was in
-	curMaildirView *MaildirView   // the current mailview
-	knownMaildirs  []knownMaildir // list of loaded maildirs
-	curMaildir     int            // index into knownMaildirs
-	searchPattern  string         // currently searched pattern
-	prompt         string         // current prompt: useful to know what to needs to be taken out of the view
-	newMail        NewMail        // the mail currently beeing edited
+	cfg            config.Config     // the running configuration
+	mode           Mode              // the current mode the app is in
+	prevMode       Mode              // the mode the app was in
+	curMaildirView *MaildirView      // the current mailview
+	knownMaildirs  []knownMaildir    // list of loaded maildirs
+	curMaildir     int               // index into knownMaildirs
+	searchPattern  string            // currently searched pattern
+	prompt         string            // current prompt: useful to know what to needs to be taken out of the view
+	newMail        NewMail           // the mail currently beeing edited
+	completions    []string          // the candidates when completing the prompt's input
+	completionIdx  int               // the last candidate that was displayed
+	tagPrefix      bool              // true if the next action applies to the tagged messages
+	attachments    *AttachmentView   // the attachments of the current message
+	attachRetMode  Mode              // the mode to go back to when leaving the attachments
+	mailcap        *mailcap.Mailcap  // loaded on first use
+	folderTarget   int               // the known maildir the folder commands apply to
+	onChange       onMaildirChangeFn // passed to the monitors of the folders found later on
+	undo           undoStack         // the actions of the index that can be undone
+	outbox         *outbox           // the messages waiting to be sent
 }
 
 func (amua *Amua) ExtEditor() string {
@@ -60,15 +84,97 @@ func (amua *Amua) ExtEditor() string {
 	return editor
 }
 func (amua *Amua) getMessage(idx int) *Message {
-	return amua.curMaildirView.md.messages[idx]
+	return amua.curMaildirView.Message(idx)
 }
 func (amua *Amua) curMessage() *Message {
 	return amua.getMessage(amua.curMaildirView.cur)
 }
 
+func (amua *Amua) taggedMessages() []*Message {
+	ret := []*Message{}
+	for _, m := range amua.curMaildirView.md.Messages() {
+		if (m.Flags & Tagged) != 0 {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// Returns the messages the next action applies to: the tagged messages if
+// the tag prefix was pressed, the current message otherwise
+func (amua *Amua) targetMessages() []*Message {
+	if amua.tagPrefix {
+		amua.tagPrefix = false
+		amua.clearStatus()
+		return amua.taggedMessages()
+	}
+	m := amua.curMessage()
+	if m == nil {
+		return nil
+	}
+	return []*Message{m}
+}
+
+// Clears the status bar, leaving only the active limit if there's one
+func (amua *Amua) clearStatus() {
+	mv := amua.curMaildirView
+	if mv == nil || mv.limit == "" {
+		setStatus("")
+		return
+	}
+	setStatus(fmt.Sprintf("Limit: %s (%d/%d)", mv.limit, mv.Len(), mv.md.Len()))
+}
+
+// Tags, or untags, the messages of the current maildir view matching
+// pattern. Returns how many matched.
+func (amua *Amua) tagPattern(pattern string, tag bool) (int, error) {
+	md := amua.curMaildirView.md
+	matches, _, err := amua.searchMatcher(pattern)
+	if err != nil {
+		return 0, err
+	}
+	msgs := []*Message{}
+	for _, m := range amua.curMaildirView.Messages() {
+		if matches.Match(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	if tag {
+		amua.undo.push(changeFlags(md, msgs, Tagged, 0))
+	} else {
+		amua.undo.push(changeFlags(md, msgs, 0, Tagged))
+	}
+	return len(msgs), nil
+}
+
+// Returns a matcher telling whether a message of the current maildir
+// matches the query q. When the full-text index can answer q, also
+// returns the number of messages it found in each of the other maildirs.
+func (amua *Amua) searchMatcher(q string) (*queryMatcher, map[string]int, error) {
+	md := amua.curMaildirView.md
+	expr, err := query.Parse(q, time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	others := make(map[string]int)
+	if iq, ok := query.IndexQuery(expr); ok {
+		hits, err := searchIndex.search(iq)
+		if err != nil {
+			return nil, nil, err
+		}
+		for mdPath, keys := range hits {
+			if !md.covers(mdPath) {
+				others[mdPath] = len(keys)
+			}
+		}
+	}
+	return newQueryMatcher(md, expr), others, nil
+}
+
 const (
 	MAILDIR_VIEW   = "maildir"
 	MESSAGE_VIEW   = "message"
+	ATTACH_VIEW    = "attachments"
 	SLIDER_VIEW    = "slider"
 	SIDE_VIEW      = "side"
 	STATUS_VIEW    = "status"
@@ -90,6 +196,17 @@ func (m *Message) Draw(amua *Amua, g *gocui.Gui) error {
 	v.Wrap = true
 	v.SetOrigin(0, 0)
 
+	if m.loadErr != nil {
+		/* show what we have */
+		colorstring.Fprintf(v, "[red]Can't parse %s: %s\n\n", m.path, m.loadErr.Error())
+		f, err := os.Open(m.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(v, f)
+		return err
+	}
 	colorstring.Fprintf(v, "[green]Subject: %s\n", m.Subject)
 	colorstring.Fprintf(v, "[red]From: %s\n", m.From)
 	colorstring.Fprintf(v, "[red]To: %s\n", m.To)
@@ -113,110 +230,380 @@ func scrollMessageView(dy int) func(g *gocui.Gui, v *gocui.View) error {
 }
 func scrollSideView(amua *Amua, dy int) func(g *gocui.Gui, v *gocui.View) error {
 	return func(g *gocui.Gui, v *gocui.View) error {
+		_, oy := v.Origin()
 		_, cy := v.Cursor()
-		if cy+dy >= len(amua.knownMaildirs) {
-			return nil
+		row := oy + cy + dy
+		if n := len(amua.visibleMaildirs()); row >= n {
+			row = n - 1
 		}
-		if cy+dy < 0 {
-			return nil
+		if row < 0 {
+			row = 0
 		}
-		v.MoveCursor(0, dy, false)
+		showSideRow(v, row)
 		return nil
 	}
 }
 
+// Moves the sidebar's cursor to row, scrolling if it's out of the view
+func showSideRow(v *gocui.View, row int) {
+	_, h := v.Size()
+	_, oy := v.Origin()
+	if row < oy {
+		oy = row
+	} else if row >= oy+h {
+		oy = row - h + 1
+	}
+	v.SetOrigin(0, oy)
+	v.SetCursor(0, row-oy)
+}
+
 func (amua *Amua) applyCurMaildirChanges() error {
-	md := amua.curMaildirView.md
-	for _, m := range md.messages {
-		if (m.Flags & Trashed) != 0 {
-			err := os.Remove(m.path)
+	return amua.curMaildirView.md.ApplyChanges()
+}
+
+// Loads the current maildir in the background: the messages are shown
+// as they're parsed, and sorted once they're all there
+func (amua *Amua) RefreshMaildir(g *gocui.Gui, v *gocui.View) error {
+	md := amua.knownMaildirs[amua.curMaildir].maildir
+	mdv := &MaildirView{md: md, sortMode: amua.curMaildirView.sortMode}
+	mdv.SetLimit(amua.curMaildirView.limit)
+	amua.curMaildirView = mdv
+	v.SetCursor(0, 0)
+	v.SetOrigin(0, 0)
+	/* the view might have been replaced by the time we get to run */
+	redraw := func(g *gocui.Gui) {
+		if v, err := g.View(MAILDIR_VIEW); err == nil {
+			err = mdv.Draw(v)
 			if err != nil {
-				panic(err)
+				fmt.Fprint(v, err.Error())
 			}
-			continue
 		}
-		path := m.path
-		i := strings.LastIndex(m.path, ":2,")
-		if i != -1 {
-			path = path[:i]
+		drawSlider(amua, g)
+		if v, err := g.View(SIDE_VIEW); err == nil {
+			drawKnownMaildirs(amua, g, v)
 		}
-		newPath := fmt.Sprintf("%s:2,%s", path, flagsToFile(m.Flags))
-		if m.path != newPath {
-			err := os.Rename(m.path, newPath)
+	}
+	redraw(g)
+	go func() {
+		err := md.LoadWithProgress(true, func(loaded int, total int) {
+			g.Execute(func(g *gocui.Gui) error {
+				if amua.curMaildirView != mdv {
+					return nil
+				}
+				setStatus(fmt.Sprintf("Loading %s: %d/%d", md.path, loaded, total))
+				redraw(g)
+				return nil
+			})
+		})
+		g.Execute(func(g *gocui.Gui) error {
+			if amua.curMaildirView != mdv {
+				return nil
+			}
+			amua.clearStatus()
 			if err != nil {
-				panic(err)
+				displayError(err.Error())
 			}
+			mdv.Sort()
+			redraw(g)
+			return nil
+		})
+	}()
+	return nil
+}
+
+// Returns true if the known maildir at i is followed by its subfolders
+func (amua *Amua) hasSubfolders(i int) bool {
+	km := &amua.knownMaildirs[i]
+	if km.root == "" || i+1 >= len(amua.knownMaildirs) {
+		return false
+	}
+	next := &amua.knownMaildirs[i+1]
+	return next.root == km.root && next.depth > km.depth
+}
+
+// Returns the indexes of the known maildirs shown in the sidebar: all of
+// them, but the subfolders of the collapsed folders
+func (amua *Amua) visibleMaildirs() []int {
+	ret := make([]int, 0, len(amua.knownMaildirs))
+	hideBelow := -1
+	for i := range amua.knownMaildirs {
+		km := &amua.knownMaildirs[i]
+		if hideBelow >= 0 && km.depth > hideBelow {
+			continue
+		}
+		hideBelow = -1
+		if km.collapsed {
+			hideBelow = km.depth
 		}
+		ret = append(ret, i)
 	}
-	return nil
+	return ret
 }
-func (amua *Amua) RefreshMaildir(g *gocui.Gui, v *gocui.View) error {
-	md, err := LoadMaildir(amua.knownMaildirs[amua.curMaildir].path, true)
+
+// Returns the index of the known maildir under the sidebar's cursor
+func (amua *Amua) selectedMaildir(v *gocui.View) int {
+	_, oy := v.Origin()
+	_, cy := v.Cursor()
+	visible := amua.visibleMaildirs()
+	if oy+cy >= len(visible) {
+		return visible[len(visible)-1]
+	}
+	return visible[oy+cy]
+}
+
+// Runs the folder command of mode on the folder under the cursor, then
+// finds the folders of the maildir roots again
+func (amua *Amua) folderCommand(g *gocui.Gui, mode Mode, input string) error {
+	km := &amua.knownMaildirs[amua.folderTarget]
+	if mode != CommandNewFolderMode && km.maildir == amua.curMaildirView.md {
+		/* the changes would be lost otherwise */
+		err := amua.applyCurMaildirChanges()
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	var path string
+	switch mode {
+	case CommandNewFolderMode:
+		path, err = createFolder(km, input)
+		if err == nil {
+			setStatus("Created " + path)
+		}
+	case CommandRenameFolderMode:
+		path, err = renameFolder(km, input)
+		if err == nil {
+			setStatus("Renamed to " + path)
+		}
+	case CommandDeleteFolderMode:
+		if input != "yes" {
+			amua.clearStatus()
+			return nil
+		}
+		err = deleteFolder(km)
+		if err == nil {
+			setStatus("Deleted " + km.path)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	amua.knownMaildirs[amua.curMaildir].maildir = md
-	mdv := &MaildirView{md: md}
-	amua.curMaildirView = mdv
-	v.SetCursor(0, 0)
-	v.SetOrigin(0, 0)
-	err = amua.curMaildirView.Draw(v)
+	return amua.refreshFolders(g)
+}
+
+// Finds the folders of the maildir roots again, after one was created,
+// renamed or deleted. The maildirs that are gone stop being monitored,
+// and the current one is replaced by the first maildir if it's gone.
+func (amua *Amua) refreshFolders(g *gocui.Gui) error {
+	configured := []knownMaildir{}
+	searches := []knownMaildir{}
+	outboxes := []knownMaildir{}
+	prev := make(map[string]*knownMaildir)
+	for i := range amua.knownMaildirs {
+		km := &amua.knownMaildirs[i]
+		switch {
+		case km.isVirtual():
+			searches = append(searches, *km)
+		case amua.isOutbox(km):
+			outboxes = append(outboxes, *km)
+		case km.root != "":
+			prev[km.path] = km
+		default:
+			configured = append(configured, *km)
+		}
+	}
+	folders, err := discoverKnownMaildirs(cfg.AmuaConfig.MaildirRoots, prev, amua.onChange)
 	if err != nil {
-		fmt.Fprintf(v, err.Error())
+		return err
+	}
+	found := make(map[string]bool)
+	for _, km := range folders {
+		found[km.path] = true
+		if prev[km.path] == nil {
+			searchIndex.sync(km.path)
+		}
+	}
+	for path, km := range prev {
+		if found[path] {
+			continue
+		}
+		km.Stop()
+		km.maildir.cache.remove()
+		/* forgets its messages */
+		searchIndex.sync(path)
+		for _, s := range searches {
+			s.maildir.dropSource(km.maildir)
+		}
+	}
+	known := append(configured, folders...)
+	known = append(known, searches...)
+	amua.knownMaildirs = append(known, outboxes...)
+	cur := -1
+	for i, km := range amua.knownMaildirs {
+		if km.maildir == amua.curMaildirView.md {
+			cur = i
+		}
+	}
+	sv, _ := g.View(SIDE_VIEW)
+	if cur != -1 {
+		amua.curMaildir = cur
+	} else {
+		amua.curMaildir = 0
+		mv, err := g.View(MAILDIR_VIEW)
+		if err != nil {
+			return err
+		}
+		err = amua.RefreshMaildir(g, mv)
+		if err != nil {
+			return err
+		}
+	}
+	if sv != nil {
+		_, oy := sv.Origin()
+		if _, cy := sv.Cursor(); oy+cy >= len(amua.visibleMaildirs()) {
+			showSideRow(sv, 0)
+		}
+		drawKnownMaildirs(amua, g, sv)
 	}
-	drawSlider(amua, g)
-
 	return nil
 }
 
+// Returns the counts shown in the sidebar: (+new unread/total !flagged),
+// only the ones that aren't zero, or just (total) if everything was read
+func countsString(c maildirCounts) string {
+	if c.unread == 0 && c.flagged == 0 {
+		return fmt.Sprintf("(%d)", c.total)
+	}
+	ret := fmt.Sprintf("%d/%d", c.unread, c.total)
+	if c.fresh > 0 {
+		ret = fmt.Sprintf("+%d %s", c.fresh, ret)
+	}
+	if c.flagged > 0 {
+		ret = fmt.Sprintf("%s !%d", ret, c.flagged)
+	}
+	return "(" + ret + ")"
+}
+
+// Returns the index of the first known maildir after the current one that
+// holds unread messages, or -1
+func (amua *Amua) nextUnreadMaildir() int {
+	n := len(amua.knownMaildirs)
+	for k := 1; k < n; k++ {
+		i := (amua.curMaildir + k) % n
+		km := &amua.knownMaildirs[i]
+		if !km.isVirtual() && km.maildir.Counts().unread > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Expands the folders above the i-th known maildir, so that it's shown
+func (amua *Amua) expandParents(i int) {
+	km := &amua.knownMaildirs[i]
+	depth := km.depth
+	for j := i - 1; j >= 0 && depth > 0; j-- {
+		p := &amua.knownMaildirs[j]
+		if p.root != km.root {
+			break
+		}
+		if p.depth < depth {
+			p.collapsed = false
+			depth = p.depth
+		}
+	}
+}
+
+// Makes the i-th known maildir the current one, and moves the sidebar's
+// cursor to it
+func (amua *Amua) openMaildir(g *gocui.Gui, i int) error {
+	if amua.curMaildir != i {
+		amua.knownMaildirs[amua.curMaildir].maildir.SetActive(false)
+		amua.curMaildir = i
+		mv, err := g.View(MAILDIR_VIEW)
+		if err != nil {
+			return err
+		}
+		err = amua.RefreshMaildir(g, mv)
+		if err != nil {
+			return err
+		}
+	}
+	sv, err := g.View(SIDE_VIEW)
+	if err != nil {
+		return err
+	}
+	for row, j := range amua.visibleMaildirs() {
+		if j == i {
+			showSideRow(sv, row)
+		}
+	}
+	return drawKnownMaildirs(amua, g, sv)
+}
+
 func drawKnownMaildirs(amua *Amua, g *gocui.Gui, v *gocui.View) error {
 	v.Clear()
 	v.Frame = false
 	w, h := v.Size()
-	displayed := len(amua.knownMaildirs)
-	if len(amua.knownMaildirs) > h {
-		displayed = h
-	}
-	fillers := h - displayed
+	visible := amua.visibleMaildirs()
+	/* all the rows are drawn, the origin of the view scrolls them */
+	fillers := h - len(visible)
 	space := 1
-	for i := 0; i < displayed; i++ {
+	for _, i := range visible {
 		current := amua.knownMaildirs[i].maildir == amua.curMaildirView.md
-		nrMsgs := fmt.Sprintf("(%d)", len(amua.knownMaildirs[i].maildir.messages))
+		km := &amua.knownMaildirs[i]
+		counts := km.maildir.Counts()
+		nrMsgs := countsString(counts)
+		name := km.name
+		failing := false
+		if amua.isOutbox(km) {
+			st := amua.outbox.Status()
+			nrMsgs = st.String(time.Now())
+			failing = st.failing > 0
+		}
+		if km.isVirtual() {
+			/* the saved searches are only run once selected */
+			if !km.maildir.IsActive() && km.maildir.Generation() == 0 {
+				nrMsgs = "(?)"
+			}
+		}
+		if km.root != "" {
+			marker := "  "
+			if amua.hasSubfolders(i) {
+				marker = "- "
+				if km.collapsed {
+					marker = "+ "
+				}
+			}
+			name = strings.Repeat("  ", km.depth) + marker + name
+		}
 		availableWidth := w - space - len(nrMsgs) - 3
-		strfmt := fmt.Sprintf(" %%-%ds %s ", availableWidth, nrMsgs)
-		str := fmt.Sprintf(strfmt, util.TruncateString(amua.knownMaildirs[i].path, availableWidth))
-		if current {
+		str := fmt.Sprintf(" %s %s ", util.PadRight(name, availableWidth), nrMsgs)
+		switch {
+		case current:
 			colorstring.Fprintf(v, "[bold]%s", str)
-		} else {
+		case failing:
+			colorstring.Fprintf(v, "[red]%s", str)
+		case counts.fresh > 0:
+			colorstring.Fprintf(v, "[green]%s", str)
+		default:
 			fmt.Fprint(v, str)
 		}
-		fmt.Fprintf(v, strings.Repeat(" ", space-1))
+		fmt.Fprint(v, strings.Repeat(" ", space-1))
 		fmt.Fprintln(v, "|")
 	}
 	for i := 0; i < fillers; i++ {
-		fmt.Fprintf(v, strings.Repeat(" ", w-1))
+		fmt.Fprint(v, strings.Repeat(" ", w-1))
 		fmt.Fprintln(v, "|")
 	}
 	return nil
 }
 func selectNewMaildir(amua *Amua) func(g *gocui.Gui, v *gocui.View) error {
 	return func(g *gocui.Gui, v *gocui.View) error {
-		_, oy := v.Origin()
-		_, cy := v.Cursor()
-		selected := oy + cy
-		if amua.curMaildir != selected {
-			amua.knownMaildirs[amua.curMaildir].active = false
-			amua.curMaildir = selected
-			mv, err := g.View(MAILDIR_VIEW)
-			if err != nil {
-				return err
-			}
-			err = amua.RefreshMaildir(g, mv)
-			if err != nil {
-				return err
-			}
+		err := amua.openMaildir(g, amua.selectedMaildir(v))
+		if err != nil {
+			return err
 		}
-		drawKnownMaildirs(amua, g, v)
 		switchToMode(amua, g, MaildirMode)
 		return nil
 	}
@@ -232,7 +619,7 @@ func modeToViewStr(mode Mode) string {
 	case MessageMode:
 		return MESSAGE_VIEW
 	case MessageMimeMode:
-		return MESSAGE_VIEW
+		return ATTACH_VIEW
 	case KnownMaildirsMode:
 		return SIDE_VIEW
 	case CommandSearchMode:
@@ -245,13 +632,29 @@ func modeToViewStr(mode Mode) string {
 		return STATUS_VIEW
 	case CommandMailModeBcc:
 		return STATUS_VIEW
+	case CommandMoveMode:
+		return STATUS_VIEW
+	case CommandCopyMode:
+		return STATUS_VIEW
+	case CommandTagMode:
+		return STATUS_VIEW
+	case CommandUntagMode:
+		return STATUS_VIEW
+	case CommandLimitMode:
+		return STATUS_VIEW
+	case CommandSaveAttachmentMode:
+		return STATUS_VIEW
+	case CommandPipeAttachmentMode, CommandPipeMessageMode:
+		return STATUS_VIEW
+	case CommandNewFolderMode, CommandRenameFolderMode, CommandDeleteFolderMode:
+		return STATUS_VIEW
 	case SendMailMode:
 		return SEND_MAIL_VIEW
 	}
 	return ""
 }
 func (mode Mode) IsHighlighted() bool {
-	return mode != MessageMode && mode != MessageMimeMode
+	return mode != MessageMode
 }
 
 const SEARCH_PROMPT = "Search: "
@@ -259,31 +662,130 @@ const TO_PROMPT = "To: "
 const CC_PROMPT = "Cc: "
 const BCC_PROMPT = "Bcc: "
 const SUBJECT_PROMPT = "Subject: "
+const MOVE_PROMPT = "Move to: "
+const COPY_PROMPT = "Copy to: "
+const TAG_PROMPT = "Tag pattern: "
+const UNTAG_PROMPT = "Untag pattern: "
+const LIMIT_PROMPT = "Limit to: "
+const SAVE_PROMPT = "Save to: "
+const PIPE_PROMPT = "Pipe to: "
+const NEW_FOLDER_PROMPT = "New folder: "
+const RENAME_FOLDER_PROMPT = "Rename to: "
+const DELETE_FOLDER_PROMPT = "Delete %s and its %d messages? (yes/no): "
+
+// Returns the known maildirs whose path, or the last element of the
+// path, starts with prefix
+func (amua *Amua) maildirCompletions(prefix string) []string {
+	ret := []string{}
+	for i := range amua.knownMaildirs {
+		km := &amua.knownMaildirs[i]
+		if km.isVirtual() || amua.isOutbox(km) {
+			continue
+		}
+		if strings.HasPrefix(km.path, prefix) || strings.HasPrefix(filepath.Base(km.path), prefix) {
+			ret = append(ret, km.path)
+		}
+	}
+	return ret
+}
+
+// Cycles through the candidates matching the prompt's input
+func (amua *Amua) complete() {
+	if amua.mode != CommandMoveMode && amua.mode != CommandCopyMode {
+		return
+	}
+	if amua.completions == nil {
+		amua.completions = amua.maildirCompletions(getPromptInput())
+		amua.completionIdx = -1
+	}
+	if len(amua.completions) == 0 {
+		return
+	}
+	amua.completionIdx = (amua.completionIdx + 1) % len(amua.completions)
+	displayPromptWithPrefill(amua.prompt, amua.completions[amua.completionIdx])
+}
+
+// Returns true if km is the outbox, which only holds the messages queued
+// for sending
+func (amua *Amua) isOutbox(km *knownMaildir) bool {
+	return amua.outbox != nil && km.path == amua.outbox.path
+}
+
+func (amua *Amua) findKnownMaildir(path string) *knownMaildir {
+	for i := range amua.knownMaildirs {
+		km := &amua.knownMaildirs[i]
+		if km.path == path && !km.isVirtual() && !amua.isOutbox(km) {
+			return &amua.knownMaildirs[i]
+		}
+	}
+	return nil
+}
+
+// Copies or moves msgs from the current maildir to the known maildir at
+// target
+func (amua *Amua) transferMessages(msgs []*Message, target string, move bool) error {
+	km := amua.findKnownMaildir(target)
+	if km == nil {
+		return fmt.Errorf("%s is not a known maildir", target)
+	}
+	md := amua.curMaildirView.md
+	for _, m := range msgs {
+		if md.Owner(m) == km.maildir {
+			return fmt.Errorf("Can't copy or move to the same maildir")
+		}
+	}
+	moved := action{}
+	defer func() {
+		amua.undo.push(moved)
+	}()
+	for _, m := range msgs {
+		if move {
+			from := md.Owner(m)
+			key := messageKey(m)
+			nm, err := md.MoveTo(m, km.maildir)
+			if err != nil {
+				return err
+			}
+			moved = append(moved, &moveChange{from: from, to: km.maildir, fromKey: key, toKey: messageKey(nm)})
+			continue
+		}
+		_, err := md.CopyTo(m, km.maildir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func getCommandEditor(amua *Amua) func(*gocui.View, gocui.Key, rune, gocui.Modifier) {
 	return func(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
 		prompt := amua.prompt
+		if key != gocui.KeyTab {
+			amua.completions = nil
+		}
 		// simpleEditor is used as the default gocui editor.
 		switch {
+		case key == gocui.KeyTab:
+			amua.complete()
 		case ch != 0 && mod == 0:
 			v.EditWrite(ch)
 		case key == gocui.KeySpace:
 			v.EditWrite(' ')
 		case key == gocui.KeyBackspace || key == gocui.KeyBackspace2:
 			xc, _ := v.Cursor()
-			if xc <= len(prompt) {
+			if xc <= util.StringWidth(prompt) {
 				return
 			}
 			v.EditDelete(true)
 		case key == gocui.KeyDelete:
 			xc, _ := v.Cursor()
-			if xc <= len(prompt) {
+			if xc <= util.StringWidth(prompt) {
 				return
 			}
 			v.EditDelete(false)
 		case key == gocui.KeyArrowLeft:
 			xc, _ := v.Cursor()
-			if xc <= len(prompt) {
+			if xc <= util.StringWidth(prompt) {
 				return
 			}
 			v.MoveCursor(-1, 0, false)
@@ -293,6 +795,15 @@ func getCommandEditor(amua *Amua) func(*gocui.View, gocui.Key, rune, gocui.Modif
 	}
 }
 
+// Drops the message being composed, and lets the queued message that was
+// being edited be sent again
+func (amua *Amua) discardNewMail() {
+	if amua.newMail.outboxKey != "" {
+		amua.outbox.Release(amua.newMail.outboxKey)
+	}
+	amua.newMail = NewMail{}
+}
+
 func (amua *Amua) sendMailDraw(v *gocui.View) error {
 	v.Clear()
 	v.Frame = false
@@ -312,11 +823,18 @@ func (amua *Amua) sendMailDraw(v *gocui.View) error {
 	return nil
 }
 func switchToMode(amua *Amua, g *gocui.Gui, mode Mode) error {
+	if (mode == MessageMode || mode == MessageMimeMode) && amua.curMessage() == nil {
+		/* empty maildir */
+		return nil
+	}
 	/* highlight off */
 	if amua.mode.IsHighlighted() {
 		v := modeToView(g, amua.mode)
 		v.Highlight = false
 	}
+	if mode == MessageMimeMode && (amua.mode == MaildirMode || amua.mode == MessageMode) {
+		amua.attachRetMode = amua.mode
+	}
 	amua.prevMode = amua.mode
 	amua.mode = mode
 	curview := modeToViewStr(amua.mode)
@@ -324,11 +842,17 @@ func switchToMode(amua *Amua, g *gocui.Gui, mode Mode) error {
 	switch amua.mode {
 	case MessageMode:
 		m := amua.curMessage()
-		m.Flags |= Seen
+		amua.curMaildirView.md.SetFlags(m, Seen, 0)
 		err = m.Draw(amua, g)
 	case MessageMimeMode:
 		m := amua.curMessage()
-		err = (*MessageAsMimeTree)(m).Draw(amua, g)
+		if amua.attachments == nil || amua.attachments.msg != m {
+			amua.attachments, err = NewAttachmentView(m)
+		}
+		if err == nil {
+			v, _ := g.View(curview)
+			err = amua.attachments.Draw(v)
+		}
 	case MaildirMode:
 		v, _ := g.View(curview)
 		err = amua.curMaildirView.Draw(v)
@@ -345,6 +869,32 @@ func switchToMode(amua *Amua, g *gocui.Gui, mode Mode) error {
 		displayPromptWithPrefill(CC_PROMPT, util.ConcatAddresses(amua.newMail.cc))
 	case CommandMailModeBcc:
 		displayPromptWithPrefill(BCC_PROMPT, util.ConcatAddresses(amua.newMail.bcc))
+	case CommandMoveMode:
+		displayPrompt(MOVE_PROMPT)
+	case CommandCopyMode:
+		displayPrompt(COPY_PROMPT)
+	case CommandTagMode:
+		displayPrompt(TAG_PROMPT)
+	case CommandUntagMode:
+		displayPrompt(UNTAG_PROMPT)
+	case CommandLimitMode:
+		displayPromptWithPrefill(LIMIT_PROMPT, amua.curMaildirView.limit)
+	case CommandSaveAttachmentMode:
+		name := ""
+		if p, err := amua.attachments.selected(); err == nil {
+			name = attachmentName(p)
+		}
+		displayPromptWithPrefill(SAVE_PROMPT, name)
+	case CommandPipeAttachmentMode, CommandPipeMessageMode:
+		displayPrompt(PIPE_PROMPT)
+	case CommandNewFolderMode:
+		displayPrompt(NEW_FOLDER_PROMPT)
+	case CommandRenameFolderMode:
+		name := amua.knownMaildirs[amua.folderTarget].name
+		displayPromptWithPrefill(RENAME_FOLDER_PROMPT, name[strings.LastIndex(name, "/")+1:])
+	case CommandDeleteFolderMode:
+		km := &amua.knownMaildirs[amua.folderTarget]
+		displayPrompt(fmt.Sprintf(DELETE_FOLDER_PROMPT, km.name, km.maildir.Len()))
 	case CommandSearchMode:
 		displayPrompt(SEARCH_PROMPT)
 	}
@@ -352,7 +902,7 @@ func switchToMode(amua *Amua, g *gocui.Gui, mode Mode) error {
 	if err != nil {
 		v, _ := g.View(curview)
 		if v != nil {
-			fmt.Fprintf(v, err.Error())
+			fmt.Fprint(v, err.Error())
 		}
 		/* we printed the error, fallback */
 	}
@@ -390,12 +940,40 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 	}
 	maildirAllDown := func() func(g *gocui.Gui, v *gocui.View) error {
 		return func(g *gocui.Gui, v *gocui.View) error {
-			dy := len(amua.curMaildirView.md.messages) - amua.curMaildirView.cur - 1
+			dy := amua.curMaildirView.Len() - amua.curMaildirView.cur - 1
 			amua.curMaildirView.scroll(v, dy)
 			drawSlider(amua, g)
 			return nil
 		}
 	}
+	attachmentMove := func(dy int) func(g *gocui.Gui, v *gocui.View) error {
+		return func(g *gocui.Gui, v *gocui.View) error {
+			amua.attachments.scroll(v, dy)
+			return nil
+		}
+	}
+	leaveAttachments := func(g *gocui.Gui, v *gocui.View) error {
+		return switchToMode(amua, g, amua.attachRetMode)
+	}
+	attachmentPrompt := func(mode Mode) func(g *gocui.Gui, v *gocui.View) error {
+		return func(g *gocui.Gui, v *gocui.View) error {
+			if _, err := amua.attachments.selected(); err != nil {
+				setStatus(err.Error())
+				return nil
+			}
+			return switchToMode(amua, g, mode)
+		}
+	}
+	openAttachment := func(g *gocui.Gui, v *gocui.View) error {
+		p, err := amua.attachments.selected()
+		if err == nil {
+			err = amua.openAttachment(g, p)
+		}
+		if err != nil {
+			setStatus(err.Error())
+		}
+		return nil
+	}
 	messageModeToggle := func(g *gocui.Gui, v *gocui.View) error {
 		switch amua.mode {
 		case MessageMode:
@@ -405,44 +983,95 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 		}
 		return nil
 	}
-	search := func(forward bool) func(g *gocui.Gui, v *gocui.View) error {
-		return func(g *gocui.Gui, v *gocui.View) error {
-			setStatus("Looking for: " + amua.searchPattern + " in " + amua.curMaildirView.md.path)
-			found := false
+	/* fresh is true when the pattern was just entered: a fuzzy search
+	 * then starts from its closest match */
+	doSearch := func(g *gocui.Gui, forward bool, fresh bool) error {
+		if amua.searchPattern == "" {
+			return nil
+		}
+		mv := amua.curMaildirView
+		setStatus("Looking for: " + amua.searchPattern + " in " + mv.md.path)
+		matches, others, err := amua.searchMatcher(amua.searchPattern)
+		if err != nil {
+			setStatus("Invalid search: " + err.Error())
+			return nil
+		}
+		found := -1
+		if query.IsFuzzy(matches.expr) {
+			/* walk the matches from the closest to the farthest */
+			ranked := rankMatches(mv, matches)
+			pos := -1
+			for i, r := range ranked {
+				if r.idx == mv.cur {
+					pos = i
+					break
+				}
+			}
+			switch {
+			case len(ranked) == 0:
+			case fresh || pos == -1:
+				pos = 0
+				if !forward {
+					pos = len(ranked) - 1
+				}
+			case forward:
+				pos = (pos + 1) % len(ranked)
+			default:
+				pos = (pos + len(ranked) - 1) % len(ranked)
+			}
+			if pos != -1 && len(ranked) > 0 {
+				found = ranked[pos].idx
+				setStatus(fmt.Sprintf("Found: %s in %s (%d/%d, %.0f%% close)", amua.searchPattern,
+					mv.md.path, pos+1, len(ranked), 100*ranked[pos].closeness))
+			}
+		} else {
 			direction := 1
 			if forward == false {
 				direction = -1
 			}
-			for i := 0; i < len(amua.curMaildirView.md.messages); i++ {
-				idx := ((direction * i) + amua.curMaildirView.cur + direction) % len(amua.curMaildirView.md.messages)
+			nrMsgs := mv.Len()
+			for i := 0; i < nrMsgs; i++ {
+				idx := ((direction * i) + mv.cur + direction) % nrMsgs
 				if idx < 0 {
-					idx = len(amua.curMaildirView.md.messages) + idx
+					idx = nrMsgs + idx
 				}
 				if idx < 0 {
 					panic(idx)
 				}
 				m := amua.getMessage(idx)
-				if strings.Contains(m.Subject, amua.searchPattern) {
-					setStatus("Found: " + amua.searchPattern + " in " + amua.curMaildirView.md.path)
-					found = true
-					amua.curMaildirView.curTop = idx
-					amua.curMaildirView.cur = idx
+				if m != nil && matches.Match(m) {
+					setStatus("Found: " + amua.searchPattern + " in " + mv.md.path)
+					found = idx
 					break
 				}
 			}
-			if found {
-				mv, err := g.View(MAILDIR_VIEW)
-				if err != nil {
-					return err
-				}
-				err = amua.curMaildirView.Draw(mv)
-				if err != nil {
-					setStatus(err.Error())
-				}
-			} else {
-				setStatus(amua.searchPattern + " not found")
+		}
+		if found != -1 {
+			mv.curTop = found
+			mv.cur = found
+			v, err := g.View(MAILDIR_VIEW)
+			if err != nil {
+				return err
 			}
-			return nil
+			err = mv.Draw(v)
+			if err != nil {
+				setStatus(err.Error())
+			}
+		} else if len(others) > 0 {
+			elsewhere := []string{}
+			for mdPath, n := range others {
+				elsewhere = append(elsewhere, fmt.Sprintf("%s (%d)", mdPath, n))
+			}
+			sort.Strings(elsewhere)
+			setStatus(amua.searchPattern + " not found, but found in " + strings.Join(elsewhere, ", "))
+		} else {
+			setStatus(amua.searchPattern + " not found")
+		}
+		return nil
+	}
+	search := func(forward bool) func(g *gocui.Gui, v *gocui.View) error {
+		return func(g *gocui.Gui, v *gocui.View) error {
+			return doSearch(g, forward, false)
 		}
 	}
 	enterSearch := func(forward bool) func(g *gocui.Gui, v *gocui.View) error {
@@ -455,42 +1084,94 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			prompt := amua.prompt
 			amua.searchPattern = strings.TrimSpace(string(spbuf[len(prompt):]))
 			switchToMode(amua, g, MaildirMode)
-			search(forward)(g, v)
-			return nil
+			return doSearch(g, forward, true)
 		}
 	}
 	cancelSearch := func(g *gocui.Gui, v *gocui.View) error {
-		setStatus("")
+		if amua.mode == CommandNewMailMode {
+			amua.discardNewMail()
+		}
+		amua.tagPrefix = false
+		amua.clearStatus()
 		return switchToMode(amua, g, amua.prevMode)
 	}
 	setFlag := func(flag MessageFlags) func(g *gocui.Gui, v *gocui.View) error {
 		return func(g *gocui.Gui, v *gocui.View) error {
-			m := amua.curMessage()
-			m.Flags |= flag
+			amua.undo.push(changeFlags(amua.curMaildirView.md, amua.targetMessages(), flag, 0))
 			amua.curMaildirView.Draw(v)
 			return nil
 		}
 	}
 	unsetFlag := func(flag MessageFlags) func(g *gocui.Gui, v *gocui.View) error {
 		return func(g *gocui.Gui, v *gocui.View) error {
-			m := amua.curMessage()
-			m.Flags &= ^flag
+			amua.undo.push(changeFlags(amua.curMaildirView.md, amua.targetMessages(), 0, flag))
 			amua.curMaildirView.Draw(v)
 			return nil
 		}
 	}
 	toggleFlag := func(flag MessageFlags) func(g *gocui.Gui, v *gocui.View) error {
 		return func(g *gocui.Gui, v *gocui.View) error {
-			m := amua.curMessage()
-			if (m.Flags & flag) != 0 {
-				m.Flags &= ^flag
+			msgs := amua.targetMessages()
+			/* the flag is cleared only if all the messages have it */
+			allSet := len(msgs) > 0
+			for _, m := range msgs {
+				if (m.Flags & flag) == 0 {
+					allSet = false
+				}
+			}
+			md := amua.curMaildirView.md
+			if allSet {
+				amua.undo.push(changeFlags(md, msgs, 0, flag))
 			} else {
-				m.Flags |= flag
+				amua.undo.push(changeFlags(md, msgs, flag, 0))
 			}
 			amua.curMaildirView.Draw(v)
 			return nil
 		}
 	}
+	undoRedo := func(redo bool) func(g *gocui.Gui, v *gocui.View) error {
+		return func(g *gocui.Gui, v *gocui.View) error {
+			var n int
+			var err error
+			if redo {
+				n, err = amua.undo.Redo()
+			} else {
+				n, err = amua.undo.Undo()
+			}
+			amua.curMaildirView.Sort()
+			amua.curMaildirView.Draw(v)
+			drawSlider(amua, g)
+			sv, _ := g.View(SIDE_VIEW)
+			drawKnownMaildirs(amua, g, sv)
+			switch {
+			case err != nil:
+				setStatus(err.Error())
+			case redo:
+				setStatus(fmt.Sprintf("Redid %d changes", n))
+			default:
+				setStatus(fmt.Sprintf("Undid %d changes", n))
+			}
+			return nil
+		}
+	}
+	tagPrefix := func(g *gocui.Gui, v *gocui.View) error {
+		if len(amua.taggedMessages()) == 0 {
+			setStatus("No tagged messages")
+			return nil
+		}
+		amua.tagPrefix = true
+		setStatus("tag-")
+		return nil
+	}
+	cycleSortMode := func(g *gocui.Gui, v *gocui.View) error {
+		mv := amua.curMaildirView
+		mv.sortMode = (mv.sortMode + 1) % MaxSortMode
+		mv.Sort()
+		setStatus("Sorting by " + sortModeTxt[mv.sortMode])
+		mv.Draw(v)
+		drawSlider(amua, g)
+		return nil
+	}
 	quit := func(g *gocui.Gui, v *gocui.View) error {
 		amua.applyCurMaildirChanges()
 		return gocui.ErrQuit
@@ -501,6 +1182,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 	unreadMessage := unsetFlag(Seen)
 	readMessage := setFlag(Seen)
 	toggleFlagged := toggleFlag(Flagged)
+	toggleTagged := toggleFlag(Tagged)
 
 	syncMaildir := func(g *gocui.Gui, v *gocui.View) error {
 		amua.applyCurMaildirChanges()
@@ -509,10 +1191,130 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 		drawKnownMaildirs(amua, g, v)
 		return nil
 	}
+	jumpToUnread := func(g *gocui.Gui, v *gocui.View) error {
+		i := amua.nextUnreadMaildir()
+		if i == -1 {
+			setStatus("No other maildir has unread messages")
+			return nil
+		}
+		amua.expandParents(i)
+		err := amua.openMaildir(g, i)
+		if err != nil {
+			return err
+		}
+		return switchToMode(amua, g, MaildirMode)
+	}
+	toggleFolder := func(g *gocui.Gui, v *gocui.View) error {
+		i := amua.selectedMaildir(v)
+		if !amua.hasSubfolders(i) {
+			return nil
+		}
+		amua.knownMaildirs[i].collapsed = !amua.knownMaildirs[i].collapsed
+		return drawKnownMaildirs(amua, g, v)
+	}
+	folderPrompt := func(mode Mode) func(g *gocui.Gui, v *gocui.View) error {
+		return func(g *gocui.Gui, v *gocui.View) error {
+			i := amua.selectedMaildir(v)
+			if amua.knownMaildirs[i].root == "" {
+				displayError(amua.knownMaildirs[i].name + " is not under a maildir root")
+				return nil
+			}
+			amua.folderTarget = i
+			return switchToMode(amua, g, mode)
+		}
+	}
 	commandEnter := func(g *gocui.Gui, v *gocui.View) error {
 		switch amua.mode {
 		case CommandSearchMode:
 			return enterSearch(true)(g, v)
+		case CommandSaveAttachmentMode, CommandPipeAttachmentMode:
+			input := getPromptInput()
+			save := amua.mode == CommandSaveAttachmentMode
+			switchToMode(amua, g, MessageMimeMode)
+			p, err := amua.attachments.selected()
+			if err == nil && input != "" {
+				if save {
+					err = saveAttachment(p, input)
+					if err == nil {
+						setStatus("Saved to " + input)
+					}
+				} else {
+					err = pipeAttachment(g, p, input)
+					switchToMode(amua, g, MessageMimeMode)
+				}
+			}
+			if err != nil {
+				setStatus(err.Error())
+			}
+		case CommandLimitMode:
+			limit := getPromptInput()
+			if limit == "all" {
+				limit = ""
+			}
+			err := amua.curMaildirView.SetLimit(limit)
+			switchToMode(amua, g, MaildirMode)
+			drawSlider(amua, g)
+			if err != nil {
+				setStatus("Invalid limit: " + err.Error())
+			} else {
+				amua.clearStatus()
+			}
+		case CommandTagMode, CommandUntagMode:
+			tag := amua.mode == CommandTagMode
+			n, err := amua.tagPattern(getPromptInput(), tag)
+			switchToMode(amua, g, MaildirMode)
+			if err != nil {
+				setStatus("Invalid pattern: " + err.Error())
+			} else if tag {
+				setStatus(fmt.Sprintf("Tagged %d messages", n))
+			} else {
+				setStatus(fmt.Sprintf("Untagged %d messages", n))
+			}
+		case CommandNewFolderMode, CommandRenameFolderMode, CommandDeleteFolderMode:
+			mode := amua.mode
+			input := getPromptInput()
+			switchToMode(amua, g, KnownMaildirsMode)
+			err := amua.folderCommand(g, mode, input)
+			if err != nil {
+				displayError(err.Error())
+			}
+		case CommandPipeMessageMode:
+			command := getPromptInput()
+			msgs := amua.targetMessages()
+			mode := MaildirMode
+			if amua.prevMode == MessageMode {
+				mode = MessageMode
+			}
+			switchToMode(amua, g, mode)
+			if command == "" || len(msgs) == 0 {
+				return nil
+			}
+			if err := pipeMessages(g, msgs, command); err != nil {
+				setStatus(err.Error())
+			}
+		case CommandMoveMode, CommandCopyMode:
+			move := amua.mode == CommandMoveMode
+			target := getPromptInput()
+			msgs := amua.targetMessages()
+			if len(msgs) == 0 {
+				return switchToMode(amua, g, MaildirMode)
+			}
+			err := amua.transferMessages(msgs, target, move)
+			if err != nil {
+				displayError(err.Error())
+				return nil
+			}
+			if move {
+				setStatus("Moved to " + target)
+			} else {
+				setStatus("Copied to " + target)
+			}
+			sv, _ := g.View(SIDE_VIEW)
+			drawKnownMaildirs(amua, g, sv)
+			if move || amua.prevMode != MessageMode {
+				return switchToMode(amua, g, MaildirMode)
+			}
+			return switchToMode(amua, g, MessageMode)
 		case CommandMailModeTo:
 			var err error
 			amua.newMail.to, err = mail.ParseAddressList(getPromptInput())
@@ -520,7 +1322,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 				displayError(err.Error())
 				return nil
 			}
-			setStatus("")
+			amua.clearStatus()
 			switchToMode(amua, g, SendMailMode)
 		case CommandMailModeCc:
 			var err error
@@ -529,7 +1331,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 				//flash error
 				return nil
 			}
-			setStatus("")
+			amua.clearStatus()
 			switchToMode(amua, g, SendMailMode)
 		case CommandMailModeBcc:
 			var err error
@@ -538,7 +1340,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 				//flash error
 				return nil
 			}
-			setStatus("")
+			amua.clearStatus()
 			switchToMode(amua, g, SendMailMode)
 		case CommandNewMailMode:
 			if len(amua.newMail.to) == 0 {
@@ -574,7 +1376,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 				if err != nil {
 					log.Fatal(err.Error())
 				}
-				setStatus("")
+				amua.clearStatus()
 				switchToMode(amua, g, SendMailMode)
 				err = g.Sync()
 				if err != nil {
@@ -585,24 +1387,91 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 		return nil
 	}
 	sendMail := func(g *gocui.Gui, v *gocui.View) error {
-		err := send(&amua.newMail, cfg)
+		err := send(&amua.newMail, cfg, amua.outbox)
 		if err != nil {
 			setStatus(err.Error())
 			return nil
 		}
-		setStatus("Sent to " + cfg.SMTPConfig.Host)
+		setStatus("Queued for sending")
 		switchToMode(amua, g, MaildirMode)
 		amua.newMail = NewMail{}
+		sv, _ := g.View(SIDE_VIEW)
+		drawKnownMaildirs(amua, g, sv)
+		return nil
+	}
+	leaveMail := func(g *gocui.Gui, v *gocui.View) error {
+		amua.discardNewMail()
+		return switchToMode(amua, g, MaildirMode)
+	}
+	newMessage := func(g *gocui.Gui, v *gocui.View) error {
+		amua.newMail = NewMail{}
+		return switchToMode(amua, g, CommandNewMailMode)
+	}
+	editQueued := func(g *gocui.Gui, v *gocui.View) error {
+		if !amua.isOutbox(&amua.knownMaildirs[amua.curMaildir]) {
+			setStatus("Only the queued messages can be edited")
+			return nil
+		}
+		m := amua.curMessage()
+		if m == nil {
+			return nil
+		}
+		key := messageKey(m)
+		path, err := amua.outbox.Hold(key)
+		if err != nil {
+			displayError(err.Error())
+			return nil
+		}
+		buf, err := ioutil.ReadFile(path)
+		var nm *NewMail
+		if err == nil {
+			nm, err = newMailFromQueued(buf)
+		}
+		if err != nil {
+			amua.outbox.Release(key)
+			displayError(err.Error())
+			return nil
+		}
+		nm.outboxKey = key
+		amua.newMail = *nm
+		return switchToMode(amua, g, CommandNewMailMode)
+	}
+	cancelQueued := func(g *gocui.Gui, v *gocui.View) error {
+		if !amua.isOutbox(&amua.knownMaildirs[amua.curMaildir]) {
+			setStatus("Only the queued messages can be cancelled")
+			return nil
+		}
+		n := 0
+		for _, m := range amua.targetMessages() {
+			err := amua.outbox.Cancel(messageKey(m))
+			if err != nil {
+				displayError(err.Error())
+				break
+			}
+			n++
+		}
+		setStatus(fmt.Sprintf("Cancelled %d queued messages", n))
+		return nil
+	}
+	flushOutbox := func(g *gocui.Gui, v *gocui.View) error {
+		amua.outbox.Flush()
+		setStatus("Sending the queued messages")
 		return nil
 	}
 	reply := func(group bool) func(g *gocui.Gui, v *gocui.View) error {
 		return func(g *gocui.Gui, v *gocui.View) error {
 			m := amua.curMessage()
+			if m == nil {
+				return nil
+			}
+			amua.newMail = NewMail{}
 			amua.newMail.to = buildTo(m)
 			if group {
 				amua.newMail.cc = buildCCs(m)
 			}
 			amua.newMail.subject = "Re: " + m.Subject
+			amua.newMail.inReplyTo = m.MessageId
+			amua.newMail.references = buildReferences(m)
 			buf, err := ioutil.ReadAll((*MessageAsText)(m))
 			if err != nil {
 				return err
@@ -610,27 +1479,30 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			buf = bytes.Replace(buf, []byte("\n"), []byte("\n> "), -1)
 			replyHeader := fmt.Sprintf("On %s, %s wrote:\n> ", m.Date.Format("Mon Jan 2 15:04:05 -0700 MST 2006"), m.From)
 			amua.newMail.body = append([]byte(replyHeader), buf...)
+			amua.newMail.parent = m.path
+			amua.newMail.parentFlag = Replied
 			switchToMode(amua, g, CommandNewMailMode)
 			return nil
 		}
 	}
 	replyMessage := reply(false)
 	groupReplyMessage := reply(true)
-	pipeMessage := func(g *gocui.Gui, v *gocui.View) error {
+	forwardMessage := func(g *gocui.Gui, v *gocui.View) error {
 		m := amua.curMessage()
-		cmd := exec.Command(amua.ExtEditor(), m.path)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		if err := cmd.Run(); err != nil {
-			log.Fatal(err)
+		if m == nil {
+			return nil
 		}
-		setStatus("")
-		switchToMode(amua, g, MaildirMode)
-		err := g.Sync()
+		buf, err := ioutil.ReadAll((*MessageAsText)(m))
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		/* exec a command, pipe the message there */
+		amua.newMail = NewMail{
+			subject:    "Fwd: " + m.Subject,
+			body:       forwardBody(m, buf),
+			parent:     m.path,
+			parentFlag: Passed,
+		}
+		switchToMode(amua, g, CommandNewMailMode)
 		return nil
 	}
 	type keybinding struct {
@@ -653,6 +1525,7 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			{'n', search(true), false},
 			{'N', search(false), false},
 			{'$', syncMaildir, false},
+			{'o', cycleSortMode, false},
 			{'F', toggleFlagged, false},
 			{gocui.KeyCtrlR, readMessage, false},
 			{gocui.KeyCtrlN, unreadMessage, false},
@@ -662,10 +1535,24 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			{gocui.KeyCtrlB, maildirMove(-10), false},
 			{gocui.KeyPgup, maildirMove(-10), false},
 			{'/', switchToModeInt(CommandSearchMode), false},
-			{'m', switchToModeInt(CommandNewMailMode), false},
+			{'m', newMessage, false},
 			{'r', replyMessage, false},
 			{'g', groupReplyMessage, false},
-			{'|', pipeMessage, false},
+			{'|', switchToModeInt(CommandPipeMessageMode), false},
+			{'s', switchToModeInt(CommandMoveMode), false},
+			{'C', switchToModeInt(CommandCopyMode), false},
+			{'t', toggleTagged, false},
+			{'T', switchToModeInt(CommandTagMode), false},
+			{'l', switchToModeInt(CommandLimitMode), false},
+			{gocui.KeyCtrlT, switchToModeInt(CommandUntagMode), false},
+			{';', tagPrefix, false},
+			{gocui.KeyTab, jumpToUnread, false},
+			{'U', undoRedo(false), false},
+			{'Y', undoRedo(true), false},
+			{'e', editQueued, false},
+			{'x', cancelQueued, false},
+			{'S', flushOutbox, false},
+			{'f', forwardMessage, false},
 		},
 		MESSAGE_VIEW: {
 			{'q', switchToModeInt(MaildirMode), false},
@@ -677,15 +1564,30 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			{'k', scrollMessageView(-1), false},
 			{'r', replyMessage, false},
 			{'g', groupReplyMessage, false},
-			{'|', pipeMessage, false},
+			{'f', forwardMessage, false},
+			{'|', switchToModeInt(CommandPipeMessageMode), false},
+			{'s', switchToModeInt(CommandMoveMode), false},
+			{'C', switchToModeInt(CommandCopyMode), false},
+		},
+		ATTACH_VIEW: {
+			{'q', leaveAttachments, false},
+			{'v', messageModeToggle, false},
+			{'j', attachmentMove(1), false},
+			{gocui.KeyArrowDown, attachmentMove(1), false},
+			{'k', attachmentMove(-1), false},
+			{gocui.KeyArrowUp, attachmentMove(-1), false},
+			{'s', attachmentPrompt(CommandSaveAttachmentMode), false},
+			{'|', attachmentPrompt(CommandPipeAttachmentMode), false},
+			{'o', openAttachment, false},
+			{gocui.KeyEnter, openAttachment, false},
 		},
 		SEND_MAIL_VIEW: {
-			{'q', switchToModeInt(MaildirMode), false},
+			{'q', leaveMail, false},
 			{'t', switchToModeInt(CommandMailModeTo), false},
 			{'c', switchToModeInt(CommandMailModeCc), false},
 			{'b', switchToModeInt(CommandMailModeBcc), false},
 			{'y', sendMail, false},
-			{gocui.KeyCtrlG, switchToModeInt(MaildirMode), false},
+			{gocui.KeyCtrlG, leaveMail, false},
 		},
 		STATUS_VIEW: {
 			{gocui.KeyEnter, commandEnter, false},
@@ -695,8 +1597,16 @@ func keybindings(amua *Amua, g *gocui.Gui) error {
 			{'j', scrollSideView(amua, 1), false},
 			{gocui.KeyArrowDown, scrollSideView(amua, 1), false},
 			{'k', scrollSideView(amua, -1), false},
-			{gocui.KeyArrowUp, scrollSideView(amua, 1), false},
+			{gocui.KeyArrowUp, scrollSideView(amua, -1), false},
+			{gocui.KeyPgdn, scrollSideView(amua, 10), false},
+			{gocui.KeyPgup, scrollSideView(amua, -10), false},
+			{gocui.KeyTab, jumpToUnread, false},
 			{gocui.KeyEnter, selectNewMaildir(amua), false},
+			{gocui.KeySpace, toggleFolder, false},
+			{'n', folderPrompt(CommandNewFolderMode), false},
+			{'R', folderPrompt(CommandRenameFolderMode), false},
+			{'D', folderPrompt(CommandDeleteFolderMode), false},
+			{'S', flushOutbox, false},
 		},
 		"": {
 			{gocui.KeyCtrlC, quit, false},
@@ -723,9 +1633,9 @@ func drawSlider(amua *Amua, g *gocui.Gui) {
 	_, h := v.Size()
 	sliderH := 1
 	whites := h - 1
-	if len(amua.curMaildirView.md.messages) > 0 {
-		sliderH = h * h / len(amua.curMaildirView.md.messages)
-		whites = amua.curMaildirView.curTop * h / len(amua.curMaildirView.md.messages)
+	if nrMsgs := amua.curMaildirView.Len(); nrMsgs > 0 {
+		sliderH = h * h / nrMsgs
+		whites = amua.curMaildirView.curTop * h / nrMsgs
 	}
 	if sliderH <= 0 {
 		sliderH = 1
@@ -767,6 +1677,13 @@ func getLayout(amua *Amua) func(g *gocui.Gui) error {
 			}
 			v.Frame = false
 		}
+		v, err = g.SetView(ATTACH_VIEW, int(0.15*float32(maxX)), -1, maxX-1, maxY-1)
+		if err != nil {
+			if err != gocui.ErrUnknownView {
+				return err
+			}
+			v.Frame = false
+		}
 		v, err = g.SetView(MAILDIR_VIEW, int(0.15*float32(maxX)), -1, maxX-1, maxY-1)
 		if err != nil {
 			if err != gocui.ErrUnknownView {
@@ -776,7 +1693,8 @@ func getLayout(amua *Amua) func(g *gocui.Gui) error {
 			if amua.mode == MaildirMode {
 				v.Highlight = true
 			}
-			amua.curMaildirView.Draw(v)
+			/* the first maildir is loaded once it can be shown */
+			amua.RefreshMaildir(g, v)
 			err = g.SetCurrentView(MAILDIR_VIEW)
 			if err != nil {
 				log.Panicln(err)
@@ -805,8 +1723,12 @@ func getLayout(amua *Amua) func(g *gocui.Gui) error {
 type knownMaildir struct {
 	maildir     *Maildir // might be nil if not loaded
 	path        string
+	name        string // what the sidebar shows
+	depth       int    // the indentation in the sidebar, for the folders of a root
+	collapsed   bool   // true if the subfolders are hidden
+	root        string // the maildir root it was found under, if any
+	plusPlus    bool   // true for a Maildir++ folder
 	stopMonitor chan bool
-	active      bool //true if the maildir is actively being displayed, only one is at a given time
 }
 
 func initKnownMaildirs(maildirs []string, onChange onMaildirChangeFn) ([]knownMaildir, error) {
@@ -815,19 +1737,16 @@ func initKnownMaildirs(maildirs []string, onChange onMaildirChangeFn) ([]knownMa
 		var err error
 		var md *Maildir
 		km := &knownMaildirs[i]
-		active := false
-		if i == 0 {
-			active = true
-		}
-		md, err = LoadMaildir(m, active)
+		md, err = LoadMaildir(m, false)
 		if err != nil {
 			return nil, err
 		}
 		km.maildir = md
 		km.path = m
+		km.name = m
 		km.stopMonitor = make(chan bool)
-		km.active = active
-		go km.Start(onChange)
+		mon := *km
+		go mon.Start(onChange)
 	}
 	return knownMaildirs, nil
 }
@@ -856,10 +1775,19 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if len(cfg.AmuaConfig.Maildirs) == 0 {
-		log.Fatal("No maildir defined in '%s', exiting.", *cfgFile)
+	if len(cfg.AmuaConfig.Maildirs) == 0 && len(cfg.AmuaConfig.MaildirRoots) == 0 {
+		log.Fatalf("No maildir defined in '%s', exiting.", *cfgFile)
 
 	}
+	t, err := newTransport(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sentDir = cfg.AmuaConfig.Sent
+	fccHooks, err = compileFccHooks(cfg.AmuaConfig.FccHooks)
+	if err != nil {
+		log.Fatal(err)
+	}
 	amua := &Amua{}
 
 	g := gocui.NewGui()
@@ -869,15 +1797,48 @@ func main() {
 	g.Editor = gocui.EditorFunc(getCommandEditor(amua))
 	defer g.Close()
 
-	onchange := func(km *knownMaildir) {
+	redrawMaildir := func(g *gocui.Gui) error {
+		mv, err := g.View(MAILDIR_VIEW)
+		if err != nil {
+			return err
+		}
+		amua.curMaildirView.Sort()
+		err = amua.curMaildirView.Draw(mv)
+		if err != nil {
+			return err
+		}
+		drawSlider(amua, g)
+		if amua.mode == MaildirMode && amua.curMaildirView.limit != "" {
+			/* update the count */
+			amua.clearStatus()
+		}
+		return nil
+	}
+	onchange := func(md *Maildir) {
 		g.Execute(func(g *gocui.Gui) error {
-			mv, err := g.View(MAILDIR_VIEW)
-			if err != nil {
-				return err
-			}
-			err = amua.RefreshMaildir(g, mv)
-			if err != nil {
-				return err
+			/* the monitor updated the maildir in place, no need to
+			 * reload it from disk */
+			cur := amua.curMaildirView.md
+			if cur.dependsOn(md) {
+				/* the query is run again on the updated source,
+				 * in the background */
+				go func() {
+					err := cur.Load(true)
+					g.Execute(func(g *gocui.Gui) error {
+						if amua.curMaildirView.md != cur {
+							return nil
+						}
+						if err != nil {
+							setStatus(err.Error())
+						}
+						return redrawMaildir(g)
+					})
+				}()
+			} else if md == cur {
+				err := redrawMaildir(g)
+				if err != nil {
+					return err
+				}
 			}
 			v, _ := g.View(SIDE_VIEW)
 			drawKnownMaildirs(amua, g, v)
@@ -885,10 +1846,92 @@ func main() {
 		})
 	}
 
+	indexDir := cfg.AmuaConfig.IndexDir
+	if indexDir == "" {
+		indexDir = filepath.Join(usr.HomeDir, ".amua", "index")
+	}
+	searchIndex, err = newIndexer(indexDir)
+	if err != nil {
+		log.Fatalf("Can't open the search index in %s: %s", indexDir, err.Error())
+	}
+	defer searchIndex.Close()
+
+	if cfg.AmuaConfig.IndexFormat != "" {
+		indexFormat, err = ParseIndexFormat(cfg.AmuaConfig.IndexFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	trashDir = cfg.AmuaConfig.TrashDir
+	if trashDir == "" {
+		trashDir = filepath.Join(usr.HomeDir, ".amua", "trash")
+	}
+	trashDays := cfg.AmuaConfig.TrashDays
+	if trashDays <= 0 {
+		trashDays = 7
+	}
+	/* a trash that can't be purged is still usable */
+	purgeTrash(time.Duration(trashDays) * 24 * time.Hour)
+	headerCacheDir = cfg.AmuaConfig.CacheDir
+	if headerCacheDir == "" {
+		headerCacheDir = filepath.Join(usr.HomeDir, ".amua", "headers")
+	}
 	amua.knownMaildirs, err = initKnownMaildirs(cfg.AmuaConfig.Maildirs, onchange)
 	if err != nil {
 		log.Fatal(err)
 	}
+	amua.onChange = onchange
+	folders, err := discoverKnownMaildirs(cfg.AmuaConfig.MaildirRoots, nil, onchange)
+	if err != nil {
+		log.Fatal(err)
+	}
+	amua.knownMaildirs = append(amua.knownMaildirs, folders...)
+	if len(amua.knownMaildirs) == 0 {
+		log.Fatalf("No maildir found in '%s', exiting.", *cfgFile)
+	}
+	defer func() {
+		for _, km := range amua.knownMaildirs {
+			km.maildir.SaveCache()
+		}
+	}()
+	for _, km := range amua.knownMaildirs {
+		searchIndex.sync(km.path)
+	}
+	searches, err := initSavedSearches(cfg.AmuaConfig.Searches, amua.knownMaildirs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	amua.knownMaildirs = append(amua.knownMaildirs, searches...)
+	outboxDir := cfg.AmuaConfig.OutboxDir
+	if outboxDir == "" {
+		outboxDir = filepath.Join(usr.HomeDir, ".amua", "outbox")
+	}
+	amua.outbox, err = newOutbox(outboxDir, t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outboxes, err := initKnownMaildirs([]string{outboxDir}, onchange)
+	if err != nil {
+		log.Fatal(err)
+	}
+	outboxes[0].name = "[Outbox]"
+	amua.knownMaildirs = append(amua.knownMaildirs, outboxes...)
+	amua.outbox.notify = func(sent int, err error) {
+		g.Execute(func(g *gocui.Gui) error {
+			/* don't overwrite a prompt */
+			if modeToViewStr(amua.mode) != STATUS_VIEW {
+				if err != nil {
+					setStatus(err.Error())
+				} else {
+					setStatus(fmt.Sprintf("Sent %d messages with %s", sent, t))
+				}
+			}
+			v, _ := g.View(SIDE_VIEW)
+			drawKnownMaildirs(amua, g, v)
+			return nil
+		})
+	}
+	go amua.outbox.run()
 	amua.curMaildir = 0
 	amua.prevMode = MaildirMode
 	amua.mode = MaildirMode
@@ -908,9 +1951,9 @@ func main() {
 		v.SetOrigin(0, 0)
 		v.SetCursor(0, 0)
 		v.Editable = true
-		fmt.Fprintf(v, amua.prompt)
-		fmt.Fprintf(v, prefill)
-		v.SetCursor(len(amua.prompt)+len(prefill), 0)
+		fmt.Fprint(v, amua.prompt)
+		fmt.Fprint(v, prefill)
+		v.SetCursor(util.StringWidth(amua.prompt)+util.StringWidth(prefill), 0)
 	}
 	displayPrompt = func(s string) {
 		displayPromptWithPrefill(s, "")
@@ -935,12 +1978,12 @@ func main() {
 		}
 		w, _ := v.Size()
 		v.Clear()
-		format := fmt.Sprintf("\033[7m%%-%ds\033[0m", w)
-		fmt.Fprintf(v, format, s)
+		fmt.Fprintf(v, "\033[7m%s\033[0m", util.PadRight(s, w))
 	}
 	displayError = func(s string) {
 		maxX, maxY := g.Size()
-		if v, err := g.SetView(ERROR_VIEW, maxX/2-len(s), maxY/2, maxX/2+len(s), maxY/2+2); err != nil {
+		sw := util.StringWidth(s)
+		if v, err := g.SetView(ERROR_VIEW, maxX/2-sw, maxY/2, maxX/2+sw, maxY/2+2); err != nil {
 			if err != gocui.ErrUnknownView {
 				return
 			}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"amua/mailcap"
+	"amua/mime"
+	"amua/util"
+
+	"github.com/deweerdt/gocui"
+)
+
+// Lists the MIME parts of a message, and lets the user pick one to save,
+// open or pipe
+type AttachmentView struct {
+	msg    *Message
+	parts  []*mime.MimePart
+	depths []int
+	curTop int
+	cur    int
+}
+
+func (av *AttachmentView) flatten(p *mime.MimePart, depth int) {
+	for cur := p; cur != nil; cur = cur.Next {
+		av.parts = append(av.parts, cur)
+		av.depths = append(av.depths, depth)
+		if cur.Child != nil {
+			av.flatten(cur.Child, depth+1)
+		}
+	}
+}
+
+func NewAttachmentView(m *Message) (*AttachmentView, error) {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mtree, err := mime.GetMimeTree(f, 10)
+	if err != nil {
+		return nil, err
+	}
+	av := &AttachmentView{msg: m}
+	av.flatten(mtree, 0)
+	return av, nil
+}
+
+func (av *AttachmentView) Draw(v *gocui.View) error {
+	v.Clear()
+	v.Frame = false
+	v.Wrap = false
+	_, h := v.Size()
+	if av.cur < av.curTop {
+		av.curTop = av.cur
+	}
+	if av.cur >= av.curTop+h {
+		av.curTop = av.cur - h + 1
+	}
+	v.SetOrigin(0, av.curTop)
+	v.SetCursor(0, av.cur-av.curTop)
+	for i, p := range av.parts {
+		size := ""
+		if p.Buf != nil {
+			size = util.SiteToHuman(int64(p.Buf.Len()))
+		}
+		mt := strings.Repeat("  ", av.depths[i]) + mime.MimeTypeTxt(p.MimeType)
+		fmt.Fprintf(v, "%-4d %-40s %8s  %s\n", i, mt, size, p.Name)
+	}
+	return nil
+}
+
+func (av *AttachmentView) scroll(v *gocui.View, dy int) {
+	av.cur += dy
+	if av.cur >= len(av.parts) {
+		av.cur = len(av.parts) - 1
+	}
+	if av.cur < 0 {
+		av.cur = 0
+	}
+	av.Draw(v)
+}
+
+// Returns the selected part, or an error if it has no content of its own
+func (av *AttachmentView) selected() (*mime.MimePart, error) {
+	if av.cur >= len(av.parts) {
+		return nil, fmt.Errorf("No attachment selected")
+	}
+	p := av.parts[av.cur]
+	if p.MimeType.IsMultipart() || p.Buf == nil {
+		return nil, fmt.Errorf("%s is a container, select one of its parts", mime.MimeTypeTxt(p.MimeType))
+	}
+	return p, nil
+}
+
+// Returns a file name for p, safe to use in a directory of our choosing
+func attachmentName(p *mime.MimePart) string {
+	name := filepath.Base(p.Name)
+	if name == "." || name == "/" || name == ".." || name == "" {
+		return "attachment"
+	}
+	return name
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+// Writes p to path, refusing to overwrite an existing file
+func saveAttachment(p *mime.MimePart, path string) error {
+	f, err := os.OpenFile(expandHome(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p.Buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Runs a command attached to the terminal, and waits for it to complete
+func runInTerminal(g *gocui.Gui, cmd *exec.Cmd) error {
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	g.Sync()
+	return err
+}
+
+// Pipes p to a shell command
+func pipeAttachment(g *gocui.Gui, p *mime.MimePart, command string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(p.Buf.Bytes())
+	return runInTerminal(g, cmd)
+}
+
+// Pipes each of msgs in turn to a shell command, stopping at the first
+// failure
+func pipeMessages(g *gocui.Gui, msgs []*Message, command string) error {
+	for _, m := range msgs {
+		f, err := os.Open(m.path)
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stdin = f
+		err = runInTerminal(g, cmd)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+	}
+	return nil
+}
+
+func (amua *Amua) getMailcap() *mailcap.Mailcap {
+	if amua.mailcap == nil {
+		paths := cfg.AmuaConfig.Mailcaps
+		if len(paths) == 0 {
+			paths = mailcap.DefaultPaths()
+		}
+		mc, err := mailcap.Load(paths)
+		if err != nil {
+			setStatus(err.Error())
+			mc = &mailcap.Mailcap{}
+		}
+		amua.mailcap = mc
+	}
+	return amua.mailcap
+}
+
+// Returns the viewer for p: the configured viewers are looked up first,
+// then the mailcap files
+func (amua *Amua) viewerFor(p *mime.MimePart) (*mailcap.Entry, error) {
+	mt := strings.ToLower(mime.MimeTypeTxt(p.MimeType))
+	major := mt
+	if i := strings.Index(mt, "/"); i != -1 {
+		major = mt[:i]
+	}
+	for _, t := range []string{mt, major + "/*"} {
+		if c, ok := cfg.AmuaConfig.Viewers[t]; ok {
+			return &mailcap.Entry{MimeType: t, Command: c, NeedsTerminal: true}, nil
+		}
+	}
+	e := amua.getMailcap().Lookup(mt, p.Params)
+	if e == nil {
+		return nil, fmt.Errorf("No viewer for %s", mt)
+	}
+	return e, nil
+}
+
+// Opens p with its viewer. Interactive viewers are run in the terminal,
+// the others run in the background.
+func (amua *Amua) openAttachment(g *gocui.Gui, p *mime.MimePart) error {
+	e, err := amua.viewerFor(p)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "amua")
+	if err != nil {
+		return err
+	}
+	name := attachmentName(p)
+	if p.Name == "" && strings.Contains(e.NameTemplate, "%s") {
+		name = filepath.Base(strings.Replace(e.NameTemplate, "%s", name, 1))
+	}
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path, p.Buf.Bytes(), 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	mt := mime.MimeTypeTxt(p.MimeType)
+	command := mailcap.Expand(e.Command, path, mt, p.Params)
+	if e.CopiousOutput {
+		pager := os.Getenv("PAGER")
+		if pager == "" {
+			pager = "less"
+		}
+		command += " | " + pager
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	var stdin *os.File
+	if !mailcap.TakesFile(e.Command) {
+		stdin, err = os.Open(path)
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		cmd.Stdin = stdin
+	}
+	cleanup := func() {
+		if stdin != nil {
+			stdin.Close()
+		}
+		os.RemoveAll(dir)
+	}
+	if e.NeedsTerminal || e.CopiousOutput {
+		defer cleanup()
+		return runInTerminal(g, cmd)
+	}
+	err = cmd.Start()
+	if err != nil {
+		cleanup()
+		return err
+	}
+	go func() {
+		cmd.Wait()
+		cleanup()
+	}()
+	return nil
+}
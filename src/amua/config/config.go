@@ -2,22 +2,64 @@ package config
 
 import (
 	"bufio"
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type SMTPConfig struct {
-	Host   string
-	User   string
-	Passwd string
+	Host               string // host:port, the port defaults to 465 with implicit TLS, 25 otherwise
+	User               string
+	Passwd             string // the password, or the OAuth2 access token with XOAUTH2
+	PasswdCommand      string // a shell command printing the password, instead of Passwd
+	PasswdFile         string // a file holding the password, instead of Passwd
+	Auth               string // "plain", "login", "cram-md5" or "xoauth2", defaults to plain if User is set
+	TLS                string // "starttls" (the default), "implicit" or "none"
+	RequireTLS         bool   // refuse to send if the server doesn't offer STARTTLS, not with TLS = "none"
+	CAFile             string // the PEM bundle checking the server's certificate, instead of the system's
+	InsecureSkipVerify bool   // don't check the server's certificate
+	Helo               string // the name sent in EHLO, defaults to the host name
+}
+
+// A named query, shown as a virtual maildir holding the matching messages
+// of Maildirs, or of all the maildirs if it's empty
+type SearchConfig struct {
+	Name     string
+	Query    string
+	Maildirs []string
+}
+
+// Saves the messages sent from an address matching From, or to a
+// recipient matching To, to Maildir instead of AmuaConfig.Sent, like
+// mutt's fcc-hook. The patterns are case insensitive regular expressions,
+// an empty one matches everything.
+type FccHook struct {
+	From    string
+	To      string
+	Maildir string
 }
 
 type AmuaConfig struct {
-	Maildirs  []string
-	Me        string
-	MeAliases []string
-	Editor    string
+	Maildirs        []string
+	MaildirRoots    []string // the roots under which the maildirs are discovered, Maildir++ or nested
+	Me              string
+	MeAliases       []string
+	Editor          string
+	Mailcaps        []string          // the mailcap files to use, instead of the RFC 1524 defaults
+	Viewers         map[string]string // MIME type to viewer command, takes precedence over the mailcap files
+	IndexDir        string            // where the full-text index is kept, defaults to ~/.amua/index
+	Searches        []SearchConfig    // the saved searches
+	CacheDir        string            // where the headers of the messages are cached, defaults to ~/.amua/headers
+	IndexFormat     string            // the format of the lines of the index, see IndexFormat
+	TrashDir        string            // where the removed messages are kept, defaults to ~/.amua/trash
+	TrashDays       int               // how long the removed messages are kept, defaults to 7 days
+	Transport       string            // "smtp" (the default) to send with SMTPConfig, or "sendmail"
+	SendmailCommand string            // the command the messages are piped to, defaults to "/usr/sbin/sendmail -oi", without -t
+	OutboxDir       string            // the maildir holding the messages until they're sent, defaults to ~/.amua/outbox
+	Sent            string            // the maildir the sent messages are saved to, they're not saved if it's empty
+	FccHooks        []FccHook         // the first matching hook overrides Sent
 }
 type Config struct {
 	AmuaConfig AmuaConfig
@@ -34,6 +76,29 @@ func NewConfig(filename string) (*Config, error) {
 	if _, err := toml.DecodeReader(bufio.NewReader(file), &cfg); err != nil {
 		return nil, err
 	}
+	sc := &cfg.SMTPConfig
+	n := 0
+	for _, s := range []string{sc.Passwd, sc.PasswdCommand, sc.PasswdFile} {
+		if s != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("Only one of Passwd, PasswdCommand and PasswdFile can be set in %s", filename)
+	}
+	if sc.RequireTLS && strings.EqualFold(sc.TLS, "none") {
+		return nil, fmt.Errorf("RequireTLS can't be set along with TLS = \"none\" in %s", filename)
+	}
+	if sc.Passwd != "" {
+		fi, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().Perm()&0004 != 0 {
+			return nil, fmt.Errorf("%s holds the SMTP password but is readable by everyone: "+
+				"make it private, or use PasswdCommand or PasswdFile", filename)
+		}
+	}
 
 	return cfg, nil
 }
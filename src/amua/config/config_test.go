@@ -0,0 +1,52 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string, perm os.FileMode) string {
+	f, err := ioutil.TempFile("", "amuarc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Chmod(perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestNewConfigPasswd(t *testing.T) {
+	tests := []struct {
+		content string
+		perm    os.FileMode
+		ok      bool
+	}{
+		{"[SMTPConfig]\nUser = \"me\"\nPasswd = \"secret\"\n", 0600, true},
+		{"[SMTPConfig]\nUser = \"me\"\nPasswd = \"secret\"\n", 0644, false},
+		{"[SMTPConfig]\nUser = \"me\"\nPasswdCommand = \"pass show mail\"\n", 0644, true},
+		{"[SMTPConfig]\nUser = \"me\"\nPasswdFile = \"/home/me/.smtp\"\n", 0644, true},
+		{"[SMTPConfig]\nUser = \"me\"\nPasswd = \"secret\"\nPasswdFile = \"/home/me/.smtp\"\n", 0600, false},
+		{"[SMTPConfig]\nUser = \"me\"\nTLS = \"none\"\nRequireTLS = true\n", 0600, false},
+		{"[SMTPConfig]\nUser = \"me\"\nTLS = \"starttls\"\nRequireTLS = true\n", 0600, true},
+	}
+	for i, test := range tests {
+		name := writeConfig(t, test.content, test.perm)
+		cfg, err := NewConfig(name)
+		os.Remove(name)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: unexpected error %v", i, err)
+			continue
+		}
+		if err == nil && cfg.SMTPConfig.User != "me" {
+			t.Errorf("%d: unexpected user %q", i, cfg.SMTPConfig.User)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A maildir found under one of the MaildirRoots. Two layouts are
+// supported: Maildir++, where the folders of the root maildir are its
+// .Parent.Child subdirectories, and plain trees of nested maildirs.
+type folder struct {
+	path     string
+	name     string   // relative to the closest folder above it
+	depth    int      // how many folders are above it
+	plusPlus bool     // a Maildir++ folder, kept in the root
+	elems    []string // the path of the folder in the hierarchy
+}
+
+// Returns true if path holds a maildir
+func isMaildir(path string) bool {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		fi, err := os.Stat(filepath.Join(path, d))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+type byElems []*folder
+
+func (f byElems) Len() int      { return len(f) }
+func (f byElems) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+func (f byElems) Less(i, j int) bool {
+	a, b := f[i].elems, f[j].elems
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Walks the nested maildirs under dir, the Maildir++ folders excepted
+func findNested(dir string, elems []string, found []*folder) ([]*folder, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		n := fi.Name()
+		if !fi.IsDir() || strings.HasPrefix(n, ".") || n == "cur" || n == "new" || n == "tmp" {
+			continue
+		}
+		path := filepath.Join(dir, n)
+		sub := append(append([]string{}, elems...), n)
+		if isMaildir(path) {
+			found = append(found, &folder{path: path, elems: sub})
+		}
+		found, err = findNested(path, sub, found)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// Returns the folders under root, the root included if it's a maildir,
+// each one followed by its subfolders. The folders missing in the
+// hierarchy are skipped: .A.B is shown as A/B if there's no .A.
+func discoverFolders(root string) ([]*folder, error) {
+	found := []*folder{}
+	if isMaildir(root) {
+		found = append(found, &folder{path: root, elems: []string{}})
+	}
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		n := fi.Name()
+		if !fi.IsDir() || len(n) < 2 || n[0] != '.' || n == ".." {
+			continue
+		}
+		path := filepath.Join(root, n)
+		if isMaildir(path) {
+			found = append(found, &folder{path: path, elems: strings.Split(n[1:], "."), plusPlus: true})
+		}
+	}
+	found, err = findNested(root, []string{}, found)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byElems(found))
+	byKey := make(map[string]*folder)
+	for _, f := range found {
+		f.name = strings.Join(f.elems, "/")
+		if len(f.elems) == 0 {
+			f.name = filepath.Base(root)
+		}
+		for i := len(f.elems) - 1; i >= 0; i-- {
+			if p, ok := byKey[strings.Join(f.elems[:i], "/")]; ok {
+				f.depth = p.depth + 1
+				f.name = strings.Join(f.elems[i:], "/")
+				break
+			}
+		}
+		byKey[strings.Join(f.elems, "/")] = f
+	}
+	return found, nil
+}
+
+// Returns the known maildirs for the folders under roots. The ones
+// already in prev are kept as they are, the others are loaded and
+// monitored.
+func discoverKnownMaildirs(roots []string, prev map[string]*knownMaildir, onChange onMaildirChangeFn) ([]knownMaildir, error) {
+	ret := []knownMaildir{}
+	for _, root := range roots {
+		folders, err := discoverFolders(root)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range folders {
+			if km, ok := prev[f.path]; ok {
+				km.name = f.name
+				km.depth = f.depth
+				ret = append(ret, *km)
+				continue
+			}
+			md, err := LoadMaildir(f.path, false)
+			if err != nil {
+				return nil, err
+			}
+			km := knownMaildir{
+				maildir:     md,
+				path:        f.path,
+				name:        f.name,
+				depth:       f.depth,
+				root:        root,
+				plusPlus:    f.plusPlus,
+				stopMonitor: make(chan bool),
+			}
+			ret = append(ret, km)
+			go km.Start(onChange)
+		}
+	}
+	return ret, nil
+}
+
+// Returns the name folder would have under parent, a folder of the
+// same root
+func subfolderPath(parent *knownMaildir, name string) (string, error) {
+	if parent.root == "" {
+		return "", fmt.Errorf("%s is not under a maildir root", parent.path)
+	}
+	if name == "" || strings.ContainsAny(name, "/") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid folder name %q", name)
+	}
+	switch {
+	case parent.plusPlus:
+		if strings.Contains(name, ".") {
+			return "", fmt.Errorf("Maildir++ folder names can't contain dots")
+		}
+		return parent.path + "." + name, nil
+	case parent.path == parent.root:
+		/* the folders of a root maildir are Maildir++ ones */
+		if strings.Contains(name, ".") {
+			return "", fmt.Errorf("Maildir++ folder names can't contain dots")
+		}
+		return filepath.Join(parent.root, "."+name), nil
+	}
+	return filepath.Join(parent.path, name), nil
+}
+
+// Creates the folder name under parent, and returns its path
+func createFolder(parent *knownMaildir, name string) (string, error) {
+	path, err := subfolderPath(parent, name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	for _, d := range []string{"cur", "new", "tmp"} {
+		err := os.MkdirAll(filepath.Join(path, d), 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+	if parent.plusPlus || parent.path == parent.root {
+		/* tells the delivery agents it's a Maildir++ folder */
+		f, err := os.OpenFile(filepath.Join(path, "maildirfolder"), os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+	}
+	return path, nil
+}
+
+// Returns the Maildir++ folders below the one at path
+func plusPlusChildren(km *knownMaildir) ([]string, error) {
+	fis, err := ioutil.ReadDir(km.root)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(km.path) + "."
+	ret := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), prefix) {
+			ret = append(ret, filepath.Join(km.root, fi.Name()))
+		}
+	}
+	return ret, nil
+}
+
+// Renames the folder of km, its subfolders included. Only the last
+// element of its name changes: it stays where it is in the hierarchy.
+func renameFolder(km *knownMaildir, name string) (string, error) {
+	if km.root == "" || km.path == km.root {
+		return "", fmt.Errorf("Can't rename %s, it's not a folder of a maildir root", km.path)
+	}
+	if name == "" || strings.ContainsAny(name, "/") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid folder name %q", name)
+	}
+	var path string
+	if km.plusPlus {
+		if strings.Contains(name, ".") {
+			return "", fmt.Errorf("Maildir++ folder names can't contain dots")
+		}
+		base := filepath.Base(km.path)
+		path = filepath.Join(km.root, base[:strings.LastIndex(base, ".")+1]+name)
+	} else {
+		path = filepath.Join(filepath.Dir(km.path), name)
+	}
+	if path == km.path {
+		return path, nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("%s already exists", path)
+	}
+	if km.plusPlus {
+		children, err := plusPlusChildren(km)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range children {
+			err := os.Rename(c, path+c[len(km.path):])
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	err := os.Rename(km.path, path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Removes the folder of km, and the messages it holds. The folders having
+// subfolders are left alone.
+func deleteFolder(km *knownMaildir) error {
+	if km.root == "" || km.path == km.root {
+		return fmt.Errorf("Can't delete %s, it's not a folder of a maildir root", km.path)
+	}
+	folders, err := discoverFolders(km.root)
+	if err != nil {
+		return err
+	}
+	for i, f := range folders {
+		if f.path == km.path && i+1 < len(folders) && folders[i+1].depth > f.depth {
+			return fmt.Errorf("%s has subfolders", km.name)
+		}
+	}
+	if km.plusPlus {
+		children, err := plusPlusChildren(km)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("%s has subfolders", km.name)
+		}
+	}
+	return os.RemoveAll(km.path)
+}
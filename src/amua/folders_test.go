@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mkTestMaildir(t *testing.T, path string) {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		err := os.MkdirAll(filepath.Join(path, d), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiscoverFolders(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	mkTestMaildir(t, filepath.Join(root, ".Lists"))
+	mkTestMaildir(t, filepath.Join(root, ".Lists.golang"))
+	mkTestMaildir(t, filepath.Join(root, ".Work.2016"))
+	mkTestMaildir(t, filepath.Join(root, "archive", "2015"))
+	mkTestMaildir(t, filepath.Join(root, "archive", "2015", "spam"))
+	/* neither maildirs nor folders */
+	os.MkdirAll(filepath.Join(root, ".notmuch"), 0700)
+	ioutil.WriteFile(filepath.Join(root, ".Lists.file"), nil, 0600)
+
+	folders, err := discoverFolders(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path  string
+		name  string
+		depth int
+	}{
+		{root, filepath.Base(root), 0},
+		{filepath.Join(root, ".Lists"), "Lists", 1},
+		{filepath.Join(root, ".Lists.golang"), "golang", 2},
+		{filepath.Join(root, ".Work.2016"), "Work/2016", 1},
+		{filepath.Join(root, "archive", "2015"), "archive/2015", 1},
+		{filepath.Join(root, "archive", "2015", "spam"), "spam", 2},
+	}
+	if len(folders) != len(expected) {
+		for _, f := range folders {
+			t.Logf("%s %s %d", f.path, f.name, f.depth)
+		}
+		t.Fatalf("Expected %d folders, got %d", len(expected), len(folders))
+	}
+	for i, e := range expected {
+		f := folders[i]
+		if f.path != e.path || f.name != e.name || f.depth != e.depth {
+			t.Errorf("Expected %s %q at depth %d, got %s %q at depth %d", e.path, e.name, e.depth, f.path, f.name, f.depth)
+		}
+	}
+}
+
+func TestFolderCommands(t *testing.T) {
+	root := newTestMaildir(t)
+	defer os.RemoveAll(root)
+	mkTestMaildir(t, filepath.Join(root, "nested"))
+	onChange := func(*Maildir) {}
+	known, err := discoverKnownMaildirs([]string{root}, nil, onChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for i := range known {
+			known[i].Stop()
+		}
+	}()
+	if len(known) != 2 || known[0].root != root {
+		t.Fatalf("Expected 2 folders, got %d", len(known))
+	}
+
+	/* Maildir++ under the root, nested elsewhere */
+	path, err := createFolder(&known[0], "Lists")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(root, ".Lists") || !isMaildir(path) {
+		t.Errorf("Unexpected folder %s", path)
+	}
+	if _, err := os.Stat(filepath.Join(path, "maildirfolder")); err != nil {
+		t.Error(err)
+	}
+	path, err = createFolder(&known[1], "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(root, "nested", "sub") || !isMaildir(path) {
+		t.Errorf("Unexpected folder %s", path)
+	}
+	for _, name := range []string{"", "a/b", ".hidden", "a.b"} {
+		if _, err := createFolder(&known[0], name); err == nil {
+			t.Errorf("Expected an error for %q", name)
+		}
+	}
+
+	/* the known folders are kept */
+	prev := map[string]*knownMaildir{}
+	for i := range known {
+		prev[known[i].path] = &known[i]
+	}
+	found, err := discoverKnownMaildirs([]string{root}, prev, onChange)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 4 || found[0].maildir != known[0].maildir {
+		t.Fatalf("Unexpected folders %v", found)
+	}
+	known = append(known, found[1], found[3])
+	lists := &found[1]
+	if lists.path != filepath.Join(root, ".Lists") {
+		t.Fatalf("Unexpected folder %s", lists.path)
+	}
+	_, err = createFolder(lists, "golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMessage(t, filepath.Join(root, ".Lists.golang"), "cur", "1.a:2,", "gophers")
+
+	/* the subfolders follow */
+	path, err = renameFolder(lists, "ml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(root, ".ml") || !isMaildir(filepath.Join(root, ".ml.golang")) {
+		t.Errorf("The folder wasn't renamed: %s", path)
+	}
+	if _, err := renameFolder(&known[0], "root"); err == nil {
+		t.Error("Expected an error when renaming the root")
+	}
+	path, err = renameFolder(&known[1], "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isMaildir(filepath.Join(path, "sub")) {
+		t.Error("The nested folder didn't follow")
+	}
+
+	lists.path = filepath.Join(root, ".ml")
+	if err := deleteFolder(lists); err == nil {
+		t.Error("Expected an error when deleting a folder with subfolders")
+	}
+	golang := &knownMaildir{path: filepath.Join(root, ".ml.golang"), root: root, plusPlus: true}
+	if err := deleteFolder(golang); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(golang.path); !os.IsNotExist(err) {
+		t.Errorf("The folder wasn't deleted: %v", err)
+	}
+	if err := deleteFolder(&known[0]); err == nil {
+		t.Error("Expected an error when deleting the root")
+	}
+}
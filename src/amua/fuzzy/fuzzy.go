@@ -0,0 +1,151 @@
+// Package fuzzy matches words approximately: phonetically, with the
+// Double Metaphone algorithm, and within a small edit distance. It
+// helps finding "Schmitt" when looking for "Smith", or a misspelled
+// subject.
+package fuzzy
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The closeness of words sounding alike, depending on how the
+// codes matched
+const (
+	PrimaryCloseness   = 0.8
+	SecondaryCloseness = 0.6
+)
+
+// Returns the maximum edit distance allowed between a word of n
+// characters and the words it matches
+func MaxDistance(n int) int {
+	switch {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	case n <= 8:
+		return 2
+	}
+	return 3
+}
+
+// Returns the Levenshtein distance between a and b, or max + 1 if it's
+// larger than max
+func Distance(a string, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) > len(rb) {
+		ra, rb = rb, ra
+	}
+	if len(rb)-len(ra) > max {
+		return max + 1
+	}
+	prev := make([]int, len(ra)+1)
+	cur := make([]int, len(ra)+1)
+	for i := range prev {
+		prev[i] = i
+	}
+	for j := 1; j <= len(rb); j++ {
+		cur[0] = j
+		rowMin := cur[0]
+		for i := 1; i <= len(ra); i++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := prev[i-1] + cost
+			if prev[i]+1 < d {
+				d = prev[i] + 1
+			}
+			if cur[i-1]+1 < d {
+				d = cur[i-1] + 1
+			}
+			cur[i] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev, cur = cur, prev
+	}
+	if prev[len(ra)] > max {
+		return max + 1
+	}
+	return prev[len(ra)]
+}
+
+// Splits s in lower case words
+func Words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// A word to look for, with its codes computed once
+type Word struct {
+	word               string
+	primary, secondary string
+}
+
+func NewWord(word string) *Word {
+	w := &Word{word: strings.ToLower(word)}
+	w.primary, w.secondary = DoubleMetaphone(w.word)
+	return w
+}
+
+// Returns how close candidate is to w, from 0 (not at all) to 1 (it's
+// the same word)
+func (w *Word) Closeness(candidate string) float64 {
+	candidate = strings.ToLower(candidate)
+	if candidate == w.word {
+		return 1
+	}
+	ret := 0.0
+	max := MaxDistance(len([]rune(w.word)))
+	if d := Distance(w.word, candidate, max); d <= max {
+		/* a single typo in a long word is closer than one in a short word */
+		ret = 1 - float64(d)/float64(len([]rune(w.word))+1)
+	}
+	if w.primary == "" {
+		return ret
+	}
+	p, s := DoubleMetaphone(candidate)
+	c := 0.0
+	switch {
+	case w.primary == p:
+		c = PrimaryCloseness
+	case w.primary == s, w.secondary == p, w.secondary == s && s != "":
+		c = SecondaryCloseness
+	}
+	if c > ret {
+		ret = c
+	}
+	return ret
+}
+
+// Returns the closeness of w to the closest word of text
+func (w *Word) ClosenessIn(text string) float64 {
+	ret := 0.0
+	for _, c := range Words(text) {
+		if cl := w.Closeness(c); cl > ret {
+			ret = cl
+			if ret == 1 {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// Returns the Double Metaphone codes of w, without duplicates
+func (w *Word) Codes() []string {
+	if w.primary == "" {
+		return nil
+	}
+	if w.secondary == "" || w.secondary == w.primary {
+		return []string{w.primary}
+	}
+	return []string{w.primary, w.secondary}
+}
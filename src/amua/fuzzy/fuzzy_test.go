@@ -0,0 +1,68 @@
+package fuzzy
+
+import (
+	"testing"
+)
+
+func TestDoubleMetaphone(t *testing.T) {
+	tests := []struct {
+		word               string
+		primary, secondary string
+	}{
+		{"Smith", "SM0", "XMT"},
+		{"Schmidt", "XMT", "SMT"},
+		{"Schmitt", "XMT", "SMT"},
+		{"Michael", "MKL", "MXL"},
+		{"Caesar", "SSR", "SSR"},
+		{"Jose", "HS", "HS"},
+		{"Arnow", "ARN", "ARNF"},
+		{"Wasserman", "ASRM", "FSRM"},
+		{"Knight", "NT", "NT"},
+		{"Xavier", "SF", "SFR"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		p, s := DoubleMetaphone(tt.word)
+		if p != tt.primary || s != tt.secondary {
+			t.Errorf("%q: expected %q/%q, got %q/%q", tt.word, tt.primary, tt.secondary, p, s)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		max      int
+		expected int
+	}{
+		{"kitten", "sitting", 5, 3},
+		{"kitten", "sitting", 2, 3},
+		{"same", "same", 0, 0},
+		{"", "abc", 3, 3},
+		{"recieve", "receive", 2, 2},
+		{"héllo", "hello", 1, 1},
+		{"a", "abcdef", 2, 3},
+	}
+	for _, tt := range tests {
+		if got := Distance(tt.a, tt.b, tt.max); got != tt.expected {
+			t.Errorf("%q/%q (max %d): expected %d, got %d", tt.a, tt.b, tt.max, tt.expected, got)
+		}
+	}
+}
+
+func TestCloseness(t *testing.T) {
+	w := NewWord("Smith")
+	exact := w.ClosenessIn("John Smith <js@example.com>")
+	typo := w.ClosenessIn("John Smyth <js@example.com>")
+	sounds := w.ClosenessIn("Anna Schmitt <as@example.com>")
+	none := w.ClosenessIn("Bob Jones <bob@example.com>")
+	if exact != 1 {
+		t.Errorf("expected an exact match, got %v", exact)
+	}
+	if !(typo < exact && sounds < typo && none < sounds) {
+		t.Errorf("expected exact > typo > sounds > none, got %v %v %v %v", exact, typo, sounds, none)
+	}
+	if none != 0 {
+		t.Errorf("expected no match, got %v", none)
+	}
+}
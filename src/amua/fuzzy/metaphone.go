@@ -0,0 +1,625 @@
+package fuzzy
+
+import (
+	"strings"
+)
+
+// The maximum length of the codes, as in the original algorithm
+const maxCodeLen = 4
+
+type metaphone struct {
+	s                  string // the upper cased word, padded with spaces
+	length             int    // the length of the word, without the padding
+	last               int
+	primary, secondary []byte
+}
+
+func (mp *metaphone) at(pos int) byte {
+	if pos < 0 || pos >= len(mp.s) {
+		return 0
+	}
+	return mp.s[pos]
+}
+
+// Returns true if the length characters at start are one of options
+func (mp *metaphone) stringAt(start int, length int, options ...string) bool {
+	if start < 0 || start+length > len(mp.s) {
+		return false
+	}
+	sub := mp.s[start : start+length]
+	for _, o := range options {
+		if sub == o {
+			return true
+		}
+	}
+	return false
+}
+
+func (mp *metaphone) isVowel(pos int) bool {
+	switch mp.at(pos) {
+	case 'A', 'E', 'I', 'O', 'U', 'Y':
+		return true
+	}
+	return false
+}
+
+func (mp *metaphone) slavoGermanic() bool {
+	return strings.Contains(mp.s, "W") || strings.Contains(mp.s, "K") ||
+		strings.Contains(mp.s, "CZ") || strings.Contains(mp.s, "WITZ")
+}
+
+func (mp *metaphone) add(main string) {
+	mp.add2(main, main)
+}
+
+func (mp *metaphone) add2(main string, alt string) {
+	mp.primary = append(mp.primary, main...)
+	mp.secondary = append(mp.secondary, alt...)
+}
+
+// Replaces the few non ASCII letters the algorithm knows about, and
+// drops the other ones
+func normalize(word string) string {
+	ret := []byte{}
+	for _, r := range strings.ToUpper(word) {
+		switch {
+		case r == 'Ç':
+			ret = append(ret, '\x01')
+		case r == 'Ñ':
+			ret = append(ret, '\x02')
+		case r >= 'A' && r <= 'Z', r == ' ':
+			ret = append(ret, byte(r))
+		}
+	}
+	return string(ret)
+}
+
+// Returns the primary and secondary Double Metaphone codes of word, as
+// described by Lawrence Philips in "The Double Metaphone Search
+// Algorithm", C/C++ Users Journal, June 2000
+func DoubleMetaphone(word string) (string, string) {
+	s := normalize(word)
+	mp := &metaphone{s: s + "     ", length: len(s), last: len(s) - 1}
+	current := 0
+	if mp.length < 1 {
+		return "", ""
+	}
+	/* skip these when at start of word */
+	if mp.stringAt(0, 2, "GN", "KN", "PN", "WR", "PS") {
+		current++
+	}
+	/* initial 'X' is pronounced 'Z' e.g. 'Xavier' */
+	if mp.at(0) == 'X' {
+		mp.add("S")
+		current++
+	}
+	for (len(mp.primary) < maxCodeLen || len(mp.secondary) < maxCodeLen) && current < mp.length {
+		switch mp.at(current) {
+		case 'A', 'E', 'I', 'O', 'U', 'Y':
+			/* all init vowels now map to 'A' */
+			if current == 0 {
+				mp.add("A")
+			}
+			current++
+		case 'B':
+			/* "-mb", e.g "dumb", already skipped over... */
+			mp.add("P")
+			if mp.at(current+1) == 'B' {
+				current += 2
+			} else {
+				current++
+			}
+		case '\x01':
+			mp.add("S")
+			current++
+		case 'C':
+			current = mp.handleC(current)
+		case 'D':
+			if mp.stringAt(current, 2, "DG") {
+				if mp.stringAt(current+2, 1, "I", "E", "Y") {
+					/* e.g. 'edge' */
+					mp.add("J")
+					current += 3
+				} else {
+					/* e.g. 'edgar' */
+					mp.add("TK")
+					current += 2
+				}
+				break
+			}
+			if mp.stringAt(current, 2, "DT", "DD") {
+				mp.add("T")
+				current += 2
+				break
+			}
+			mp.add("T")
+			current++
+		case 'F':
+			if mp.at(current+1) == 'F' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("F")
+		case 'G':
+			current = mp.handleG(current)
+		case 'H':
+			/* only keep if first & before vowel or btw. 2 vowels */
+			if (current == 0 || mp.isVowel(current-1)) && mp.isVowel(current+1) {
+				mp.add("H")
+				current += 2
+			} else {
+				current++
+			}
+		case 'J':
+			current = mp.handleJ(current)
+		case 'K':
+			if mp.at(current+1) == 'K' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("K")
+		case 'L':
+			if mp.at(current+1) == 'L' {
+				/* spanish e.g. 'cabrillo', 'gallegos' */
+				if (current == mp.length-3 && mp.stringAt(current-1, 4, "ILLO", "ILLA", "ALLE")) ||
+					((mp.stringAt(mp.last-1, 2, "AS", "OS") || mp.stringAt(mp.last, 1, "A", "O")) &&
+						mp.stringAt(current-1, 4, "ALLE")) {
+					mp.add2("L", "")
+					current += 2
+					break
+				}
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("L")
+		case 'M':
+			if (mp.stringAt(current-1, 3, "UMB") && (current+1 == mp.last || mp.stringAt(current+2, 2, "ER"))) ||
+				mp.at(current+1) == 'M' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("M")
+		case 'N':
+			if mp.at(current+1) == 'N' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("N")
+		case '\x02':
+			current++
+			mp.add("N")
+		case 'P':
+			if mp.at(current+1) == 'H' {
+				mp.add("F")
+				current += 2
+				break
+			}
+			/* also account for "campbell", "raspberry" */
+			if mp.stringAt(current+1, 1, "P", "B") {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("P")
+		case 'Q':
+			if mp.at(current+1) == 'Q' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("K")
+		case 'R':
+			/* french e.g. 'rogier', but exclude 'hochmeier' */
+			if current == mp.last && !mp.slavoGermanic() && mp.stringAt(current-2, 2, "IE") &&
+				!mp.stringAt(current-4, 2, "ME", "MA") {
+				mp.add2("", "R")
+			} else {
+				mp.add("R")
+			}
+			if mp.at(current+1) == 'R' {
+				current += 2
+			} else {
+				current++
+			}
+		case 'S':
+			current = mp.handleS(current)
+		case 'T':
+			current = mp.handleT(current)
+		case 'V':
+			if mp.at(current+1) == 'V' {
+				current += 2
+			} else {
+				current++
+			}
+			mp.add("F")
+		case 'W':
+			current = mp.handleW(current)
+		case 'X':
+			/* french e.g. breaux */
+			if !(current == mp.last && (mp.stringAt(current-3, 3, "IAU", "EAU") || mp.stringAt(current-2, 2, "AU", "OU"))) {
+				mp.add("KS")
+			}
+			if mp.stringAt(current+1, 1, "C", "X") {
+				current += 2
+			} else {
+				current++
+			}
+		case 'Z':
+			/* chinese pinyin e.g. 'zhao' */
+			if mp.at(current+1) == 'H' {
+				mp.add("J")
+				current += 2
+				break
+			}
+			if mp.stringAt(current+1, 2, "ZO", "ZI", "ZA") ||
+				(mp.slavoGermanic() && current > 0 && mp.at(current-1) != 'T') {
+				mp.add2("S", "TS")
+			} else {
+				mp.add("S")
+			}
+			if mp.at(current+1) == 'Z' {
+				current += 2
+			} else {
+				current++
+			}
+		default:
+			current++
+		}
+	}
+	if len(mp.primary) > maxCodeLen {
+		mp.primary = mp.primary[:maxCodeLen]
+	}
+	if len(mp.secondary) > maxCodeLen {
+		mp.secondary = mp.secondary[:maxCodeLen]
+	}
+	return string(mp.primary), string(mp.secondary)
+}
+
+func (mp *metaphone) handleC(current int) int {
+	/* various germanic */
+	if current > 1 && !mp.isVowel(current-2) && mp.stringAt(current-1, 3, "ACH") &&
+		mp.at(current+2) != 'I' && (mp.at(current+2) != 'E' || mp.stringAt(current-2, 6, "BACHER", "MACHER")) {
+		mp.add("K")
+		return current + 2
+	}
+	/* special case 'caesar' */
+	if current == 0 && mp.stringAt(current, 6, "CAESAR") {
+		mp.add("S")
+		return current + 2
+	}
+	/* italian 'chianti' */
+	if mp.stringAt(current, 4, "CHIA") {
+		mp.add("K")
+		return current + 2
+	}
+	if mp.stringAt(current, 2, "CH") {
+		/* find 'michael' */
+		if current > 0 && mp.stringAt(current, 4, "CHAE") {
+			mp.add2("K", "X")
+			return current + 2
+		}
+		/* greek roots e.g. 'chemistry', 'chorus' */
+		if current == 0 &&
+			(mp.stringAt(current+1, 5, "HARAC", "HARIS") || mp.stringAt(current+1, 3, "HOR", "HYM", "HIA", "HEM")) &&
+			!mp.stringAt(0, 5, "CHORE") {
+			mp.add("K")
+			return current + 2
+		}
+		/* germanic, greek, or otherwise 'ch' for 'kh' sound */
+		if mp.stringAt(0, 4, "VAN ", "VON ") || mp.stringAt(0, 3, "SCH") ||
+			/* 'architect but not 'arch', 'orchestra', 'orchid' */
+			mp.stringAt(current-2, 6, "ORCHES", "ARCHIT", "ORCHID") ||
+			mp.stringAt(current+2, 1, "T", "S") ||
+			((mp.stringAt(current-1, 1, "A", "O", "U", "E") || current == 0) &&
+				/* e.g., 'wachtler', 'wechsler', but not 'tichner' */
+				mp.stringAt(current+2, 1, "L", "R", "N", "M", "B", "H", "F", "V", "W", " ")) {
+			mp.add("K")
+		} else {
+			if current > 0 {
+				if mp.stringAt(0, 2, "MC") {
+					/* e.g., "McHugh" */
+					mp.add("K")
+				} else {
+					mp.add2("X", "K")
+				}
+			} else {
+				mp.add("X")
+			}
+		}
+		return current + 2
+	}
+	/* e.g, 'czerny' */
+	if mp.stringAt(current, 2, "CZ") && !mp.stringAt(current-2, 4, "WICZ") {
+		mp.add2("S", "X")
+		return current + 2
+	}
+	/* e.g., 'focaccia' */
+	if mp.stringAt(current+1, 3, "CIA") {
+		mp.add("X")
+		return current + 3
+	}
+	/* double 'C', but not if e.g. 'McClellan' */
+	if mp.stringAt(current, 2, "CC") && !(current == 1 && mp.at(0) == 'M') {
+		/* 'bellocchio' but not 'bacchus' */
+		if mp.stringAt(current+2, 1, "I", "E", "H") && !mp.stringAt(current+2, 2, "HU") {
+			/* 'accident', 'accede' 'succeed' */
+			if (current == 1 && mp.at(current-1) == 'A') || mp.stringAt(current-1, 5, "UCCEE", "UCCES") {
+				mp.add("KS")
+			} else {
+				/* 'bacci', 'bertucci', other italian */
+				mp.add("X")
+			}
+			return current + 3
+		}
+		/* Pierce's rule */
+		mp.add("K")
+		return current + 2
+	}
+	if mp.stringAt(current, 2, "CK", "CG", "CQ") {
+		mp.add("K")
+		return current + 2
+	}
+	if mp.stringAt(current, 2, "CI", "CE", "CY") {
+		/* italian vs. english */
+		if mp.stringAt(current, 3, "CIO", "CIE", "CIA") {
+			mp.add2("S", "X")
+		} else {
+			mp.add("S")
+		}
+		return current + 2
+	}
+	mp.add("K")
+	/* name sent in 'mac caffrey', 'mac gregor' */
+	if mp.stringAt(current+1, 2, " C", " Q", " G") {
+		return current + 3
+	}
+	if mp.stringAt(current+1, 1, "C", "K", "Q") && !mp.stringAt(current+1, 2, "CE", "CI") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (mp *metaphone) handleG(current int) int {
+	if mp.at(current+1) == 'H' {
+		if current > 0 && !mp.isVowel(current-1) {
+			mp.add("K")
+			return current + 2
+		}
+		/* 'ghislane', ghiradelli */
+		if current == 0 {
+			if mp.at(current+2) == 'I' {
+				mp.add("J")
+			} else {
+				mp.add("K")
+			}
+			return current + 2
+		}
+		/* Parker's rule (with some further refinements) - e.g., 'hugh' */
+		if (current > 1 && mp.stringAt(current-2, 1, "B", "H", "D")) ||
+			/* e.g., 'bough' */
+			(current > 2 && mp.stringAt(current-3, 1, "B", "H", "D")) ||
+			/* e.g., 'broughton' */
+			(current > 3 && mp.stringAt(current-4, 1, "B", "H")) {
+			return current + 2
+		}
+		/* e.g., 'laugh', 'McLaughlin', 'cough', 'gough', 'rough', 'tough' */
+		if current > 2 && mp.at(current-1) == 'U' && mp.stringAt(current-3, 1, "C", "G", "L", "R", "T") {
+			mp.add("F")
+		} else if current > 0 && mp.at(current-1) != 'I' {
+			mp.add("K")
+		}
+		return current + 2
+	}
+	if mp.at(current+1) == 'N' {
+		if current == 1 && mp.isVowel(0) && !mp.slavoGermanic() {
+			mp.add2("KN", "N")
+		} else if !mp.stringAt(current+2, 2, "EY") && mp.at(current+1) != 'Y' && !mp.slavoGermanic() {
+			/* not e.g. 'cagney' */
+			mp.add2("N", "KN")
+		} else {
+			mp.add("KN")
+		}
+		return current + 2
+	}
+	/* 'tagliaro' */
+	if mp.stringAt(current+1, 2, "LI") && !mp.slavoGermanic() {
+		mp.add2("KL", "L")
+		return current + 2
+	}
+	/* -ges-, -gep-, -gel-, -gie- at beginning */
+	if current == 0 && (mp.at(current+1) == 'Y' ||
+		mp.stringAt(current+1, 2, "ES", "EP", "EB", "EL", "EY", "IB", "IL", "IN", "IE", "EI", "ER")) {
+		mp.add2("K", "J")
+		return current + 2
+	}
+	/* -ger-, -gy- */
+	if (mp.stringAt(current+1, 2, "ER") || mp.at(current+1) == 'Y') &&
+		!mp.stringAt(0, 6, "DANGER", "RANGER", "MANGER") &&
+		!mp.stringAt(current-1, 1, "E", "I") && !mp.stringAt(current-1, 3, "RGY", "OGY") {
+		mp.add2("K", "J")
+		return current + 2
+	}
+	/* italian e.g, 'biaggi' */
+	if mp.stringAt(current+1, 1, "E", "I", "Y") || mp.stringAt(current-1, 4, "AGGI", "OGGI") {
+		/* obvious germanic */
+		if mp.stringAt(0, 4, "VAN ", "VON ") || mp.stringAt(0, 3, "SCH") || mp.stringAt(current+1, 2, "ET") {
+			mp.add("K")
+		} else if mp.stringAt(current+1, 4, "IER ") {
+			/* always soft if french ending */
+			mp.add("J")
+		} else {
+			mp.add2("J", "K")
+		}
+		return current + 2
+	}
+	mp.add("K")
+	if mp.at(current+1) == 'G' {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (mp *metaphone) handleJ(current int) int {
+	/* obvious spanish, 'jose', 'san jacinto' */
+	if mp.stringAt(current, 4, "JOSE") || mp.stringAt(0, 4, "SAN ") {
+		if (current == 0 && mp.at(current+4) == ' ') || mp.stringAt(0, 4, "SAN ") {
+			mp.add("H")
+		} else {
+			mp.add2("J", "H")
+		}
+		return current + 1
+	}
+	if current == 0 && !mp.stringAt(current, 4, "JOSE") {
+		/* Yankelovich/Jankelowicz */
+		mp.add2("J", "A")
+	} else if mp.isVowel(current-1) && !mp.slavoGermanic() && (mp.at(current+1) == 'A' || mp.at(current+1) == 'O') {
+		/* spanish pron. of e.g. 'bajador' */
+		mp.add2("J", "H")
+	} else if current == mp.last {
+		mp.add2("J", "")
+	} else if !mp.stringAt(current+1, 1, "L", "T", "K", "S", "N", "M", "B", "Z") &&
+		!mp.stringAt(current-1, 1, "S", "K", "L") {
+		mp.add("J")
+	}
+	/* it could happen! */
+	if mp.at(current+1) == 'J' {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (mp *metaphone) handleS(current int) int {
+	/* special cases 'island', 'isle', 'carlisle', 'carlysle' */
+	if mp.stringAt(current-1, 3, "ISL", "YSL") {
+		return current + 1
+	}
+	/* special case 'sugar-' */
+	if current == 0 && mp.stringAt(current, 5, "SUGAR") {
+		mp.add2("X", "S")
+		return current + 1
+	}
+	if mp.stringAt(current, 2, "SH") {
+		/* germanic */
+		if mp.stringAt(current+1, 4, "HEIM", "HOEK", "HOLM", "HOLZ") {
+			mp.add("S")
+		} else {
+			mp.add("X")
+		}
+		return current + 2
+	}
+	/* italian & armenian */
+	if mp.stringAt(current, 3, "SIO", "SIA") || mp.stringAt(current, 4, "SIAN") {
+		if !mp.slavoGermanic() {
+			mp.add2("S", "X")
+		} else {
+			mp.add("S")
+		}
+		return current + 3
+	}
+	/* german & anglicisations, e.g. 'smith' match 'schmidt', 'snider'
+	 * match 'schneider'. Also, -sz- in slavic language although in
+	 * hungarian it is pronounced 's' */
+	if (current == 0 && mp.stringAt(current+1, 1, "M", "N", "L", "W")) || mp.stringAt(current+1, 1, "Z") {
+		mp.add2("S", "X")
+		if mp.stringAt(current+1, 1, "Z") {
+			return current + 2
+		}
+		return current + 1
+	}
+	if mp.stringAt(current, 2, "SC") {
+		/* Schlesinger's rule */
+		if mp.at(current+2) == 'H' {
+			/* dutch origin, e.g. 'school', 'schooner' */
+			if mp.stringAt(current+3, 2, "OO", "ER", "EN", "UY", "ED", "EM") {
+				/* 'schermerhorn', 'schenker' */
+				if mp.stringAt(current+3, 2, "ER", "EN") {
+					mp.add2("X", "SK")
+				} else {
+					mp.add("SK")
+				}
+				return current + 3
+			}
+			if current == 0 && !mp.isVowel(3) && mp.at(3) != 'W' {
+				mp.add2("X", "S")
+			} else {
+				mp.add("X")
+			}
+			return current + 3
+		}
+		if mp.stringAt(current+2, 1, "I", "E", "Y") {
+			mp.add("S")
+			return current + 3
+		}
+		mp.add("SK")
+		return current + 3
+	}
+	/* french e.g. 'resnais', 'artois' */
+	if current == mp.last && mp.stringAt(current-2, 2, "AI", "OI") {
+		mp.add2("", "S")
+	} else {
+		mp.add("S")
+	}
+	if mp.stringAt(current+1, 1, "S", "Z") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (mp *metaphone) handleT(current int) int {
+	if mp.stringAt(current, 4, "TION") {
+		mp.add("X")
+		return current + 3
+	}
+	if mp.stringAt(current, 3, "TIA", "TCH") {
+		mp.add("X")
+		return current + 3
+	}
+	if mp.stringAt(current, 2, "TH") || mp.stringAt(current, 3, "TTH") {
+		/* special case 'thomas', 'thames' or germanic */
+		if mp.stringAt(current+2, 2, "OM", "AM") || mp.stringAt(0, 4, "VAN ", "VON ") || mp.stringAt(0, 3, "SCH") {
+			mp.add("T")
+		} else {
+			mp.add2("0", "T")
+		}
+		return current + 2
+	}
+	mp.add("T")
+	if mp.stringAt(current+1, 1, "T", "D") {
+		return current + 2
+	}
+	return current + 1
+}
+
+func (mp *metaphone) handleW(current int) int {
+	/* can also be in middle of word */
+	if mp.stringAt(current, 2, "WR") {
+		mp.add("R")
+		return current + 2
+	}
+	if current == 0 && (mp.isVowel(current+1) || mp.stringAt(current, 2, "WH")) {
+		if mp.isVowel(current + 1) {
+			/* Wasserman should match Vasserman */
+			mp.add2("A", "F")
+		} else {
+			/* need Uomo to match Womo */
+			mp.add("A")
+		}
+	}
+	/* Arnow should match Arnoff */
+	if (current == mp.last && mp.isVowel(current-1)) ||
+		mp.stringAt(current-1, 5, "EWSKI", "EWSKY", "OWSKI", "OWSKY") || mp.stringAt(0, 3, "SCH") {
+		mp.add2("", "F")
+		return current + 1
+	}
+	/* polish e.g. 'filipowicz' */
+	if mp.stringAt(current, 4, "WICZ", "WITZ") {
+		mp.add2("TS", "FX")
+		return current + 4
+	}
+	return current + 1
+}
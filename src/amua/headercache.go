@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Where the header caches are kept, one file per maildir. No cache is
+// used if it's empty.
+var headerCacheDir string
+
+// Bumped each time cachedHeaders changes, the caches written by other
+// versions are ignored
+const headerCacheVersion = 3
+
+// The headers of a message, valid as long as its file keeps the same
+// size and modification time. The flags aren't cached: they're in the
+// file name, which changes when they do.
+type cachedHeaders struct {
+	Key   string // see maildirKey
+	Size  int64
+	Mtime int64
+	Headers
+}
+
+type headerCacheFile struct {
+	Version int
+	Entries []*cachedHeaders
+}
+
+// Caches the parsed headers of the messages of a maildir on disk, so
+// that only the new or modified files are parsed when it's loaded. The
+// cache is read on first use, and shared by the UI and the monitor.
+type headerCache struct {
+	path    string
+	lock    sync.Mutex
+	loaded  bool
+	dirty   bool
+	entries map[string]*cachedHeaders
+}
+
+// Returns the cache for the maildir at mdPath, or nil if the caches are
+// disabled
+func newHeaderCache(mdPath string) *headerCache {
+	if headerCacheDir == "" {
+		return nil
+	}
+	abs, err := filepath.Abs(mdPath)
+	if err != nil {
+		abs = mdPath
+	}
+	name := fmt.Sprintf("%x", sha1.Sum([]byte(abs)))
+	return &headerCache{path: filepath.Join(headerCacheDir, name)}
+}
+
+// Reads the cache file, with the lock held. A missing or unreadable
+// cache is just an empty one.
+func (hc *headerCache) load() {
+	hc.loaded = true
+	hc.entries = make(map[string]*cachedHeaders)
+	f, err := os.Open(hc.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var cf headerCacheFile
+	err = gob.NewDecoder(f).Decode(&cf)
+	if err != nil || cf.Version != headerCacheVersion {
+		return
+	}
+	for _, e := range cf.Entries {
+		hc.entries[e.Key] = e
+	}
+}
+
+// Returns the message at path, from the cache if its file didn't change
+// since it was parsed
+func (hc *headerCache) loadMessage(path string) (*Message, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := maildirKey(filepath.Base(path))
+	hc.lock.Lock()
+	if !hc.loaded {
+		hc.load()
+	}
+	e, ok := hc.entries[key]
+	hc.lock.Unlock()
+	if !ok || e.Size != fi.Size() || e.Mtime != fi.ModTime().UnixNano() {
+		m, err := LoadMessage(path)
+		if err != nil {
+			return nil, err
+		}
+		hc.lock.Lock()
+		hc.entries[key] = &cachedHeaders{
+			Key:     key,
+			Size:    fi.Size(),
+			Mtime:   fi.ModTime().UnixNano(),
+			Headers: m.Headers,
+		}
+		hc.dirty = true
+		hc.lock.Unlock()
+		return m, nil
+	}
+	m := &Message{
+		Headers: e.Headers,
+		path:    path,
+		size:    fi.Size(),
+		Flags:   pathFlags(path),
+	}
+	return m, nil
+}
+
+// Forgets the messages whose key isn't in keys
+func (hc *headerCache) prune(keys map[string]bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	for k := range hc.entries {
+		if !keys[k] {
+			delete(hc.entries, k)
+			hc.dirty = true
+		}
+	}
+}
+
+// Removes the cache file, once its maildir is gone
+func (hc *headerCache) remove() {
+	if hc == nil {
+		return
+	}
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	os.Remove(hc.path)
+	hc.entries = make(map[string]*cachedHeaders)
+	hc.loaded = true
+	hc.dirty = false
+}
+
+// Writes the cache to disk, if it changed since it was read
+func (hc *headerCache) save() error {
+	if hc == nil {
+		return nil
+	}
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+	if !hc.dirty {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(hc.path), 0700)
+	if err != nil {
+		return err
+	}
+	cf := headerCacheFile{Version: headerCacheVersion}
+	cf.Entries = make([]*cachedHeaders, 0, len(hc.entries))
+	for _, e := range hc.entries {
+		cf.Entries = append(cf.Entries, e)
+	}
+	tmp := hc.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&cf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, hc.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	hc.dirty = false
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withHeaderCache(t testing.TB) func() {
+	dir, err := ioutil.TempDir("", "amuacache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerCacheDir = dir
+	return func() {
+		headerCacheDir = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	defer withHeaderCache(t)()
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "one")
+	path := deliverTestMessage(t, dir, "cur", "2.b:2,", "two")
+	gone := deliverTestMessage(t, dir, "cur", "3.c:2,", "three")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.cache.entries) != 3 {
+		t.Fatalf("Expected 3 cached entries, got %d", len(md.cache.entries))
+	}
+
+	/* same size and mtime: the cached headers are used */
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := fmt.Sprintf("From: a@example.com\r\nTo: b@example.com\r\nSubject: %s\r\nMessage-ID: <%s@example.com>\r\n\r\nbody\r\n", "owt", "2.b:2,")
+	err = ioutil.WriteFile(path, []byte(msg), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* the flags come from the file name, not from the cache */
+	err = os.Rename(path, path+"F")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(gone)
+	md, err = LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Sort(SortByFile)
+	m := md.Message(1)
+	if m.Subject != "two" || m.Flags != Flagged {
+		t.Errorf("Expected the cached headers, got %q, %v", m.Subject, m.Flags)
+	}
+	if len(md.cache.entries) != 2 {
+		t.Errorf("Expected the removed message to be pruned, got %d entries", len(md.cache.entries))
+	}
+
+	/* a modified file is parsed again */
+	later := fi.ModTime().Add(time.Second)
+	err = os.Chtimes(path+"F", later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err = LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Sort(SortByFile)
+	if m := md.Message(1); m.Subject != "owt" {
+		t.Errorf("Expected the modified headers, got %q", m.Subject)
+	}
+}
+
+func TestHeaderCacheCorrupted(t *testing.T) {
+	defer withHeaderCache(t)()
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "one")
+	hc := newHeaderCache(dir)
+	err := ioutil.WriteFile(hc.path, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := md.Message(0); m == nil || m.Subject != "one" {
+		t.Errorf("Unexpected message %v", m)
+	}
+}
+
+const benchMessages = 100000
+
+// Creates a maildir holding n messages, with the usual headers
+func newBenchMaildir(b *testing.B, n int) string {
+	dir := newTestMaildir(b)
+	for i := 0; i < n; i++ {
+		msg := fmt.Sprintf("Return-Path: <list-bounces@example.org>\r\n"+
+			"Received: from mx.example.org by mail.example.com; Mon, 4 Jul 2016 10:%02d:00 +0200\r\n"+
+			"From: =?utf-8?q?Andr=C3=A9_Example?= <user%d@example.com>\r\n"+
+			"To: list@example.org\r\n"+
+			"Cc: someone@example.com, someone.else@example.com\r\n"+
+			"Subject: Re: [list] message number %d\r\n"+
+			"Date: Mon, 4 Jul 2016 10:%02d:00 +0200\r\n"+
+			"Message-ID: <%d@example.com>\r\n"+
+			"In-Reply-To: <%d@example.com>\r\n"+
+			"References: <%d@example.com> <%d@example.com>\r\n"+
+			"MIME-Version: 1.0\r\n"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"\r\n"+
+			"The body of message %d.\r\n", i%60, i%100, i, i%60, i, i-1, i-2, i-1, i)
+		err := ioutil.WriteFile(filepath.Join(dir, "cur", fmt.Sprintf("%d.bench:2,S", i)), []byte(msg), 0600)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func benchmarkLoadMaildir(b *testing.B, cached bool) {
+	if cached {
+		defer withHeaderCache(b)()
+	}
+	dir := newBenchMaildir(b, benchMessages)
+	defer os.RemoveAll(dir)
+	if cached {
+		/* the first load fills the cache */
+		_, err := LoadMaildir(dir, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		md, err := LoadMaildir(dir, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if md.Len() != benchMessages {
+			b.Fatalf("Expected %d messages, got %d", benchMessages, md.Len())
+		}
+	}
+}
+
+func BenchmarkLoadMaildir(b *testing.B) {
+	benchmarkLoadMaildir(b, false)
+}
+
+func BenchmarkLoadMaildirCached(b *testing.B) {
+	benchmarkLoadMaildir(b, true)
+}
@@ -0,0 +1,834 @@
+// Package index is an on-disk inverted index of the messages found in a
+// set of maildirs, so that they can be searched without reading every
+// message.
+//
+// The index lives in a directory, holding a log of the indexed documents
+// and a set of segments, see segment.go. The documents added to the
+// index are kept in memory until Flush is called, at which point they're
+// written to a new segment. Segments of about the same size are merged
+// once there are enough of them, see pickMerge.
+package index
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"amua/fuzzy"
+)
+
+// The indexed fields. A search term not prefixed by a field name matches
+// any of them.
+var Fields = []string{"from", "to", "cc", "subject", "body"}
+
+// The fields whose words are also indexed by their Double Metaphone
+// codes, as "field~CODE" terms, for the fuzzy searches. A fuzzy word not
+// prefixed by a field name matches any of them.
+var PhoneticFields = []string{"from", "to", "cc", "subject"}
+
+const docsLog = "docs.log"
+const segSuffix = ".seg"
+
+// How many segments of the same tier are merged at once. The tier of a
+// segment grows with the log of its size, see segmentTier.
+const mergeFactor = 10
+
+// The segments smaller than this are all in the lowest tier
+const mergeBase = 64 << 10
+
+// Terms outside those bounds are not indexed, they're mostly noise
+const minTermLen = 2
+const maxTermLen = 40
+
+// A document is a message, identified by its maildir and the unique part
+// of its file name, which doesn't change with its flags
+type Doc struct {
+	Maildir string
+	Key     string
+}
+
+// A document matching a search, and how closely it does: from 1 for an
+// exact match down to 0
+type Hit struct {
+	Doc
+	Closeness float64
+}
+
+type Index struct {
+	dir       string
+	lock      sync.Mutex
+	mergeLock sync.Mutex // held while merging, outside of lock
+	docs      map[uint32]Doc
+	ids       map[Doc]uint32
+	nextId    uint32
+	log       *os.File
+	segments  []*segment
+	nextSeg   int
+	mem       map[string][]uint32 // the postings that weren't flushed yet
+	pending   []uint32            // the documents that weren't flushed yet
+}
+
+// Splits text into lower case terms
+func Tokenize(text string) []string {
+	ret := []string{}
+	for _, w := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		n := len([]rune(w))
+		if n < minTermLen || n > maxTermLen {
+			continue
+		}
+		ret = append(ret, strings.ToLower(w))
+	}
+	return ret
+}
+
+// Opens the index found in dir, creating it if needed
+func Open(dir string) (*Index, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{
+		dir:  dir,
+		docs: make(map[uint32]Doc),
+		ids:  make(map[Doc]uint32),
+		mem:  make(map[string][]uint32),
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		seg, err := openSegment(n)
+		if err != nil {
+			idx.closeSegments()
+			return nil, fmt.Errorf("%s: %s", n, err.Error())
+		}
+		idx.segments = append(idx.segments, seg)
+		if seg.maxId >= idx.nextId {
+			idx.nextId = seg.maxId + 1
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(n), segSuffix))
+		if err == nil && num >= idx.nextSeg {
+			idx.nextSeg = num + 1
+		}
+	}
+	err = idx.readLog()
+	if err != nil {
+		idx.closeSegments()
+		return nil, err
+	}
+	idx.log, err = os.OpenFile(filepath.Join(dir, docsLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		idx.closeSegments()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Replays the documents log: each line either adds a document with
+// '+id "maildir" "key"', or removes one with '-id'
+func (idx *Index) readLog() error {
+	f, err := os.Open(filepath.Join(idx.dir, docsLog))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		var id uint32
+		switch line[0] {
+		case '+':
+			var d Doc
+			_, err := fmt.Sscanf(line[1:], "%d %q %q", &id, &d.Maildir, &d.Key)
+			if err != nil {
+				/* a torn write at the end of the log, the
+				 * document will be indexed again */
+				continue
+			}
+			idx.docs[id] = d
+			idx.ids[d] = id
+		case '-':
+			_, err := fmt.Sscanf(line[1:], "%d", &id)
+			if err != nil {
+				continue
+			}
+			if d, ok := idx.docs[id]; ok {
+				delete(idx.ids, d)
+				delete(idx.docs, id)
+			}
+		}
+		if id >= idx.nextId {
+			idx.nextId = id + 1
+		}
+	}
+	return scanner.Err()
+}
+
+func (idx *Index) closeSegments() {
+	for _, seg := range idx.segments {
+		seg.Close()
+	}
+	idx.segments = nil
+}
+
+// Flushes the pending documents, and closes the index
+func (idx *Index) Close() error {
+	err := idx.Flush()
+	idx.mergeLock.Lock()
+	defer idx.mergeLock.Unlock()
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.closeSegments()
+	if cerr := idx.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Returns true if the document is indexed
+func (idx *Index) Has(d Doc) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	_, ok := idx.ids[d]
+	return ok
+}
+
+// Returns the keys of the documents indexed for a maildir
+func (idx *Index) Keys(maildir string) map[string]bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	ret := make(map[string]bool)
+	for d := range idx.ids {
+		if d.Maildir == maildir {
+			ret[d.Key] = true
+		}
+	}
+	return ret
+}
+
+// Returns the number of documents waiting to be flushed
+func (idx *Index) Pending() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return len(idx.pending)
+}
+
+// Indexes a document. fields maps the names found in Fields to their
+// text, the other fields are ignored. Adding a document that is already
+// indexed does nothing.
+func (idx *Index) Add(d Doc, fields map[string]string) {
+	terms := make(map[string]bool)
+	for _, f := range Fields {
+		for _, t := range Tokenize(fields[f]) {
+			terms[f+":"+t] = true
+		}
+	}
+	for _, f := range PhoneticFields {
+		for _, t := range Tokenize(fields[f]) {
+			for _, c := range fuzzy.NewWord(t).Codes() {
+				terms[f+"~"+c] = true
+			}
+		}
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if _, ok := idx.ids[d]; ok {
+		return
+	}
+	id := idx.nextId
+	idx.nextId++
+	idx.docs[id] = d
+	idx.ids[d] = id
+	idx.pending = append(idx.pending, id)
+	for t := range terms {
+		idx.mem[t] = append(idx.mem[t], id)
+	}
+}
+
+// Removes a document from the index
+func (idx *Index) Remove(d Doc) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	id, ok := idx.ids[d]
+	if !ok {
+		return nil
+	}
+	delete(idx.ids, d)
+	delete(idx.docs, id)
+	for i, p := range idx.pending {
+		if p == id {
+			/* it was never written, its postings are ignored
+			 * from now on */
+			idx.pending = append(idx.pending[:i], idx.pending[i+1:]...)
+			return nil
+		}
+	}
+	_, err := fmt.Fprintf(idx.log, "-%d\n", id)
+	return err
+}
+
+func (idx *Index) segmentPath(num int) string {
+	return filepath.Join(idx.dir, fmt.Sprintf("%08d%s", num, segSuffix))
+}
+
+// Writes the pending documents to a new segment, then merges the
+// segments if needed
+func (idx *Index) Flush() error {
+	err := idx.flush()
+	if err != nil {
+		return err
+	}
+	return idx.merge()
+}
+
+func (idx *Index) flush() error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if len(idx.pending) == 0 {
+		return nil
+	}
+	terms := make([]string, 0, len(idx.mem))
+	for t := range idx.mem {
+		terms = append(terms, t)
+	}
+	sort.Strings(terms)
+	i := 0
+	path := idx.segmentPath(idx.nextSeg)
+	err := writeSegment(path, func() (string, []uint32, bool) {
+		if i == len(terms) {
+			return "", nil, false
+		}
+		i++
+		return terms[i-1], idx.mem[terms[i-1]], true
+	})
+	if err != nil {
+		return err
+	}
+	seg, err := openSegment(path)
+	if err != nil {
+		return err
+	}
+	idx.nextSeg++
+	idx.segments = append(idx.segments, seg)
+	/* the documents are logged once their postings are on disk: if we
+	 * crash before, they'll just be indexed again */
+	w := bufio.NewWriter(idx.log)
+	for _, id := range idx.pending {
+		d := idx.docs[id]
+		fmt.Fprintf(w, "+%d %q %q\n", id, d.Maildir, d.Key)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = idx.log.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	idx.pending = nil
+	idx.mem = make(map[string][]uint32)
+	return nil
+}
+
+// Returns the tier of a segment: 0 below mergeBase, then one more each
+// time its size is multiplied by mergeFactor
+func segmentTier(seg *segment) int {
+	t := 0
+	for size := int64(mergeBase); seg.sparseOff >= size; size *= mergeFactor {
+		t++
+	}
+	return t
+}
+
+// Returns the segments to merge next, nil if there are none: the ones of
+// the lowest tier holding at least mergeFactor segments. The merged
+// segment usually ends up a tier higher, so a document is rewritten about
+// log(n) times instead of at every merge, and the frequent merges of the
+// new segments stay small.
+func pickMerge(segments []*segment) []*segment {
+	tiers := make(map[int][]*segment)
+	low := -1
+	for _, seg := range segments {
+		t := segmentTier(seg)
+		tiers[t] = append(tiers[t], seg)
+		if len(tiers[t]) >= mergeFactor && (low == -1 || t < low) {
+			low = t
+		}
+	}
+	if low == -1 {
+		return nil
+	}
+	return tiers[low]
+}
+
+// Merges the segments picked by pickMerge until there are none left to
+// merge, dropping the removed documents, and rewrites the documents log
+// with the live ones. The new segment and log are written without the
+// lock held, the searches using the old segments meanwhile, and are only
+// swapped in with it.
+func (idx *Index) merge() error {
+	idx.mergeLock.Lock()
+	defer idx.mergeLock.Unlock()
+	for {
+		idx.lock.Lock()
+		segs := pickMerge(idx.segments)
+		if segs == nil {
+			idx.lock.Unlock()
+			return nil
+		}
+		/* the pending documents are logged once flushed, after
+		 * logOff */
+		docs := make(map[uint32]Doc, len(idx.docs))
+		for id, d := range idx.docs {
+			docs[id] = d
+		}
+		for _, id := range idx.pending {
+			delete(docs, id)
+		}
+		fi, err := idx.log.Stat()
+		if err != nil {
+			idx.lock.Unlock()
+			return err
+		}
+		logOff := fi.Size()
+		path := idx.segmentPath(idx.nextSeg)
+		idx.nextSeg++
+		idx.lock.Unlock()
+
+		seg, err := mergeSegments(path, segs, docs)
+		if err != nil {
+			return err
+		}
+		logPath := filepath.Join(idx.dir, docsLog)
+		tmp := logPath + ".tmp"
+		err = writeLog(tmp, docs)
+		if err != nil {
+			seg.Close()
+			os.Remove(path)
+			return err
+		}
+
+		idx.lock.Lock()
+		err = idx.swapLog(tmp, logOff)
+		if err != nil {
+			idx.lock.Unlock()
+			os.Remove(tmp)
+			seg.Close()
+			os.Remove(path)
+			return err
+		}
+		merged := make(map[*segment]bool, len(segs))
+		for _, old := range segs {
+			merged[old] = true
+			old.Close()
+			os.Remove(old.path)
+		}
+		segments := []*segment{}
+		for _, s := range idx.segments {
+			if !merged[s] {
+				segments = append(segments, s)
+			}
+		}
+		idx.segments = append(segments, seg)
+		idx.lock.Unlock()
+	}
+}
+
+// Writes the postings of segs to a new segment at path, only keeping the
+// documents found in docs
+func mergeSegments(path string, segs []*segment, docs map[uint32]Doc) (*segment, error) {
+	its := make([]*segmentIterator, 0, len(segs))
+	for _, seg := range segs {
+		it := seg.iterator(int64(len(segMagic)))
+		err := it.next()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+	var ierr error
+	next := func() (string, []uint32, bool) {
+		for len(its) > 0 {
+			term := its[0].term
+			for _, it := range its[1:] {
+				if it.term < term {
+					term = it.term
+				}
+			}
+			var ids []uint32
+			remaining := its[:0]
+			for _, it := range its {
+				if it.term == term {
+					p, err := it.postings()
+					if err != nil {
+						ierr = err
+						return "", nil, false
+					}
+					for _, id := range p {
+						if _, ok := docs[id]; ok {
+							ids = append(ids, id)
+						}
+					}
+					err = it.next()
+					if err == io.EOF {
+						continue
+					}
+					if err != nil {
+						ierr = err
+						return "", nil, false
+					}
+				}
+				remaining = append(remaining, it)
+			}
+			its = remaining
+			if len(ids) > 0 {
+				return term, sortIds(ids), true
+			}
+		}
+		return "", nil, false
+	}
+	err := writeSegment(path, next)
+	if err == nil {
+		err = ierr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return openSegment(path)
+}
+
+// Writes a documents log holding docs to path
+func writeLog(path string, docs map[uint32]Doc) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for id, d := range docs {
+		fmt.Fprintf(w, "+%d %q %q\n", id, d.Maildir, d.Key)
+	}
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Replaces the documents log with tmp, once what was logged past logOff
+// is appended to it. Must be called with the lock held.
+func (idx *Index) swapLog(tmp string, logOff int64) error {
+	path := filepath.Join(idx.dir, docsLog)
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, logOff, 1<<62))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	idx.log.Close()
+	idx.log = log
+	return nil
+}
+
+type uint32Slice []uint32
+
+func (a uint32Slice) Len() int           { return len(a) }
+func (a uint32Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uint32Slice) Less(i, j int) bool { return a[i] < a[j] }
+
+// Sorts ids, and removes the duplicates
+func sortIds(ids []uint32) []uint32 {
+	sort.Sort(uint32Slice(ids))
+	ret := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// Merges two sorted lists of ids, without duplicates
+func union(a, b []uint32) []uint32 {
+	ret := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			ret = append(ret, a[i])
+			i++
+		case a[i] > b[j]:
+			ret = append(ret, b[j])
+			j++
+		default:
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	ret = append(ret, a[i:]...)
+	return append(ret, b[j:]...)
+}
+
+// Merges sorted lists of ids, two by two so that we don't go over the
+// longest ones more than log(len(lists)) times
+func unionAll(lists [][]uint32) []uint32 {
+	if len(lists) == 0 {
+		return nil
+	}
+	for len(lists) > 1 {
+		merged := lists[:0]
+		for i := 0; i < len(lists); i += 2 {
+			if i+1 == len(lists) {
+				merged = append(merged, lists[i])
+			} else {
+				merged = append(merged, union(lists[i], lists[i+1]))
+			}
+		}
+		lists = merged
+	}
+	return lists[0]
+}
+
+func intersect(a, b []uint32) []uint32 {
+	ret := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ret = append(ret, a[i])
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// Returns the sorted ids of the documents matching a term, with the
+// lock held
+func (idx *Index) lookup(term string, prefix bool) ([]uint32, error) {
+	var lists [][]uint32
+	collect := func(p []uint32) {
+		lists = append(lists, p)
+	}
+	for _, seg := range idx.segments {
+		err := seg.lookup(term, prefix, collect)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for t, p := range idx.mem {
+		if t == term || (prefix && strings.HasPrefix(t, term)) {
+			collect(p)
+		}
+	}
+	return unionAll(lists), nil
+}
+
+// Calls fn with the postings of the terms starting with prefix that want
+// returns true for, with the lock held
+func (idx *Index) scan(prefix string, want func(string) bool, fn func(string, []uint32)) error {
+	for _, seg := range idx.segments {
+		err := seg.scan(prefix, want, fn)
+		if err != nil {
+			return err
+		}
+	}
+	for t, p := range idx.mem {
+		if strings.HasPrefix(t, prefix) && want(t) {
+			fn(t, p)
+		}
+	}
+	return nil
+}
+
+// Returns the documents with a word close to word in one of fields, and
+// how close it is, with the lock held. The words within the edit
+// distance are only looked for among the ones starting with the same
+// letter, the phonetic codes take care of the others.
+func (idx *Index) fuzzyLookup(fields []string, word string) (map[uint32]float64, error) {
+	fw := fuzzy.NewWord(word)
+	ret := make(map[uint32]float64)
+	add := func(ids []uint32, closeness float64) {
+		for _, id := range ids {
+			if closeness > ret[id] {
+				ret[id] = closeness
+			}
+		}
+	}
+	first := string([]rune(word)[:1])
+	maxDist := fuzzy.MaxDistance(len([]rune(word)))
+	for _, f := range fields {
+		prefix := f + ":"
+		err := idx.scan(prefix+first, func(t string) bool {
+			return fuzzy.Distance(word, t[len(prefix):], maxDist) <= maxDist
+		}, func(t string, ids []uint32) {
+			add(ids, fw.Closeness(t[len(prefix):]))
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, c := range fw.Codes() {
+			closeness := fuzzy.PrimaryCloseness
+			if i > 0 {
+				closeness = fuzzy.SecondaryCloseness
+			}
+			ids, err := idx.lookup(f+"~"+c, false)
+			if err != nil {
+				return nil, err
+			}
+			add(ids, closeness)
+		}
+	}
+	return ret, nil
+}
+
+type hitsByCloseness []Hit
+
+func (h hitsByCloseness) Len() int           { return len(h) }
+func (h hitsByCloseness) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h hitsByCloseness) Less(i, j int) bool { return h[i].Closeness > h[j].Closeness }
+
+// Returns the documents matching a query: a list of words that must all
+// be found in the document. A word can be restricted to a field with a
+// "field:" prefix, and can end with a '*' to match all the terms
+// starting with it.
+func (idx *Index) Search(query string) ([]Doc, error) {
+	hits, err := idx.SearchRanked(query)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Doc, len(hits))
+	for i, h := range hits {
+		ret[i] = h.Doc
+	}
+	return ret, nil
+}
+
+// Like Search, but a word can also start with a '~' to match the words
+// sounding like it or within a small edit distance of it, e.g.
+// "from:~smith" matches "Schmitt". The hits are sorted by decreasing
+// closeness, a document being as close as its farthest fuzzy word.
+func (idx *Index) SearchRanked(query string) ([]Hit, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	var result []uint32
+	var closeness map[uint32]float64
+	nwords := 0
+	and := func(ids []uint32) {
+		if nwords == 0 {
+			result = ids
+		} else {
+			result = intersect(result, ids)
+		}
+		nwords++
+	}
+	for _, w := range strings.Fields(query) {
+		fields := Fields
+		if i := strings.Index(w, ":"); i != -1 {
+			fields = []string{strings.ToLower(w[:i])}
+			w = w[i+1:]
+		}
+		if strings.HasPrefix(w, "~") {
+			terms := Tokenize(w)
+			if len(terms) == 0 {
+				continue
+			}
+			if len(fields) > 1 {
+				fields = PhoneticFields
+			}
+			found, err := idx.fuzzyLookup(fields, terms[0])
+			if err != nil {
+				return nil, err
+			}
+			ids := make([]uint32, 0, len(found))
+			for id := range found {
+				ids = append(ids, id)
+			}
+			and(sortIds(ids))
+			if closeness == nil {
+				closeness = found
+				continue
+			}
+			for id, c := range found {
+				if prev, ok := closeness[id]; !ok || c < prev {
+					closeness[id] = c
+				}
+			}
+			continue
+		}
+		prefix := strings.HasSuffix(w, "*")
+		terms := Tokenize(w)
+		if len(terms) == 0 {
+			continue
+		}
+		for i, t := range terms {
+			var lists [][]uint32
+			for _, f := range fields {
+				p, err := idx.lookup(f+":"+t, prefix && i == len(terms)-1)
+				if err != nil {
+					return nil, err
+				}
+				lists = append(lists, p)
+			}
+			and(unionAll(lists))
+		}
+	}
+	ret := make([]Hit, 0, len(result))
+	for _, id := range result {
+		if d, ok := idx.docs[id]; ok {
+			c := 1.0
+			if closeness != nil {
+				c = closeness[id]
+			}
+			ret = append(ret, Hit{d, c})
+		}
+	}
+	sort.Stable(hitsByCloseness(ret))
+	return ret, nil
+}
@@ -0,0 +1,270 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestIndex(t testing.TB) (*Index, string) {
+	dir, err := ioutil.TempDir("", "amuaindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx, dir
+}
+
+func keys(docs []Doc) []string {
+	ret := []string{}
+	for _, d := range docs {
+		ret = append(ret, d.Key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func checkSearch(t *testing.T, idx *Index, query string, expected ...string) {
+	docs, err := idx.Search(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := keys(docs)
+	sort.Strings(expected)
+	if len(expected) == 0 {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("%q: expected %v, got %v", query, expected, got)
+	}
+}
+
+func addTestDocs(idx *Index) {
+	idx.Add(Doc{"inbox", "1"}, map[string]string{
+		"from":    "Alice <alice@example.com>",
+		"subject": "Lunch on Friday?",
+		"body":    "Shall we try the new Café downtown?",
+	})
+	idx.Add(Doc{"inbox", "2"}, map[string]string{
+		"from":    "Bob <bob@example.com>",
+		"subject": "Re: Lunch on Friday?",
+		"body":    "Sure, see you at noon. Alice said the café is great.",
+	})
+	idx.Add(Doc{"archive", "3"}, map[string]string{
+		"from":    "Carol <carol@example.org>",
+		"subject": "Quarterly report",
+		"body":    "The report is attached.",
+	})
+}
+
+func TestTokenize(t *testing.T) {
+	got := Tokenize("Hello, World! a x_y Ça-va? 42")
+	expected := []string{"hello", "world", "ça", "va", "42"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	idx, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer idx.Close()
+	addTestDocs(idx)
+	for i := 0; i < 2; i++ {
+		checkSearch(t, idx, "lunch", "1", "2")
+		checkSearch(t, idx, "CAFÉ", "1", "2")
+		checkSearch(t, idx, "from:alice", "1")
+		checkSearch(t, idx, "alice", "1", "2")
+		checkSearch(t, idx, "lunch noon", "2")
+		checkSearch(t, idx, "subject:report", "3")
+		checkSearch(t, idx, "rep*", "3")
+		checkSearch(t, idx, "re*", "2", "3")
+		checkSearch(t, idx, "example.org", "3")
+		checkSearch(t, idx, "nothing")
+		checkSearch(t, idx, "")
+		/* the same, from the disk */
+		err := idx.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	idx, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer idx.Close()
+	idx.Add(Doc{"inbox", "smith"}, map[string]string{"from": "John Smith <js@example.com>"})
+	idx.Add(Doc{"inbox", "smyth"}, map[string]string{"from": "Jane Smyth <jane@example.com>"})
+	idx.Add(Doc{"inbox", "schmitt"}, map[string]string{"from": "Anna Schmitt <as@example.com>"})
+	idx.Add(Doc{"inbox", "jones"}, map[string]string{"from": "Bob Jones <bob@example.com>", "body": "smith"})
+	for i := 0; i < 2; i++ {
+		hits, err := idx.SearchRanked("from:~smith")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, h := range hits {
+			got = append(got, h.Key)
+		}
+		expected := []string{"smith", "smyth", "schmitt"}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+		/* the body isn't searched phonetically */
+		checkSearch(t, idx, "~schmidt", "smith", "smyth", "schmitt")
+		checkSearch(t, idx, "~smith jones")
+		err = idx.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	idx, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	addTestDocs(idx)
+	err := idx.Remove(Doc{"inbox", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSearch(t, idx, "lunch", "1")
+	if !idx.Has(Doc{"archive", "3"}) || idx.Has(Doc{"inbox", "2"}) {
+		t.Error("Unexpected documents after reopening")
+	}
+	/* removing a flushed document */
+	err = idx.Remove(Doc{"inbox", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Close()
+	idx, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	checkSearch(t, idx, "lunch")
+	if got := idx.Keys("archive"); !reflect.DeepEqual(got, map[string]bool{"3": true}) {
+		t.Errorf("Unexpected keys: %v", got)
+	}
+	/* new documents don't reuse the ids of the old ones */
+	idx.Add(Doc{"inbox", "4"}, map[string]string{"subject": "lunch again"})
+	checkSearch(t, idx, "lunch", "4")
+}
+
+func TestMerge(t *testing.T) {
+	idx, dir := newTestIndex(t)
+	defer os.RemoveAll(dir)
+	defer idx.Close()
+	for i := 0; i < 3*mergeFactor; i++ {
+		idx.Add(Doc{"inbox", fmt.Sprint(i)}, map[string]string{
+			"subject": fmt.Sprintf("message number%d", i),
+		})
+		if i%7 == 0 {
+			idx.Remove(Doc{"inbox", fmt.Sprint(i)})
+		}
+		err := idx.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(idx.segments) >= mergeFactor {
+		t.Errorf("The segments weren't merged: %d", len(idx.segments))
+	}
+	docs, err := idx.Search("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := 3*mergeFactor - (3*mergeFactor+6)/7
+	if len(docs) != expected {
+		t.Errorf("Expected %d documents, got %d", expected, len(docs))
+	}
+	checkSearch(t, idx, "number8", "8")
+	checkSearch(t, idx, "number7")
+	checkSearch(t, idx, "number2*", "2", "20", "22", "23", "24", "25", "26", "27", "29")
+
+	/* the rewritten log matches the merged segments */
+	idx.Close()
+	idx2, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx2.Close()
+	docs, err = idx2.Search("message")
+	if err != nil || len(docs) != expected {
+		t.Errorf("Expected %d documents after reopening, got %d: %v", expected, len(docs), err)
+	}
+	checkSearch(t, idx2, "number7")
+}
+
+func TestPickMerge(t *testing.T) {
+	var segs []*segment
+	add := func(n int, size int64) {
+		for i := 0; i < n; i++ {
+			segs = append(segs, &segment{path: fmt.Sprint(len(segs)), sparseOff: size})
+		}
+	}
+	add(mergeFactor-1, mergeBase*mergeFactor)
+	add(mergeFactor-1, mergeBase)
+	add(mergeFactor-1, 1)
+	if m := pickMerge(segs); m != nil {
+		t.Errorf("Unexpected merge of %d segments", len(m))
+	}
+	/* the lowest full tier is merged first */
+	add(1, mergeBase*2)
+	add(1, mergeBase/2)
+	m := pickMerge(segs)
+	if len(m) != mergeFactor || m[0].sparseOff != 1 {
+		t.Fatalf("Unexpected merge of %d segments", len(m))
+	}
+	segs = segs[:len(segs)-1]
+	m = pickMerge(segs)
+	if len(m) != mergeFactor || m[0].sparseOff != mergeBase {
+		t.Fatalf("Unexpected merge of %d segments", len(m))
+	}
+}
+
+// Builds an index of 100000 messages, and measures the searches
+func BenchmarkSearch(b *testing.B) {
+	idx, dir := newTestIndex(b)
+	defer os.RemoveAll(dir)
+	defer idx.Close()
+	words := []string{"meeting", "report", "lunch", "invoice", "release", "build", "patch", "review"}
+	for i := 0; i < 100000; i++ {
+		idx.Add(Doc{"archive", fmt.Sprint(i)}, map[string]string{
+			"from":    fmt.Sprintf("user%d@example.com", i%500),
+			"subject": fmt.Sprintf("%s %s", words[i%len(words)], words[(i/8)%len(words)]),
+			"body":    fmt.Sprintf("ticket%d %s", i, words[(i/64)%len(words)]),
+		})
+		if i%5000 == 0 {
+			idx.Flush()
+		}
+	}
+	idx.Flush()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := idx.Search("lunch from:user42 review")
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = idx.Search("ticket9999*")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
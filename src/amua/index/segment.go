@@ -0,0 +1,373 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A segment is an immutable file holding the postings of a set of terms.
+// It is laid out as follows:
+//   - the magic
+//   - the entries, sorted by term: the uvarint length of the term, the
+//     term, the uvarint number of documents, the uvarint length of the
+//     postings in bytes, then the postings: the uvarint deltas of the
+//     sorted document ids
+//   - the sparse index: the uvarint number of samples, then every
+//     sampleRate-th term along with the offset of its entry
+//   - the footer: the offset of the sparse index, the highest document
+//     id, and the magic again
+//
+// Only the sparse index is kept in memory, a lookup reads at most
+// sampleRate entries from the disk.
+const segMagic = "AMUASEG1"
+const sampleRate = 64
+const footerLen = 8 + 4 + 8
+
+var errCorrupted = errors.New("corrupted index segment")
+
+type sample struct {
+	term string
+	off  int64
+}
+
+type segment struct {
+	path      string
+	f         *os.File
+	sparseOff int64
+	maxId     uint32
+	samples   []sample
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	off int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.off += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) writeUvarint(v uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	_, err := cw.Write(buf[:n])
+	return err
+}
+
+func (cw *countingWriter) writeString(s string) error {
+	err := cw.writeUvarint(uint64(len(s)))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(cw, s)
+	return err
+}
+
+// Writes a segment to path. next is called repeatedly to get the terms
+// in increasing order, along with their sorted postings, until it
+// returns false.
+func writeSegment(path string, next func() (string, []uint32, bool)) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeEntries(f, next)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func writeEntries(f *os.File, next func() (string, []uint32, bool)) error {
+	cw := &countingWriter{w: bufio.NewWriter(f)}
+	_, err := io.WriteString(cw, segMagic)
+	if err != nil {
+		return err
+	}
+	var samples []sample
+	var maxId uint32
+	postings := make([]byte, 0, 1024)
+	var buf [binary.MaxVarintLen64]byte
+	for i := 0; ; i++ {
+		term, ids, ok := next()
+		if !ok {
+			break
+		}
+		if i%sampleRate == 0 {
+			samples = append(samples, sample{term, cw.off})
+		}
+		postings = postings[:0]
+		prev := uint32(0)
+		for _, id := range ids {
+			n := binary.PutUvarint(buf[:], uint64(id-prev))
+			postings = append(postings, buf[:n]...)
+			prev = id
+		}
+		if prev > maxId {
+			maxId = prev
+		}
+		err = cw.writeString(term)
+		if err == nil {
+			err = cw.writeUvarint(uint64(len(ids)))
+		}
+		if err == nil {
+			err = cw.writeUvarint(uint64(len(postings)))
+		}
+		if err == nil {
+			_, err = cw.Write(postings)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sparseOff := cw.off
+	err = cw.writeUvarint(uint64(len(samples)))
+	for _, s := range samples {
+		if err == nil {
+			err = cw.writeString(s.term)
+		}
+		if err == nil {
+			err = cw.writeUvarint(uint64(s.off))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var footer [footerLen]byte
+	binary.BigEndian.PutUint64(footer[0:], uint64(sparseOff))
+	binary.BigEndian.PutUint32(footer[8:], maxId)
+	copy(footer[12:], segMagic)
+	_, err = cw.Write(footer[:])
+	if err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func openSegment(path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg, err := loadSegment(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+func loadSegment(path string, f *os.File) (*segment, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size < int64(len(segMagic)+footerLen) {
+		return nil, errCorrupted
+	}
+	var footer [footerLen]byte
+	_, err = f.ReadAt(footer[:], size-footerLen)
+	if err != nil {
+		return nil, err
+	}
+	if string(footer[12:]) != segMagic {
+		return nil, errCorrupted
+	}
+	seg := &segment{
+		path:      path,
+		f:         f,
+		sparseOff: int64(binary.BigEndian.Uint64(footer[0:])),
+		maxId:     binary.BigEndian.Uint32(footer[8:]),
+	}
+	if seg.sparseOff < int64(len(segMagic)) || seg.sparseOff > size-footerLen {
+		return nil, errCorrupted
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, seg.sparseOff, size-footerLen-seg.sparseOff))
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		term, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		off, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		seg.samples = append(seg.samples, sample{term, int64(off)})
+	}
+	return seg, nil
+}
+
+func (seg *segment) Close() error {
+	return seg.f.Close()
+}
+
+// Walks the entries of a segment in order
+type segmentIterator struct {
+	r    *bufio.Reader
+	term string
+	n    uint64 // the number of documents of the current term
+	size uint64 // the size of the postings of the current term
+	read bool   // true if the postings were read
+}
+
+func (seg *segment) iterator(off int64) *segmentIterator {
+	return &segmentIterator{
+		r: bufio.NewReader(io.NewSectionReader(seg.f, off, seg.sparseOff-off)),
+	}
+}
+
+// Moves to the next term, returns io.EOF at the end of the segment
+func (it *segmentIterator) next() error {
+	if it.term != "" && !it.read {
+		_, err := it.r.Discard(int(it.size))
+		if err != nil {
+			return err
+		}
+	}
+	term, err := readString(it.r)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return errCorrupted
+		}
+		return err
+	}
+	it.term = term
+	it.read = false
+	it.n, err = binary.ReadUvarint(it.r)
+	if err == nil {
+		it.size, err = binary.ReadUvarint(it.r)
+	}
+	if err != nil {
+		return errCorrupted
+	}
+	return nil
+}
+
+// Returns the postings of the current term
+func (it *segmentIterator) postings() ([]uint32, error) {
+	it.read = true
+	ids := make([]uint32, 0, it.n)
+	prev := uint32(0)
+	for i := uint64(0); i < it.n; i++ {
+		delta, err := binary.ReadUvarint(it.r)
+		if err != nil {
+			return nil, errCorrupted
+		}
+		prev += uint32(delta)
+		ids = append(ids, prev)
+	}
+	return ids, nil
+}
+
+// Returns an iterator on the block of entries where term would be
+func (seg *segment) seek(term string) *segmentIterator {
+	i := sort.Search(len(seg.samples), func(i int) bool {
+		return seg.samples[i].term >= term
+	})
+	/* the term can only be in the block of the previous sample, unless
+	 * it's the sample itself */
+	if i == len(seg.samples) || seg.samples[i].term != term {
+		i--
+	}
+	if i < 0 {
+		i = 0
+	}
+	return seg.iterator(seg.samples[i].off)
+}
+
+// Calls fn with the postings of term, or with the postings of all the
+// terms starting with term if prefix is set
+func (seg *segment) lookup(term string, prefix bool, fn func([]uint32)) error {
+	if len(seg.samples) == 0 {
+		return nil
+	}
+	it := seg.seek(term)
+	for {
+		err := it.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if it.term < term {
+			continue
+		}
+		if it.term == term || (prefix && strings.HasPrefix(it.term, term)) {
+			ids, err := it.postings()
+			if err != nil {
+				return err
+			}
+			fn(ids)
+			if !prefix {
+				return nil
+			}
+			continue
+		}
+		return nil
+	}
+}
+
+// Calls fn with the postings of the terms starting with prefix that want
+// returns true for. The postings of the others aren't even read.
+func (seg *segment) scan(prefix string, want func(string) bool, fn func(string, []uint32)) error {
+	if len(seg.samples) == 0 {
+		return nil
+	}
+	it := seg.seek(prefix)
+	for {
+		err := it.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if it.term < prefix {
+			continue
+		}
+		if !strings.HasPrefix(it.term, prefix) {
+			return nil
+		}
+		if !want(it.term) {
+			continue
+		}
+		ids, err := it.postings()
+		if err != nil {
+			return err
+		}
+		fn(it.term, ids)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"amua/util"
+)
+
+// The format of the lines of the index, in the spirit of mutt's
+// index_format. The placeholders are:
+//
+//	%C	the number of the message
+//	%Z	the flags
+//	%d	the date, as "2006-01-02 15:04"
+//	%{fmt}	the date, formatted with the strftime format fmt
+//	%D	the date relative to now: "5m", "3h", "2d", then "Jan 02"
+//	%F	the sender, or "To: recipient" for the messages I sent
+//	%c	the size
+//	%s	the subject
+//	%T	the thread tree, when sorted by thread
+//	%X	"@" if the message has attachments
+//	%B	the name of the mailing list
+//	%%	a percent sign
+//
+// A width can be given as in %-20.20F: the field is padded to the
+// minimum width, on the right if there's a minus, and truncated to the
+// maximum width after the dot. The widths are in screen cells.
+type IndexFormat []indexFormatItem
+
+type indexFormatItem struct {
+	literal string // shown as is if verb is 0
+	verb    byte
+	arg     string // the strftime format of %{fmt}
+	left    bool   // align on the left
+	min     int
+	max     int // -1 if there's no maximum width
+}
+
+const defaultIndexFormat = "%-6C%-6Z%{%b %d}  %-25.25F %1X[%5c] %T%s"
+
+var indexFormat = mustParseIndexFormat(defaultIndexFormat)
+
+func mustParseIndexFormat(s string) IndexFormat {
+	f, err := ParseIndexFormat(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Returns the digits at the start of s, as a number, and what follows
+func parseWidth(s string) (int, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 {
+		return -1, s
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n, s[i:]
+}
+
+func ParseIndexFormat(s string) (IndexFormat, error) {
+	ret := IndexFormat{}
+	for len(s) > 0 {
+		pct := strings.Index(s, "%")
+		if pct == -1 {
+			ret = append(ret, indexFormatItem{literal: s})
+			break
+		}
+		if pct > 0 {
+			ret = append(ret, indexFormatItem{literal: s[:pct]})
+		}
+		s = s[pct+1:]
+		it := indexFormatItem{max: -1}
+		if strings.HasPrefix(s, "-") {
+			it.left = true
+			s = s[1:]
+		}
+		it.min, s = parseWidth(s)
+		if strings.HasPrefix(s, ".") {
+			it.max, s = parseWidth(s[1:])
+			if it.max == -1 {
+				return nil, fmt.Errorf("Missing maximum width in the index format")
+			}
+		}
+		if len(s) == 0 {
+			return nil, fmt.Errorf("The index format ends with an incomplete placeholder")
+		}
+		it.verb = s[0]
+		s = s[1:]
+		switch it.verb {
+		case 'C', 'Z', 'd', 'D', 'F', 'c', 's', 'T', 'X', 'B':
+		case '%':
+			it = indexFormatItem{literal: "%"}
+		case '{':
+			end := strings.Index(s, "}")
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated date format in the index format")
+			}
+			it.arg = s[:end]
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("Unknown placeholder %%%c in the index format", it.verb)
+		}
+		ret = append(ret, it)
+	}
+	return ret, nil
+}
+
+// Returns the name of the first recipient, or its address if it has none
+func firstRecipient(to string) string {
+	addrs, err := mail.ParseAddressList(to)
+	if err != nil || len(addrs) == 0 {
+		return to
+	}
+	if addrs[0].Name != "" {
+		return addrs[0].Name
+	}
+	return addrs[0].Address
+}
+
+// Returns the sender of m, or who it was sent to if I'm the sender
+func fromOrTo(m *Message) string {
+	a, err := mail.ParseAddress(m.From)
+	if err == nil && isMe != nil && isMe(a) && m.To != "" {
+		return "To: " + firstRecipient(m.To)
+	}
+	return m.From
+}
+
+// Returns a short date: how long ago it was for the last week, the day
+// for the current year, the month otherwise
+func relativeDate(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	d := now.Sub(t)
+	switch {
+	case d < 0:
+		return t.Format("Jan 02")
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	case d < 7*24*time.Hour:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	case t.Year() == now.Year():
+		return t.Format("Jan 02")
+	}
+	return t.Format("Jan 2006")
+}
+
+// Formats t like strftime(3) would, for the usual conversions
+func strftime(t time.Time, format string) string {
+	if t.IsZero() {
+		return ""
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'a':
+			buf.WriteString(t.Format("Mon"))
+		case 'A':
+			buf.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			buf.WriteString(t.Format("Jan"))
+		case 'B':
+			buf.WriteString(t.Format("January"))
+		case 'd':
+			buf.WriteString(t.Format("02"))
+		case 'e':
+			fmt.Fprintf(&buf, "%2d", t.Day())
+		case 'H':
+			buf.WriteString(t.Format("15"))
+		case 'I':
+			buf.WriteString(t.Format("03"))
+		case 'j':
+			fmt.Fprintf(&buf, "%03d", t.YearDay())
+		case 'm':
+			buf.WriteString(t.Format("01"))
+		case 'M':
+			buf.WriteString(t.Format("04"))
+		case 'p':
+			buf.WriteString(t.Format("PM"))
+		case 'S':
+			buf.WriteString(t.Format("05"))
+		case 'y':
+			buf.WriteString(t.Format("06"))
+		case 'Y':
+			fmt.Fprintf(&buf, "%d", t.Year())
+		case 'z':
+			buf.WriteString(t.Format("-0700"))
+		case 'Z':
+			buf.WriteString(t.Format("MST"))
+		case 'F':
+			buf.WriteString(t.Format("2006-01-02"))
+		case 'R':
+			buf.WriteString(t.Format("15:04"))
+		case 'T':
+			buf.WriteString(t.Format("15:04:05"))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(format[i])
+		}
+	}
+	return buf.String()
+}
+
+// Returns the line of the index showing m, the idx-th message
+func (f IndexFormat) Format(idx int, m *Message, tree string, now time.Time) string {
+	var buf bytes.Buffer
+	for _, it := range f {
+		if it.verb == 0 {
+			buf.WriteString(it.literal)
+			continue
+		}
+		var s string
+		switch it.verb {
+		case 'C':
+			s = strconv.Itoa(idx)
+		case 'Z':
+			s = flagsToString(m.Flags)
+		case 'd':
+			s = strftime(m.Date, "%Y-%m-%d %H:%M")
+		case '{':
+			s = strftime(m.Date, it.arg)
+		case 'D':
+			s = relativeDate(m.Date, now)
+		case 'F':
+			s = fromOrTo(m)
+			if m.loadErr != nil {
+				s = filepath.Base(m.path)
+			}
+		case 'c':
+			s = util.SiteToHuman(m.size)
+		case 's':
+			s = m.Subject
+			if m.loadErr != nil {
+				s = "<" + m.loadErr.Error() + ">"
+			}
+		case 'T':
+			s = tree
+		case 'X':
+			if m.MediaType == "multipart/mixed" {
+				s = "@"
+			}
+		case 'B':
+			s = m.ListName
+		}
+		if it.max >= 0 {
+			s = util.TruncateString(s, it.max)
+		}
+		if it.min > 0 && util.StringWidth(s) < it.min {
+			if it.left {
+				s = util.PadRight(s, it.min)
+			} else {
+				s = util.PadLeft(s, it.min)
+			}
+		}
+		buf.WriteString(s)
+	}
+	return buf.String()
+}
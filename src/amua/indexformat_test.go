@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func TestIndexFormat(t *testing.T) {
+	defer func(f func(*mail.Address) bool) { isMe = f }(isMe)
+	isMe = func(a *mail.Address) bool { return a.Address == "me@example.com" }
+	now := time.Date(2016, 7, 4, 12, 0, 0, 0, time.UTC)
+	m := &Message{
+		Headers: Headers{
+			From:      "Someone <someone@example.com>",
+			To:        "Me <me@example.com>",
+			Subject:   "Hello",
+			Date:      time.Date(2016, 7, 4, 9, 5, 0, 0, time.UTC),
+			ListName:  "golang-nuts",
+			MediaType: "multipart/mixed",
+		},
+		size:  2048,
+		Flags: Seen | Flagged,
+	}
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"%C|%Z|%s", "3|   ! |Hello"},
+		{"%-5C|%5C|%.3s|%-8.3s|", "3    |    3|Hel|Hel     |"},
+		{"%d %{%a %e %b %Y, %H:%M}", "2016-07-04 09:05 Mon  4 Jul 2016, 09:05"},
+		{"%D [%c] %X%B 100%%", "2h [2.0K] @golang-nuts 100%"},
+		{"%F", "Someone <someone@example.com>"},
+		{"%T%s", "> Hello"},
+	}
+	for _, test := range tests {
+		f, err := ParseIndexFormat(test.format)
+		if err != nil {
+			t.Errorf("Can't parse %q: %s", test.format, err)
+			continue
+		}
+		if s := f.Format(3, m, "> ", now); s != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.format, s)
+		}
+	}
+
+	/* what I sent shows who I sent it to */
+	m.From, m.To = "Me <me@example.com>", "Someone <someone@example.com>, other@example.com"
+	f, _ := ParseIndexFormat("%F")
+	if s := f.Format(0, m, "", now); s != "To: Someone" {
+		t.Errorf("Unexpected sender %q", s)
+	}
+	/* the widths are in cells */
+	m.From = "山田太郎 <taro@example.jp>"
+	f, _ = ParseIndexFormat("%-5.5F|%6c|")
+	if s := f.Format(0, m, "", now); s != "山田 |  2.0K|" {
+		t.Errorf("Unexpected line %q", s)
+	}
+	m.loadErr = errors.New("broken")
+	f, _ = ParseIndexFormat("%s")
+	if s := f.Format(0, m, "", now); s != "<broken>" {
+		t.Errorf("Unexpected subject %q", s)
+	}
+
+	for _, format := range []string{"%", "%-", "%5.s", "%q", "%{%b"} {
+		if _, err := ParseIndexFormat(format); err == nil {
+			t.Errorf("Expected an error for %q", format)
+		}
+	}
+}
+
+func TestRelativeDate(t *testing.T) {
+	now := time.Date(2016, 7, 4, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date     time.Time
+		expected string
+	}{
+		{now.Add(-30 * time.Second), "30s"},
+		{now.Add(-5 * time.Minute), "5m"},
+		{now.Add(-3 * 24 * time.Hour), "3d"},
+		{time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC), "Jan 02"},
+		{time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC), "Jan 2015"},
+		{time.Time{}, ""},
+	}
+	for _, test := range tests {
+		if s := relativeDate(test.date, now); s != test.expected {
+			t.Errorf("Expected %q for %s, got %q", test.expected, test.date, s)
+		}
+	}
+}
+
+func TestListName(t *testing.T) {
+	tests := []struct {
+		header   mail.Header
+		expected string
+	}{
+		{mail.Header{"List-Id": {"Go Nuts <golang-nuts.googlegroups.com>"}}, "golang-nuts"},
+		{mail.Header{"List-Id": {"<local>"}}, "local"},
+		{mail.Header{"List-Post": {"<mailto:dev@lists.example.org>"}}, "dev"},
+		{mail.Header{}, ""},
+	}
+	for _, test := range tests {
+		if s := listName(test.header); s != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, s)
+		}
+	}
+}
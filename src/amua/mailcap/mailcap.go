@@ -0,0 +1,203 @@
+// Package mailcap parses mailcap files, as described in RFC 1524, and
+// finds the viewer to use for a given MIME type.
+package mailcap
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type Entry struct {
+	MimeType      string // the type, possibly with a "*" subtype
+	Command       string // the view command
+	NeedsTerminal bool   // the command is interactive
+	CopiousOutput bool   // the command outputs text, meant for a pager
+	Test          string // a command that must succeed for the entry to apply
+	NameTemplate  string // a template for the temporary file's name
+}
+
+type Mailcap struct {
+	Entries []*Entry
+}
+
+// Splits a line on the unescaped semicolons
+func splitFields(line string) []string {
+	ret := []string{}
+	cur := []byte{}
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			if line[i] != ';' {
+				cur = append(cur, '\\')
+			}
+			cur = append(cur, line[i])
+		case line[i] == ';':
+			ret = append(ret, strings.TrimSpace(string(cur)))
+			cur = cur[:0]
+		default:
+			cur = append(cur, line[i])
+		}
+	}
+	return append(ret, strings.TrimSpace(string(cur)))
+}
+
+func parseEntry(line string) *Entry {
+	fields := splitFields(line)
+	if len(fields) < 2 {
+		return nil
+	}
+	e := &Entry{MimeType: strings.ToLower(fields[0]), Command: fields[1]}
+	if !strings.Contains(e.MimeType, "/") {
+		/* RFC 1524: a missing subtype means any subtype */
+		e.MimeType += "/*"
+	}
+	for _, f := range fields[2:] {
+		name := f
+		value := ""
+		if i := strings.Index(f, "="); i != -1 {
+			name = strings.TrimSpace(f[:i])
+			value = strings.TrimSpace(f[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "needsterminal":
+			e.NeedsTerminal = true
+		case "copiousoutput":
+			e.CopiousOutput = true
+		case "test":
+			e.Test = value
+		case "nametemplate":
+			e.NameTemplate = value
+		}
+	}
+	return e
+}
+
+// Parses the mailcap entries read from r, and appends them to mc
+func (mc *Mailcap) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := ""
+	for scanner.Scan() {
+		l := scanner.Text()
+		if strings.HasSuffix(l, "\\") {
+			line += l[:len(l)-1]
+			continue
+		}
+		line += l
+		trimmed := strings.TrimSpace(line)
+		line = ""
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if e := parseEntry(trimmed); e != nil {
+			mc.Entries = append(mc.Entries, e)
+		}
+	}
+	return scanner.Err()
+}
+
+// The files searched when $MAILCAPS isn't set
+func DefaultPaths() []string {
+	if env := os.Getenv("MAILCAPS"); env != "" {
+		return filepath.SplitList(env)
+	}
+	ret := []string{}
+	if home := os.Getenv("HOME"); home != "" {
+		ret = append(ret, filepath.Join(home, ".mailcap"))
+	}
+	return append(ret, "/etc/mailcap", "/usr/etc/mailcap", "/usr/local/etc/mailcap")
+}
+
+// Loads the mailcap files found in paths, the missing ones are skipped
+func Load(paths []string) (*Mailcap, error) {
+	mc := &Mailcap{}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		err = mc.Parse(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mc, nil
+}
+
+func typeMatches(pattern, mimeType string) bool {
+	if pattern == mimeType {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, pattern[:len(pattern)-1])
+	}
+	return false
+}
+
+// Returns the first entry matching mimeType whose test passes, or nil
+func (mc *Mailcap) Lookup(mimeType string, params map[string]string) *Entry {
+	mimeType = strings.ToLower(mimeType)
+	for _, e := range mc.Entries {
+		if !typeMatches(e.MimeType, mimeType) {
+			continue
+		}
+		if e.Test != "" {
+			test := Expand(e.Test, "", mimeType, params)
+			if exec.Command("/bin/sh", "-c", test).Run() != nil {
+				continue
+			}
+		}
+		return e
+	}
+	return nil
+}
+
+// Returns true if the command reads the file name, and not stdin
+func TakesFile(command string) bool {
+	return strings.Contains(strings.Replace(command, "%%", "", -1), "%s")
+}
+
+// Quotes s so that the shell takes it as a single word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Expands the %s, %t and %{param} sequences of a mailcap command
+func Expand(command, file, mimeType string, params map[string]string) string {
+	ret := []byte{}
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' || i+1 == len(command) {
+			ret = append(ret, command[i])
+			continue
+		}
+		i++
+		switch command[i] {
+		case 's':
+			ret = append(ret, shellQuote(file)...)
+		case 't':
+			ret = append(ret, shellQuote(mimeType)...)
+		case '%':
+			ret = append(ret, '%')
+		case '{':
+			end := strings.Index(command[i:], "}")
+			if end == -1 {
+				ret = append(ret, '%', '{')
+				continue
+			}
+			name := strings.ToLower(command[i+1 : i+end])
+			ret = append(ret, shellQuote(params[name])...)
+			i += end
+		default:
+			ret = append(ret, '%', command[i])
+		}
+	}
+	return string(ret)
+}
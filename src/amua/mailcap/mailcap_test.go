@@ -0,0 +1,67 @@
+package mailcap
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMailcap = `# a comment
+application/pdf; evince %s
+text/html; lynx -dump %s; copiousoutput; nametemplate=%s.html
+image/*; feh \
+	%s; test=false
+image/png; display %s; needsterminal
+audio; play -t %{format} -
+text/plain; cat %s\; echo done
+`
+
+func TestParse(t *testing.T) {
+	mc := &Mailcap{}
+	err := mc.Parse(strings.NewReader(testMailcap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.Entries) != 6 {
+		t.Fatalf("Expected 6 entries, got %d", len(mc.Entries))
+	}
+	html := mc.Entries[1]
+	if html.Command != "lynx -dump %s" || !html.CopiousOutput || html.NameTemplate != "%s.html" {
+		t.Errorf("Unexpected entry: %+v", html)
+	}
+	if mc.Entries[2].Command != "feh 	%s" || mc.Entries[2].Test != "false" {
+		t.Errorf("Continuation lines not handled: %+v", mc.Entries[2])
+	}
+	if mc.Entries[4].MimeType != "audio/*" {
+		t.Errorf("Missing subtype not handled: %+v", mc.Entries[4])
+	}
+	if mc.Entries[5].Command != "cat %s; echo done" {
+		t.Errorf("Escaped semicolon not handled: %+v", mc.Entries[5])
+	}
+}
+
+func TestLookup(t *testing.T) {
+	mc := &Mailcap{}
+	mc.Parse(strings.NewReader(testMailcap))
+	e := mc.Lookup("IMAGE/PNG", nil)
+	if e == nil || e.Command != "display %s" || !e.NeedsTerminal {
+		t.Errorf("Unexpected entry for image/png: %+v", e)
+	}
+	if e := mc.Lookup("application/zip", nil); e != nil {
+		t.Errorf("Unexpected entry for application/zip: %+v", e)
+	}
+	if e := mc.Lookup("audio/ogg", nil); e == nil || !strings.HasPrefix(e.Command, "play") {
+		t.Errorf("Unexpected entry for audio/ogg: %+v", e)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	params := map[string]string{"format": "ogg"}
+	got := Expand("play -t %{format} %s %t 100%%", "/tmp/it's.ogg", "audio/ogg", params)
+	expected := `play -t 'ogg' '/tmp/it'\''s.ogg' 'audio/ogg' 100%`
+	if got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if TakesFile("play -") || !TakesFile("evince %s") || TakesFile("echo %%s") {
+		t.Error("TakesFile is wrong")
+	}
+}
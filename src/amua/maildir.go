@@ -5,33 +5,282 @@ import (
 	"sort"
 	"io"
 	"os"
-	"io/ioutil"
 	"bytes"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"amua/util"
+	"amua/query"
 
 	"github.com/deweerdt/gocui"
 )
 
+// A Maildir is shared between the UI and the goroutine monitoring it.
+// The monitor only adds, removes or replaces messages in the list, and
+// never modifies a message once it's been added: the Message fields are
+// only ever written by the UI, with the lock held. As a consequence, the
+// UI can read a Message's fields without holding the lock, but the
+// messages list itself has to be accessed through the methods below.
+//
+// A Maildir can also be virtual, see savedSearch: its messages then
+// belong to other maildirs, which the changes are forwarded to.
 type Maildir struct {
 	path     string
+	lock     sync.Mutex // protects the fields below, and the writes to the messages' path and Flags
+	active   bool       // true if the messages are loaded, and not just their path
 	messages []*Message
+	gen      uint64                // bumped each time the messages list changes
+	search   *savedSearch          // set if the maildir is virtual
+	owners   map[*Message]*Maildir // the maildir each message of a virtual maildir comes from
+	cache    *headerCache          // nil if the headers aren't cached
+	loading  bool                  // true while Load adds the messages
+	loadSeq  uint64                // identifies the latest Load
+	pending  bool                  // true if changes were seen while loading, see rescan
+	fresh    map[string]bool       // the keys of the messages delivered since the maildir was left
 }
 
-type onMaildirChangeFn func(*knownMaildir)
+// What the sidebar shows about a maildir
+type maildirCounts struct {
+	total   int
+	unread  int
+	fresh   int // unread, and delivered since the maildir was left
+	flagged int
+}
 
-func (km *knownMaildir) Start(onChange onMaildirChangeFn) {
+// Counts the messages using their flags only, which are known even when
+// the maildir isn't active
+func (md *Maildir) Counts() maildirCounts {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	c := maildirCounts{total: len(md.messages)}
+	for _, m := range md.messages {
+		if (m.Flags & Flagged) != 0 {
+			c.flagged++
+		}
+		if (m.Flags & Seen) != 0 {
+			continue
+		}
+		c.unread++
+		if md.fresh[maildirKey(filepath.Base(m.path))] {
+			c.fresh++
+		}
+	}
+	return c
+}
+
+func (md *Maildir) Len() int {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return len(md.messages)
+}
+
+// Returns the idx-th message, or nil if idx is out of bounds
+func (md *Maildir) Message(idx int) *Message {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if idx < 0 || idx >= len(md.messages) {
+		return nil
+	}
+	return md.messages[idx]
+}
+
+// Returns a snapshot of the messages list
+func (md *Maildir) Messages() []*Message {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	ret := make([]*Message, len(md.messages))
+	copy(ret, md.messages)
+	return ret
+}
+
+// Returns the position of m in the messages list, or -1
+func (md *Maildir) Index(m *Message) int {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	for i, cur := range md.messages {
+		if cur == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns a number that changes each time the messages list does, be it
+// because messages were added, removed or sorted
+func (md *Maildir) Generation() uint64 {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return md.gen
+}
+
+func (md *Maildir) IsActive() bool {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return md.active
+}
+
+// Returns true while the messages are being loaded, see LoadWithProgress
+func (md *Maildir) IsLoading() bool {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return md.loading
+}
+
+func (md *Maildir) SetActive(active bool) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.active = active
+	if !active {
+		/* the user saw what was delivered */
+		md.fresh = nil
+	}
+}
+
+// Sets then clears the passed flags on m
+func (md *Maildir) SetFlags(m *Message, set MessageFlags, clear MessageFlags) {
+	if md.search != nil {
+		o, om := md.sourceMessage(m)
+		o.SetFlags(om, set, clear)
+		if om != m {
+			/* a copy, see loadSearch */
+			md.lock.Lock()
+			m.Flags = om.Flags
+			md.lock.Unlock()
+		}
+		return
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	m.Flags |= set
+	m.Flags &= ^clear
+}
+
+// Sorts the messages, returns the thread tree prefixes when sorting by
+// thread
+func (md *Maildir) Sort(mode SortMode) map[*Message]string {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.gen++
+	var tree map[*Message]string
+	switch mode {
+	case SortByFile:
+		sort.Sort(ByPath(md.messages))
+	case SortByDate:
+		sort.Sort(ByDate(md.messages))
+	case SortByThread:
+		md.messages, tree = threadMessages(md.messages)
+	}
+	return tree
+}
+
+func (md *Maildir) SortByDate() {
+	md.Sort(SortByDate)
+}
+
+// Writes the in-memory changes to disk: trashed messages are removed, and
+// the flags are saved in the file names
+func (md *Maildir) ApplyChanges() error {
+	if md.search != nil {
+		return md.applySearchChanges()
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	var ret error
+	msgs := make([]*Message, 0, len(md.messages))
+	removed := []*Message{}
+	for _, m := range md.messages {
+		if (m.Flags & Trashed) != 0 {
+			err := trashFile(md.path, m.path)
+			if err != nil && !os.IsNotExist(err) {
+				ret = err
+				msgs = append(msgs, m)
+				continue
+			}
+			removed = append(removed, m)
+			continue
+		}
+		msgs = append(msgs, m)
+		newPath := fmt.Sprintf("%s:2,%s", maildirKey(m.path), flagsToFile(m.Flags))
+		if m.path != newPath {
+			err := os.Rename(m.path, newPath)
+			if err != nil {
+				/* if another client renamed it in the meantime,
+				 * the monitor will pick up the new name */
+				if !os.IsNotExist(err) {
+					ret = err
+				}
+				continue
+			}
+			m.path = newPath
+		}
+	}
+	md.messages = msgs
+	md.gen++
+	searchIndex.removed(md.path, removed)
+	return ret
+}
+
+// Called by the monitors with the maildir that changed. The monitors run
+// on their own copy of the knownMaildir, as the UI replaces its list.
+type onMaildirChangeFn func(*Maildir)
+
+// How long we wait for a burst of events to settle before rescanning the
+// maildir, so that a large delivery triggers a single refresh
+const watchBatchDelay = 100 * time.Millisecond
+
+// Picks up the changes made to the maildir. While it's being loaded, the
+// changes are only recorded as pending, and Load picks them up once it's
+// published its last batch: processNew and processCur check this with
+// the lock held, as a Load can start at any time.
+func (km *knownMaildir) rescan(onChange onMaildirChangeFn) {
+	newChanged, _ := processNew(km.maildir)
+	curChanged, _ := processCur(km.maildir)
+	if newChanged || curChanged {
+		onChange(km.maildir)
+	}
+}
+
+func (km *knownMaildir) poll(onChange onMaildirChangeFn) {
 	for {
 		select {
 		case <-km.stopMonitor:
 			return
 		case <-time.After(time.Second * 1):
-			changed, _ := processNew(km.maildir, km.active)
-			if changed {
-				onChange(km)
+			km.rescan(onChange)
+		}
+	}
+}
+
+// Monitors the maildir for changes, using inotify if possible, and
+// falling back to polling otherwise
+func (km *knownMaildir) Start(onChange onMaildirChangeFn) {
+	w, err := newMaildirWatcher(km.path)
+	if err != nil {
+		km.poll(onChange)
+		return
+	}
+	defer w.Close()
+	/* catch what was delivered before the watch was set up */
+	km.rescan(onChange)
+	var batch <-chan time.Time
+	for {
+		select {
+		case <-km.stopMonitor:
+			return
+		case <-w.events:
+			if batch == nil {
+				batch = time.After(watchBatchDelay)
 			}
+		case <-batch:
+			batch = nil
+			km.rescan(onChange)
+		case <-w.errors:
+			w.Close()
+			km.poll(onChange)
+			return
 		}
 	}
 }
@@ -44,74 +293,563 @@ type readState struct {
 	buffers []*bytes.Buffer
 }
 
+// Returns a message for path: fully loaded if the maildir is active, or
+// just a stub otherwise. A file that can't be parsed gives a placeholder
+// holding the error, an error is only returned if it can't be found.
+func (md *Maildir) loadMessage(path string, active bool) (*Message, error) {
+	if !active {
+		/* the flags are enough for the sidebar's counts */
+		return &Message{path: path, Flags: pathFlags(path)}, nil
+	}
+	var m *Message
+	var err error
+	if md.cache != nil {
+		m, err = md.cache.loadMessage(path)
+	} else {
+		m, err = LoadMessage(path)
+	}
+	if err == nil {
+		return m, nil
+	}
+	fi, serr := os.Stat(path)
+	if serr != nil {
+		return nil, serr
+	}
+	return brokenMessage(path, fi.Size(), err), nil
+}
 
-func processNew(md *Maildir, active bool) (bool, error) {
+func processNew(md *Maildir) (bool, error) {
 	curdir := filepath.Join(md.path, "cur")
 	newdir := filepath.Join(md.path, "new")
-	fis, err := ioutil.ReadDir(newdir)
-	changed := false
+	names, err := readDirNames(newdir)
 	if err != nil {
 		return false, err
 	}
-	for _, fi := range fis {
-		oldName := fi.Name()
+	active := md.IsActive()
+	msgs := make([]*Message, 0, len(names))
+	for _, oldName := range names {
 		newName := fmt.Sprintf("%s:2,", oldName)
 		err := os.Rename(filepath.Join(newdir, oldName), filepath.Join(curdir, newName))
 		if err != nil {
+			if os.IsNotExist(err) {
+				/* another client picked it up first */
+				continue
+			}
 			return false, err
 		}
-		if active {
-			m, err := LoadMessage(filepath.Join(curdir, newName))
-			if err != nil {
-				return false, err
-			}
+		m, err := md.loadMessage(filepath.Join(curdir, newName), active)
+		if err != nil {
+			/* gone already */
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	md.add(msgs)
+	if len(msgs) > 0 {
+		md.lock.Lock()
+		if md.fresh == nil {
+			md.fresh = make(map[string]bool)
+		}
+		for _, m := range msgs {
+			md.fresh[maildirKey(filepath.Base(m.path))] = true
+		}
+		md.lock.Unlock()
+	}
+	return len(msgs) > 0, nil
+}
+
+// Appends msgs to the maildir, skipping the ones that are already known.
+// While the maildir is being loaded, they're left for Load to pick up.
+func (md *Maildir) add(msgs []*Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	md.lock.Lock()
+	if md.loading {
+		md.pending = true
+		md.lock.Unlock()
+		return
+	}
+	known := make(map[string]bool, len(md.messages))
+	for _, m := range md.messages {
+		known[maildirKey(filepath.Base(m.path))] = true
+	}
+	added := make([]*Message, 0, len(msgs))
+	for _, m := range msgs {
+		if !known[maildirKey(filepath.Base(m.path))] {
 			md.messages = append(md.messages, m)
-		} else {
-			md.messages = append(md.messages, &Message{path: filepath.Join(curdir, newName)})
+			added = append(added, m)
 		}
-		changed = true
 	}
-	return changed, nil
+	if len(added) > 0 {
+		md.gen++
+	}
+	md.lock.Unlock()
+	searchIndex.added(md.path, added)
 }
 
-func LoadMaildir(mdPath string, active bool) (*Maildir, error) {
-	md := &Maildir{}
-	md.path = mdPath
-	curdir := filepath.Join(mdPath, "cur")
-	fis, err := ioutil.ReadDir(curdir)
+// Returns the unique part of a maildir file name, without the info
+// suffix holding the flags
+func maildirKey(name string) string {
+	if i := strings.LastIndex(name, ":2,"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
 	if err != nil {
 		return nil, err
 	}
-	msgs := make([]*Message, len(fis))
-	for i, fi := range fis {
-		if active {
-			m, err := LoadMessage(filepath.Join(curdir, fi.Name()))
-			if err != nil {
-				return nil, err
-			}
-			msgs[i] = m
-		} else {
-			msgs[i] = &Message{path: filepath.Join(curdir, fi.Name())}
-		}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
 
+// Returns a copy of m, with a new path and new flags. The monitor never
+// modifies the messages in place, see Maildir.
+func (m *Message) withPath(path string, flags MessageFlags) *Message {
+	nm := *m
+	nm.path, nm.Flags, nm.rs = path, flags, nil
+	return &nm
+}
+
+// Picks up the changes made to cur/ by other clients, or by the outbox:
+// messages that were added, removed or had their flags changed. The flags
+// changed in memory and not applied yet are kept.
+func processCur(md *Maildir) (bool, error) {
+	curdir := filepath.Join(md.path, "cur")
+	md.lock.Lock()
+	if md.loading {
+		md.pending = true
+		md.lock.Unlock()
+		return false, nil
+	}
+	/* the directory is read with the lock held, otherwise we could
+	 * undo a rename done by ApplyChanges in the meantime */
+	names, err := readDirNames(curdir)
+	if err != nil {
+		md.lock.Unlock()
+		return false, err
+	}
+	onDisk := make(map[string]string, len(names))
+	for _, n := range names {
+		onDisk[maildirKey(n)] = n
+	}
+	changed := false
+	msgs := make([]*Message, 0, len(md.messages))
+	removed := []*Message{}
+	for _, m := range md.messages {
+		name := filepath.Base(m.path)
+		key := maildirKey(name)
+		n, ok := onDisk[key]
+		if !ok {
+			removed = append(removed, m)
+			changed = true
+			continue
+		}
+		delete(onDisk, key)
+		if n != name {
+			/* the flags set or cleared since the last sync are
+			 * kept on top of the ones found on disk */
+			synced := parseFlags(name[len(key):])
+			flags := parseFlags(n[len(key):])
+			flags = (flags | (m.Flags &^ synced)) &^ (synced &^ m.Flags)
+			m = m.withPath(filepath.Join(curdir, n), flags)
+			changed = true
+		}
+		msgs = append(msgs, m)
 	}
 	md.messages = msgs
-	_, err = processNew(md, active)
+	if changed {
+		md.gen++
+	}
+	active := md.active
+	md.lock.Unlock()
+	searchIndex.removed(md.path, removed)
+
+	added := make([]*Message, 0, len(onDisk))
+	for _, n := range onDisk {
+		m, err := md.loadMessage(filepath.Join(curdir, n), active)
+		if err != nil {
+			continue
+		}
+		added = append(added, m)
+	}
+	md.add(added)
+	return changed || len(added) > 0, nil
+}
+
+var deliveries uint32
+
+// Returns a unique file name for a new message, as described in
+// https://cr.yp.to/proto/maildir.html
+func uniqueName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(host, "/", "\\057", -1)
+	host = strings.Replace(host, ":", "\\072", -1)
+	now := time.Now()
+	seq := atomic.AddUint32(&deliveries, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), seq, host)
+}
+
+// Delivers the message read from r to the maildir at mdPath: the message
+// is written to tmp/ first, then atomically moved to cur/ with the passed
+// flags. Returns the path of the delivered message.
+func deliver(mdPath string, r io.Reader, flags MessageFlags) (string, error) {
+	name := uniqueName()
+	tmpPath := filepath.Join(mdPath, "tmp", name)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	path := filepath.Join(mdPath, "cur", fmt.Sprintf("%s:2,%s", name, flagsToFile(flags)))
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return path, nil
+}
+
+// Copies m to the maildir dst, keeping its flags. Returns the copy.
+func (md *Maildir) CopyTo(m *Message, dst *Maildir) (*Message, error) {
+	f, err := os.Open(m.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	path, err := deliver(dst.path, f, m.Flags)
+	if err != nil {
+		return nil, err
+	}
+	nm, err := dst.loadMessage(path, dst.IsActive())
 	if err != nil {
 		return nil, err
 	}
+	dst.add([]*Message{nm})
+	return nm, nil
+}
 
+// Moves m to the maildir dst, keeping its flags. Returns the moved
+// message.
+func (md *Maildir) MoveTo(m *Message, dst *Maildir) (*Message, error) {
+	nm, err := md.CopyTo(m, dst)
+	if err != nil {
+		return nil, err
+	}
+	return nm, md.Remove(m)
+}
+
+// Removes m from the maildir, and its file from the disk
+func (md *Maildir) Remove(m *Message) error {
+	if md.search != nil {
+		return md.removeFromSearch(m)
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	for i, cur := range md.messages {
+		if cur == m {
+			md.messages = append(md.messages[:i], md.messages[i+1:]...)
+			md.gen++
+			break
+		}
+	}
+	err := os.Remove(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	searchIndex.removed(md.path, []*Message{m})
+	return nil
+}
+
+// How many files are parsed at once when loading a maildir. Parsing is
+// mostly waiting for the disk, hence more workers than CPUs.
+var loadWorkers = 4 * runtime.NumCPU()
+
+// How many parsed messages are added to the maildir at once
+const loadBatch = 1000
+
+// (Re)loads the messages from disk
+func (md *Maildir) Load(active bool) error {
+	return md.LoadWithProgress(active, nil)
+}
+
+// (Re)loads the messages from disk. When active, the files are parsed
+// by a pool of workers, and the messages are added to the maildir as
+// they come, so that they can be shown before the loading is done:
+// progress is called after each batch, with the number of files
+// processed so far out of total. The messages are sorted by path once
+// they're all loaded. A Load started in the meantime supersedes this
+// one, which then stops adding messages.
+func (md *Maildir) LoadWithProgress(active bool, progress func(loaded int, total int)) error {
+	if md.search != nil {
+		return md.loadSearch()
+	}
+	curdir := filepath.Join(md.path, "cur")
+	md.lock.Lock()
+	md.loadSeq++
+	seq := md.loadSeq
+	md.messages = []*Message{}
+	md.active = active
+	md.loading = true
+	md.pending = false
+	md.gen++
+	md.lock.Unlock()
+	/* returns false if another Load started since */
+	publish := func(msgs []*Message, last bool) bool {
+		md.lock.Lock()
+		defer md.lock.Unlock()
+		if md.loadSeq != seq {
+			return false
+		}
+		md.messages = append(md.messages, msgs...)
+		if last {
+			sort.Sort(ByPath(md.messages))
+			md.loading = false
+		}
+		md.gen++
+		return true
+	}
+	/* the directory is read once loading is set, so that what's added
+	 * to it from now on is left pending */
+	names, err := readDirNames(curdir)
+	if err != nil {
+		publish(nil, true)
+		return err
+	}
+
+	if !active {
+		msgs := make([]*Message, len(names))
+		for i, n := range names {
+			msgs[i] = &Message{path: filepath.Join(curdir, n), Flags: pathFlags(n)}
+		}
+		if !publish(msgs, true) {
+			return nil
+		}
+	} else {
+		paths := make(chan string)
+		results := make(chan *Message)
+		var wg sync.WaitGroup
+		for i := 0; i < loadWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for p := range paths {
+					m, err := md.loadMessage(p, true)
+					if err != nil {
+						/* gone since we read the directory */
+						m = nil
+					}
+					results <- m
+				}
+			}()
+		}
+		go func() {
+			for _, n := range names {
+				paths <- filepath.Join(curdir, n)
+			}
+			close(paths)
+			wg.Wait()
+			close(results)
+		}()
+		superseded := false
+		batch := make([]*Message, 0, loadBatch)
+		loaded := 0
+		for m := range results {
+			loaded++
+			if m != nil {
+				batch = append(batch, m)
+			}
+			if superseded || loaded%loadBatch != 0 || loaded == len(names) {
+				continue
+			}
+			if !publish(batch, false) {
+				/* the workers are left to finish, we just
+				 * drop their results */
+				superseded = true
+				continue
+			}
+			batch = batch[:0]
+			if progress != nil {
+				progress(loaded, len(names))
+			}
+		}
+		if superseded || !publish(batch, true) {
+			return nil
+		}
+		if md.cache != nil {
+			keys := make(map[string]bool, len(names))
+			for _, n := range names {
+				keys[maildirKey(n)] = true
+			}
+			/* the messages in new/ are added below, their entries
+			 * will be written on the next load */
+			md.cache.prune(keys)
+			md.cache.save()
+		}
+	}
+	_, err = processNew(md)
+	md.lock.Lock()
+	pending := md.pending
+	md.pending = false
+	md.lock.Unlock()
+	if pending {
+		/* what changed in cur/ while we were loading */
+		_, cerr := processCur(md)
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Writes the cached headers of the maildir to disk
+func (md *Maildir) SaveCache() error {
+	return md.cache.save()
+}
+
+func LoadMaildir(mdPath string, active bool) (*Maildir, error) {
+	md := &Maildir{path: mdPath, cache: newHeaderCache(mdPath)}
+	err := md.Load(active)
+	if err != nil {
+		return nil, err
+	}
 	return md, nil
 }
 
-func (md *Maildir) SortByDate() {
-	sort.Sort(ByDate(md.messages))
+type SortMode int
+
+const (
+	SortByFile SortMode = iota // the order of the files in the maildir
+	SortByDate
+	SortByThread
+	MaxSortMode
+)
+
+var sortModeTxt = map[SortMode]string{
+	SortByFile:   "file",
+	SortByDate:   "date",
+	SortByThread: "thread",
 }
 
+type ByPath []*Message
+
+func (a ByPath) Len() int           { return len(a) }
+func (a ByPath) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByPath) Less(i, j int) bool { return a[i].path < a[j].path }
+
 type MaildirView struct {
-	curTop int
-	cur     int
-	md      *Maildir
+	curTop    int
+	cur       int
+	md        *Maildir
+	sortMode  SortMode
+	tree      map[*Message]string // the thread tree prefixes, when sorted by thread
+	limit     string              // the query limiting the messages shown, if any
+	limitExpr query.Expr
+	limited   []*Message // the messages matching limit
+	limitGen  uint64     // the maildir generation limited was computed for
+}
+
+// Returns the messages shown by the view: all the messages of the
+// maildir, or just those matching the limit. The limit is applied again
+// each time the maildir changes.
+func (mv *MaildirView) Messages() []*Message {
+	if mv.limitExpr == nil {
+		return mv.md.Messages()
+	}
+	gen := mv.md.Generation()
+	if mv.limited == nil || gen != mv.limitGen {
+		qm := newQueryMatcher(mv.md, mv.limitExpr)
+		limited := []*Message{}
+		for _, m := range mv.md.Messages() {
+			if qm.Match(m) {
+				limited = append(limited, m)
+			}
+		}
+		mv.limited = limited
+		mv.limitGen = gen
+	}
+	return mv.limited
+}
+
+func (mv *MaildirView) Len() int {
+	if mv.limitExpr == nil {
+		return mv.md.Len()
+	}
+	return len(mv.Messages())
+}
+
+// Returns the idx-th message shown, or nil if idx is out of bounds
+func (mv *MaildirView) Message(idx int) *Message {
+	if mv.limitExpr == nil {
+		return mv.md.Message(idx)
+	}
+	msgs := mv.Messages()
+	if idx < 0 || idx >= len(msgs) {
+		return nil
+	}
+	return msgs[idx]
+}
+
+// Returns the position of m in the messages shown, or -1
+func (mv *MaildirView) Index(m *Message) int {
+	if mv.limitExpr == nil {
+		return mv.md.Index(m)
+	}
+	for i, cur := range mv.Messages() {
+		if cur == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// Only shows the messages matching the query q, or all of them if q is
+// empty. The cursor stays on the current message if it's still shown.
+func (mv *MaildirView) SetLimit(q string) error {
+	var expr query.Expr
+	if q != "" {
+		var err error
+		expr, err = query.Parse(q, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	curMsg := mv.Message(mv.cur)
+	mv.limit = q
+	mv.limitExpr = expr
+	mv.limited = nil
+	if i := mv.Index(curMsg); i != -1 {
+		mv.cur = i
+	} else {
+		mv.cur = 0
+	}
+	return nil
+}
+
+// Sorts the messages according to the view's sort mode, keeping the
+// cursor on the currently selected message
+func (mv *MaildirView) Sort() {
+	curMsg := mv.Message(mv.cur)
+	mv.tree = mv.md.Sort(mv.sortMode)
+	if i := mv.Index(curMsg); i != -1 {
+		mv.cur = i
+	}
 }
 
 func (mv *MaildirView) Draw(v *gocui.View) error {
@@ -124,26 +862,23 @@ func (mv *MaildirView) Draw(v *gocui.View) error {
 		return fmt.Errorf("The screen is too small")
 	}
 
+	msgs := mv.Messages()
+	if mv.cur >= len(msgs) {
+		mv.cur = len(msgs) - 1
+	}
+	if mv.cur < 0 {
+		mv.cur = 0
+	}
+	if mv.cur < mv.curTop || mv.cur >= mv.curTop+h {
+		mv.curTop = mv.cur
+	}
 	xo, _ := v.Origin()
 	v.SetOrigin(xo, mv.curTop)
 	xc, _ := v.Cursor()
 	v.SetCursor(xc, mv.cur-mv.curTop)
-	msgs := mv.md.messages
-	flagsLen := 5
-	indexLen := 6
-	sizeLen := 5
-	remW := w - indexLen - flagsLen - sizeLen + 2 /* two spaces */ + 2 /* two brackets around the size */
-	fromRatio := 25
-	subjRatio := 100 - fromRatio
-	fromLen := (remW - 10) * fromRatio / 100.0
-	subjLen := (remW - 10) * subjRatio / 100.0
-	fmtString := fmt.Sprintf("%%-%dd%%-%ds%%-%ds [%%%ds] %%-%ds\n", indexLen, flagsLen, fromLen, sizeLen, subjLen)
+	now := time.Now()
 	for i, m := range msgs {
-		from := util.TruncateString(m.From, fromLen)
-		subj := util.TruncateString(m.Subject, subjLen)
-		flags := flagsToString(m.Flags)
-		fmt.Fprintf(v, fmtString, i, flags, from, util.SiteToHuman(m.size), subj)
-
+		fmt.Fprintln(v, indexFormat.Format(i, m, mv.tree[m], now))
 	}
 	return nil
 }
@@ -154,8 +889,9 @@ func (mv *MaildirView) scroll(v *gocui.View, incr int) {
 	_, h := v.Size()
 
 	str := fmt.Sprintf("0: %d, ", incr)
-	if mv.cur+incr > len(mv.md.messages)-1 {
-		incr = len(mv.md.messages) - 1 - mv.cur
+	nrMsgs := mv.Len()
+	if mv.cur+incr > nrMsgs-1 {
+		incr = nrMsgs - 1 - mv.cur
 		str += fmt.Sprintf("1: %d, ", incr)
 	}
 	if mv.cur+incr < 0 {
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMaildir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "amuatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"cur", "new", "tmp"} {
+		err := os.Mkdir(filepath.Join(dir, d), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func deliverTestMessage(t testing.TB, mdPath string, sub string, name string, subject string) string {
+	msg := fmt.Sprintf("From: a@example.com\r\nTo: b@example.com\r\nSubject: %s\r\nMessage-ID: <%s@example.com>\r\n\r\nbody\r\n", subject, name)
+	tmp := filepath.Join(mdPath, "tmp", name)
+	err := ioutil.WriteFile(tmp, []byte(msg), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(mdPath, sub, name)
+	err = os.Rename(tmp, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProcessNewAndCur(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "one")
+	deliverTestMessage(t, dir, "new", "2.b", "two")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(md.messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(md.messages))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "2.b:2,")); err != nil {
+		t.Errorf("The new message wasn't moved to cur: %v", err)
+	}
+
+	/* another client flags one message, deletes the other and moves
+	 * a third one to cur */
+	err = os.Rename(filepath.Join(dir, "cur", "1.a:2,S"), filepath.Join(dir, "cur", "1.a:2,FS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "cur", "2.b:2,"))
+	deliverTestMessage(t, dir, "cur", "3.c:2,", "three")
+
+	changed, err := processCur(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("processCur didn't report any change")
+	}
+	if len(md.messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(md.messages))
+	}
+	subjects := map[string]*Message{}
+	for _, m := range md.messages {
+		subjects[m.Subject] = m
+	}
+	one, ok := subjects["one"]
+	if !ok || one.Flags != Flagged|Seen || filepath.Base(one.path) != "1.a:2,FS" {
+		t.Errorf("Unexpected message: %v", one)
+	}
+	if _, ok := subjects["three"]; !ok {
+		t.Error("The message added by another client wasn't picked up")
+	}
+	changed, _ = processCur(md)
+	if changed {
+		t.Error("processCur reported a change on an unchanged maildir")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := &knownMaildir{maildir: md, path: dir, stopMonitor: make(chan bool)}
+	changes := make(chan bool, 100)
+	go km.Start(func(*Maildir) { changes <- true })
+	defer km.Stop()
+	/* give the monitor a chance to set up its watches */
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		deliverTestMessage(t, dir, "new", fmt.Sprintf("%d.burst", i), "burst")
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No change reported after a delivery")
+	}
+}
+
+// Hammers a maildir from both the monitor and the UI side, run with
+// go test -race
+func TestConcurrentAccess(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 20; i++ {
+		deliverTestMessage(t, dir, "cur", fmt.Sprintf("%d.old:2,", i), "old")
+	}
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	km := &knownMaildir{maildir: md, path: dir, stopMonitor: make(chan bool)}
+	/* the UI is notified like gocui's Execute would */
+	changes := make(chan bool, 1000)
+	go km.Start(func(*Maildir) { changes <- true })
+	defer km.Stop()
+
+	const deliveries = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	/* fetchmail */
+	go func() {
+		defer wg.Done()
+		for i := 0; i < deliveries; i++ {
+			deliverTestMessage(t, dir, "new", fmt.Sprintf("%d.new", i), "new")
+			if i%20 == 0 {
+				/* another client flags a message */
+				old := filepath.Join(dir, "cur", fmt.Sprintf("%d.old:2,", i/20))
+				os.Rename(old, old+"F")
+			}
+		}
+	}()
+	/* the UI */
+	go func() {
+		defer wg.Done()
+		mv := &MaildirView{md: md}
+		for i := 0; i < 500; i++ {
+			select {
+			case <-changes:
+			default:
+			}
+			mv.sortMode = SortMode(i % int(MaxSortMode))
+			mv.Sort()
+			for _, m := range md.Messages() {
+				_ = flagsToString(m.Flags) + m.Subject + mv.tree[m]
+			}
+			if m := md.Message(i % md.Len()); m != nil {
+				md.SetFlags(m, Seen, 0)
+			}
+			if i%50 == 0 {
+				if err := md.ApplyChanges(); err != nil {
+					t.Error(err)
+				}
+			}
+			if i%10 == 0 {
+				processNew(md)
+			}
+		}
+	}()
+	wg.Wait()
+
+	/* wait for the monitor to catch up */
+	deadline := time.Now().Add(5 * time.Second)
+	for md.Len() != 20+deliveries && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if md.Len() != 20+deliveries {
+		t.Errorf("Expected %d messages, got %d", 20+deliveries, md.Len())
+	}
+	seen := make(map[string]bool)
+	for _, m := range md.Messages() {
+		key := maildirKey(filepath.Base(m.path))
+		if seen[key] {
+			t.Errorf("Duplicate message %s", key)
+		}
+		seen[key] = true
+	}
+}
+
+func TestMoveAndCopy(t *testing.T) {
+	srcDir := newTestMaildir(t)
+	defer os.RemoveAll(srcDir)
+	dstDir := newTestMaildir(t)
+	defer os.RemoveAll(dstDir)
+	deliverTestMessage(t, srcDir, "cur", "1.a:2,", "one")
+	deliverTestMessage(t, srcDir, "cur", "2.b:2,S", "two")
+	src, err := LoadMaildir(srcDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := LoadMaildir(dstDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	one := src.Message(0)
+	src.SetFlags(one, Flagged|Seen, 0)
+	cp, err := src.CopyTo(one, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(cp.path, ":2,SF") {
+		t.Errorf("The flags weren't kept: %s", cp.path)
+	}
+	if src.Len() != 2 || dst.Len() != 1 {
+		t.Errorf("Unexpected lengths after copy: %d %d", src.Len(), dst.Len())
+	}
+
+	two := src.Message(1)
+	mv, err := src.MoveTo(two, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Len() != 1 || dst.Len() != 2 {
+		t.Errorf("Unexpected lengths after move: %d %d", src.Len(), dst.Len())
+	}
+	if _, err := os.Stat(two.path); !os.IsNotExist(err) {
+		t.Error("The moved message is still in the source maildir")
+	}
+	buf, err := ioutil.ReadFile(mv.path)
+	if err != nil || !strings.Contains(string(buf), "Subject: two") {
+		t.Errorf("Unexpected moved message: %q (%v)", buf, err)
+	}
+	tmps, _ := readDirNames(filepath.Join(dstDir, "tmp"))
+	if len(tmps) != 0 {
+		t.Errorf("Leftovers in tmp/: %v", tmps)
+	}
+	/* the monitor must not add the delivered messages a second time */
+	processCur(dst)
+	if dst.Len() != 2 {
+		t.Errorf("Expected 2 messages, got %d", dst.Len())
+	}
+}
+
+func TestLimit(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "lunch")
+	deliverTestMessage(t, dir, "cur", "2.b:2,", "report")
+	deliverTestMessage(t, dir, "cur", "3.c:2,", "lunch again")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mv := &MaildirView{md: md}
+	mv.Sort()
+	mv.cur = 2
+	if err := mv.SetLimit("subject lunch"); err != nil {
+		t.Fatal(err)
+	}
+	if mv.Len() != 2 || mv.Message(1).Subject != "lunch again" {
+		t.Errorf("Unexpected limited view: %d messages", mv.Len())
+	}
+	if mv.cur != 1 {
+		t.Errorf("The cursor didn't follow the message: %d", mv.cur)
+	}
+	if err := mv.SetLimit("subject ("); err == nil {
+		t.Error("Expected a syntax error")
+	}
+
+	/* the limit is applied to the new messages */
+	deliverTestMessage(t, dir, "new", "4.d", "lunch tomorrow?")
+	processNew(md)
+	if mv.Len() != 3 {
+		t.Errorf("Expected 3 messages, got %d", mv.Len())
+	}
+	/* flagging a message doesn't hide it */
+	if err := mv.SetLimit("flag unread"); err != nil {
+		t.Fatal(err)
+	}
+	n := mv.Len()
+	md.SetFlags(mv.Message(0), Seen, 0)
+	if mv.Len() != n {
+		t.Errorf("Expected %d messages, got %d", n, mv.Len())
+	}
+
+	mv.SetLimit("")
+	if mv.Len() != 4 {
+		t.Errorf("Expected 4 messages, got %d", mv.Len())
+	}
+}
+
+func TestLoadBrokenMessage(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "one")
+	broken := filepath.Join(dir, "cur", "2.b:2,F")
+	err := ioutil.WriteFile(broken, []byte("not a header\r\n\r\nbody\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 2 {
+		t.Fatalf("Expected 2 messages, got %d", md.Len())
+	}
+	m := md.Message(1)
+	if m.path != broken || m.loadErr == nil {
+		t.Fatalf("Expected a placeholder for %s, got %v", broken, m)
+	}
+	if m.Flags != Flagged {
+		t.Errorf("Expected the flags of the file name, got %v", m.Flags)
+	}
+	if md.Message(0).loadErr != nil {
+		t.Errorf("Unexpected error: %s", md.Message(0).loadErr)
+	}
+}
+
+func TestLoadWithProgress(t *testing.T) {
+	defer func(n int) { loadWorkers = n }(loadWorkers)
+	loadWorkers = 3
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	n := 2*loadBatch + 10
+	for i := 0; i < n; i++ {
+		deliverTestMessage(t, dir, "cur", fmt.Sprintf("%05d.a:2,S", i), fmt.Sprintf("message %d", i))
+	}
+	deliverTestMessage(t, dir, "new", "new.b", "new")
+	md := &Maildir{path: dir}
+	calls := []int{}
+	err := md.LoadWithProgress(true, func(loaded int, total int) {
+		if total != n {
+			t.Errorf("Expected %d messages in total, got %d", n, total)
+		}
+		if !md.IsLoading() || md.Len() != loaded {
+			t.Errorf("Expected the %d messages loaded so far, got %d", loaded, md.Len())
+		}
+		calls = append(calls, loaded)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0] != loadBatch || calls[1] != 2*loadBatch {
+		t.Errorf("Unexpected progress: %v", calls)
+	}
+	if md.IsLoading() || md.Len() != n+1 {
+		t.Fatalf("Expected %d messages, got %d", n+1, md.Len())
+	}
+	for i := 0; i < n; i++ {
+		m := md.Message(i)
+		if m.Subject != fmt.Sprintf("message %d", i) {
+			t.Fatalf("Expected the messages sorted by path, got %q at %d", m.Subject, i)
+		}
+	}
+	if m := md.Message(n); m.Subject != "new" {
+		t.Errorf("Expected the new message last, got %q", m.Subject)
+	}
+}
+
+func TestChangesWhileLoading(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	n := loadBatch + 10
+	for i := 0; i < n; i++ {
+		deliverTestMessage(t, dir, "cur", fmt.Sprintf("%05d.a:2,S", i), fmt.Sprintf("message %d", i))
+	}
+	md := &Maildir{path: dir}
+	err := md.LoadWithProgress(true, func(loaded int, total int) {
+		/* another client changes the maildir, and the monitor
+		 * notices while we're loading */
+		os.Remove(filepath.Join(dir, "cur", "00000.a:2,S"))
+		os.Rename(filepath.Join(dir, "cur", "00001.a:2,S"), filepath.Join(dir, "cur", "00001.a:2,FS"))
+		deliverTestMessage(t, dir, "cur", "late.b:2,", "late")
+		if changed, _ := processCur(md); changed {
+			t.Error("The changes were picked up before the load was done")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != n {
+		t.Fatalf("Expected %d messages, got %d", n, md.Len())
+	}
+	if m := md.messageByKey("00000.a"); m != nil {
+		t.Error("The removed message is still there")
+	}
+	if m := md.messageByKey("00001.a"); m == nil || (m.Flags&Flagged) == 0 {
+		t.Error("The renamed message wasn't picked up")
+	}
+	if m := md.messageByKey("late.b"); m == nil || m.Subject != "late" {
+		t.Error("The message delivered while loading wasn't picked up")
+	}
+}
+
+func TestCounts(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "read")
+	deliverTestMessage(t, dir, "cur", "2.b:2,", "unread")
+	deliverTestMessage(t, dir, "cur", "3.c:2,FS", "flagged")
+	deliverTestMessage(t, dir, "new", "4.d", "delivered")
+	/* the flags are known without loading the messages */
+	md, err := LoadMaildir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := maildirCounts{total: 4, unread: 2, fresh: 1, flagged: 1}
+	if c := md.Counts(); c != expected {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+	if s := countsString(expected); s != "(+1 2/4 !1)" {
+		t.Errorf("Unexpected counts %q", s)
+	}
+
+	/* the monitor keeps them up to date */
+	deliverTestMessage(t, dir, "new", "5.e", "delivered later")
+	os.Rename(filepath.Join(dir, "cur", "2.b:2,"), filepath.Join(dir, "cur", "2.b:2,S"))
+	processNew(md)
+	processCur(md)
+	expected = maildirCounts{total: 5, unread: 2, fresh: 2, flagged: 1}
+	if c := md.Counts(); c != expected {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+
+	/* leaving the maildir */
+	md.SetActive(false)
+	expected.fresh = 0
+	if c := md.Counts(); c != expected {
+		t.Errorf("Expected %+v, got %+v", expected, c)
+	}
+	if s := countsString(maildirCounts{total: 3}); s != "(3)" {
+		t.Errorf("Unexpected counts %q", s)
+	}
+}
+
+func TestTagging(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "lunch")
+	deliverTestMessage(t, dir, "cur", "2.b:2,", "report")
+	deliverTestMessage(t, dir, "cur", "3.c:2,", "lunch again")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := setStatus
+	setStatus = func(string) {}
+	defer func() { setStatus = saved }()
+	mv := &MaildirView{md: md}
+	mv.Sort()
+	amua := &Amua{curMaildirView: mv}
+
+	n, err := amua.tagPattern("subject lunch", true)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 tagged messages, got %d, %v", n, err)
+	}
+	tagged := amua.taggedMessages()
+	if len(tagged) != 2 || tagged[0].Subject != "lunch" || tagged[1].Subject != "lunch again" {
+		t.Fatalf("Unexpected tagged messages: %v", tagged)
+	}
+	if _, err := amua.tagPattern("subject (", true); err == nil {
+		t.Error("Expected a syntax error")
+	}
+
+	/* without the prefix, the action applies to the current message */
+	mv.cur = 1
+	msgs := amua.targetMessages()
+	if len(msgs) != 1 || msgs[0].Subject != "report" {
+		t.Errorf("Expected the current message, got %v", msgs)
+	}
+	/* with it, to the tagged ones, and only for the next action */
+	amua.tagPrefix = true
+	msgs = amua.targetMessages()
+	if len(msgs) != 2 || msgs[0].Subject != "lunch" {
+		t.Errorf("Expected the tagged messages, got %v", msgs)
+	}
+	if amua.tagPrefix {
+		t.Error("The tag prefix wasn't reset")
+	}
+	if msgs = amua.targetMessages(); len(msgs) != 1 || msgs[0].Subject != "report" {
+		t.Errorf("Expected the current message again, got %v", msgs)
+	}
+
+	n, err = amua.tagPattern("subject again", false)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 untagged message, got %d, %v", n, err)
+	}
+	if tagged = amua.taggedMessages(); len(tagged) != 1 || tagged[0].Subject != "lunch" {
+		t.Errorf("Unexpected tagged messages after untagging: %v", tagged)
+	}
+	/* tagging is undone like any other action */
+	if _, err := amua.undo.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if len(amua.taggedMessages()) != 2 {
+		t.Error("Untagging wasn't undone")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"regexp"
 	"strings"
 	"bytes"
 	"net/mail"
@@ -15,7 +16,6 @@ import (
 
 	"github.com/deweerdt/gocui"
 	"github.com/jaytaylor/html2text"
-	"github.com/mitchellh/colorstring"
 )
 
 type ByDate []*Message
@@ -24,17 +24,29 @@ func (a ByDate) Len() int           { return len(a) }
 func (a ByDate) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByDate) Less(i, j int) bool { return a[i].Date.After(a[j].Date) }
 
+// What LoadMessage parses out of the headers of a message. It only
+// changes with the file, and is cached as a whole, see headercache.go.
+type Headers struct {
+	From       string
+	To         string
+	Subject    string
+	CCs        string
+	ReplyTo    string
+	Date       time.Time
+	MessageId  string
+	InReplyTo  string
+	References []string
+	ListName   string // the short name of the mailing list it was sent to, if any
+	MediaType  string // the type of the body, "multipart/mixed" if it has attachments
+}
+
 type Message struct {
-	From    string
-	To      string
-	Subject string
-	CCs     string
-	ReplyTo string
-	Date    time.Time
+	Headers
 	path    string
 	rs      *readState
 	size    int64
 	Flags   MessageFlags
+	loadErr error // set if the message couldn't be parsed, see brokenMessage
 }
 
 
@@ -53,7 +65,7 @@ const (
 )
 
 func flagsToString(f MessageFlags) string {
-	ret := make([]byte, 4)
+	ret := []byte("     ")
 	if (f & Seen) == 0 {
 		ret[0] = 'N'
 	} else if (f & Replied) != 0 {
@@ -70,6 +82,9 @@ func flagsToString(f MessageFlags) string {
 	if (f & Flagged) != 0 {
 		ret[3] = '!'
 	}
+	if (f & Tagged) != 0 {
+		ret[4] = '*'
+	}
 	return string(ret)
 }
 func parseFlags(s string) MessageFlags {
@@ -152,6 +167,39 @@ func buildTo(m *Message) []*mail.Address {
 
 	return []*mail.Address{}
 }
+// Builds the References header of a reply to m: the parent's references,
+// followed by the parent's own id (RFC 5322, section 3.6.4)
+func buildReferences(m *Message) []string {
+	ret := make([]string, 0, len(m.References)+1)
+	if len(m.References) > 0 {
+		ret = append(ret, m.References...)
+	} else if m.InReplyTo != "" {
+		ret = append(ret, m.InReplyTo)
+	}
+	if m.MessageId != "" {
+		ret = append(ret, m.MessageId)
+	}
+	return ret
+}
+// Returns the body of a message forwarding m, whose text is text: its
+// main headers, then the text, as mutt does
+func forwardBody(m *Message, text []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "\n----- Forwarded message from %s -----\n\n", m.From)
+	fmt.Fprintf(&buf, "Date: %s\n", m.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "From: %s\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\n", m.To)
+	if m.CCs != "" {
+		fmt.Fprintf(&buf, "Cc: %s\n", m.CCs)
+	}
+	fmt.Fprintf(&buf, "Subject: %s\n\n", m.Subject)
+	buf.Write(text)
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("\n----- End forwarded message -----\n")
+	return buf.Bytes()
+}
 func dehtmlize(in *bytes.Buffer) *bytes.Buffer {
 	out, err := html2text.FromReader(in)
 	if err != nil {
@@ -245,67 +293,8 @@ func traverse(m *mime.MimePart, showParts bool) []*bytes.Buffer {
 	return ret
 }
 
-type MessageAsMimeTree Message
 type MessageAsText Message
 
-func (m *MessageAsMimeTree) Draw(amua *Amua, g *gocui.Gui) error {
-	v, err := g.View(MESSAGE_VIEW)
-	if err != nil {
-		return err
-	}
-	v.Clear()
-	v.Wrap = true
-	v.SetOrigin(0, 0)
-
-	colorstring.Fprintf(v, "[green]Subject: %s\n", m.Subject)
-	colorstring.Fprintf(v, "[red]From: %s\n", m.From)
-	colorstring.Fprintf(v, "[red]To: %s\n", m.To)
-	colorstring.Fprintf(v, "[green]Date: %s\n", m.Date.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
-	fmt.Fprintf(v, "\n")
-	_, err = io.Copy(v, m)
-	if err != nil {
-		return err
-	}
-	return nil
-
-}
-
-func (m *MessageAsMimeTree) Read(p []byte) (int, error) {
-	if m.rs == nil {
-		m.rs = &readState{}
-		var printM func(w io.Writer, depth int, m *mime.MimePart)
-		printM = func(w io.Writer, depth int, m *mime.MimePart) {
-			fmt.Fprintf(w, "%s%s\n", strings.Repeat("-", depth), mime.MimeTypeTxt(m.MimeType))
-			if m.Child != nil {
-				printM(w, depth+1, m.Child)
-			}
-			for cur := m.Next; cur != nil; cur = cur.Next {
-				printM(w, depth, cur)
-			}
-		}
-		f, err := os.Open(m.path)
-		if err != nil {
-			m.rs = nil
-			return 0, err
-		}
-		defer f.Close()
-		mtree, err := mime.GetMimeTree(f, 10)
-		if err != nil {
-			m.rs = nil
-			return 0, err
-		}
-		buf := &bytes.Buffer{}
-		printM(buf, 0, mtree)
-		m.rs.r = buf
-
-	}
-	ret, err := m.rs.r.Read(p)
-	if err != nil {
-		m.rs = nil
-	}
-	return ret, err
-}
-
 func (m *Message) Read(p []byte) (int, error) {
 	var err error
 	if m.rs == nil {
@@ -387,14 +376,23 @@ func (m *MessageAsText) Read(p []byte) (int, error) {
 	return ret, err
 }
 
-var dec = new(gomime.WordDecoder)
+var dec = &gomime.WordDecoder{CharsetReader: mime.CharsetReader}
 
 func mimedec(hdr string) string {
 	dhdr, err := dec.DecodeHeader(hdr)
 	if err != nil {
 		dhdr = hdr
 	}
-	return dhdr
+	/* some mailers send raw 8bit headers */
+	return string(mime.ToUTF8("", []byte(dhdr)))
+}
+
+var msgIdRe = regexp.MustCompile(`<[^<>]+>`)
+
+// Returns the list of message ids found in a References or In-Reply-To
+// header
+func parseMessageIds(hdr string) []string {
+	return msgIdRe.FindAllString(hdr, -1)
 }
 
 func LoadMessage(path string) (*Message, error) {
@@ -419,12 +417,59 @@ func LoadMessage(path string) (*Message, error) {
 
 	m.Subject = mimedec(msg.Header.Get("Subject"))
 	m.Date, _ = msg.Header.Date()
+	if ids := parseMessageIds(msg.Header.Get("Message-Id")); len(ids) > 0 {
+		m.MessageId = ids[0]
+	}
+	if ids := parseMessageIds(msg.Header.Get("In-Reply-To")); len(ids) > 0 {
+		m.InReplyTo = ids[0]
+	}
+	m.References = parseMessageIds(msg.Header.Get("References"))
+	m.ListName = listName(msg.Header)
+	if mt, _, err := gomime.ParseMediaType(msg.Header.Get("Content-Type")); err == nil {
+		m.MediaType = mt
+	}
 	m.size = fi.Size()
+	m.Flags = pathFlags(path)
+	return m, nil
+}
+
+// Returns the short name of the mailing list, taken from List-Id, or from
+// List-Post if there's none: "golang-nuts" for
+// "List-Id: <golang-nuts.googlegroups.com>"
+func listName(h mail.Header) string {
+	id := h.Get("List-Id")
+	if start := strings.LastIndex(id, "<"); start != -1 {
+		id = id[start+1:]
+		if end := strings.Index(id, ">"); end != -1 {
+			id = id[:end]
+		}
+		if dot := strings.Index(id, "."); dot != -1 {
+			return id[:dot]
+		}
+		return id
+	}
+	post := h.Get("List-Post")
+	if start := strings.Index(post, "<mailto:"); start != -1 {
+		post = post[start+len("<mailto:"):]
+		if at := strings.IndexAny(post, "@>"); at != -1 {
+			return post[:at]
+		}
+	}
+	return ""
+}
 
-	i := strings.LastIndex(path, ":2,")
-	if i != -1 {
-		m.Flags = parseFlags(path[i+3:])
+// Returns the flags found in the name of a message's file
+func pathFlags(path string) MessageFlags {
+	if i := strings.LastIndex(path, ":2,"); i != -1 {
+		return parseFlags(path[i+3:])
 	}
-	return m, nil
+	return 0
+}
+
+// Returns a placeholder for the message at path, which couldn't be
+// parsed. It's shown with the error, instead of making the whole maildir
+// fail to load.
+func brokenMessage(path string, size int64, err error) *Message {
+	return &Message{path: path, size: size, Flags: pathFlags(path), loadErr: err}
 }
 
@@ -0,0 +1,85 @@
+package mime
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// Charset names seen in the wild that the WHATWG index doesn't know
+var charsetAliases = map[string]string{
+	"ascii":         "us-ascii",
+	"latin1":        "iso-8859-1",
+	"latin-1":       "iso-8859-1",
+	"cp1252":        "windows-1252",
+	"cp-1252":       "windows-1252",
+	"cp1251":        "windows-1251",
+	"cp1250":        "windows-1250",
+	"gb2312-80":     "gb2312",
+	"ks_c_5601":     "ks_c_5601-1987",
+	"x-sjis":        "shift_jis",
+	"iso-2022-jp-2": "iso-2022-jp",
+}
+
+// Returns the encoding for a charset name, nil for UTF-8 and ASCII. ok is
+// false if the charset isn't known.
+func lookupCharset(charset string) (e encoding.Encoding, ok bool) {
+	name := strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"'`))
+	if alias, ok := charsetAliases[name]; ok {
+		name = alias
+	}
+	switch name {
+	case "utf-8", "utf8", "us-ascii":
+		return nil, true
+	case "iso-8859-1":
+		/* the WHATWG index maps latin1 to windows-1252, which is
+		 * a superset of it for the printable characters, but we
+		 * want the C1 controls to stay controls */
+		return charmap.ISO8859_1, true
+	}
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, false
+	}
+	return e, true
+}
+
+// Converts buf from charset to UTF-8. If the charset is missing or
+// unknown, or if buf doesn't decode cleanly, buf is assumed to be UTF-8
+// if it's valid, and windows-1252 otherwise.
+func ToUTF8(charset string, buf []byte) []byte {
+	if e, _ := lookupCharset(charset); e != nil {
+		ret, err := e.NewDecoder().Bytes(buf)
+		if err == nil && !bytes.ContainsRune(ret, utf8.RuneError) {
+			return ret
+		}
+	}
+	if utf8.Valid(buf) {
+		return buf
+	}
+	ret, err := charmap.Windows1252.NewDecoder().Bytes(buf)
+	if err != nil {
+		return buf
+	}
+	return ret
+}
+
+// A CharsetReader for mime.WordDecoder, so that encoded words in any of
+// the charsets we know get decoded
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	e, ok := lookupCharset(charset)
+	if !ok {
+		return nil, fmt.Errorf("unhandled charset %q", charset)
+	}
+	if e == nil {
+		return input, nil
+	}
+	return transform.NewReader(input, e.NewDecoder()), nil
+}
@@ -0,0 +1,106 @@
+package mime
+
+import (
+	"io/ioutil"
+	gomime "mime"
+	"strings"
+	"testing"
+)
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		charset  string
+		in       string
+		expected string
+	}{
+		{"iso-8859-1", "caf\xe9", "café"},
+		{"ISO-8859-15", "\xa4uro", "€uro"},
+		{"windows-1252", "\x93quoted\x94", "“quoted”"},
+		{"cp1252", "\x80", "€"},
+		{"koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"shift_jis", "\x93\xfa\x96\x7b", "日本"},
+		{"euc-jp", "\xc6\xfc\xcb\xdc", "日本"},
+		{"iso-2022-jp", "\x1b$BF|K\\\x1b(B", "日本"},
+		{"gb2312", "\xd6\xd0\xce\xc4", "中文"},
+		{"big5", "\xa4\xa4\xa4\xe5", "中文"},
+		{"euc-kr", "\xc7\xd1\xb1\xb9", "한국"},
+		{"utf-8", "café", "café"},
+		/* missing or bogus charsets */
+		{"", "café", "café"},
+		{"", "caf\xe9", "café"},
+		{"us-ascii", "caf\xe9", "café"},
+		{"x-unknown", "caf\xe9", "café"},
+		{"utf-8", "\x93quoted\x94", "“quoted”"},
+	}
+	for _, tt := range tests {
+		got := string(ToUTF8(tt.charset, []byte(tt.in)))
+		if got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.charset, tt.expected, got)
+		}
+	}
+}
+
+func TestCharsetReader(t *testing.T) {
+	dec := &gomime.WordDecoder{CharsetReader: CharsetReader}
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"=?windows-1252?Q?=93hi=94?=", "“hi”"},
+		{"=?KOI8-R?B?8NLJ18XU?=", "Привет"},
+		{"=?ISO-2022-JP?B?GyRCRnxLXBsoQg==?=", "日本"},
+		{"=?iso-8859-2?Q?=B3=F3d=BC?=", "łódź"},
+	}
+	for _, tt := range tests {
+		got, err := dec.DecodeHeader(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.in, tt.expected, got)
+		}
+	}
+	if _, err := dec.DecodeHeader("=?x-unknown?Q?abc?="); err == nil {
+		t.Error("Expected an error for an unknown charset")
+	}
+}
+
+const latin1Msg = "MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=frontier\r\n" +
+	"\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9\r\n" +
+	"--frontier\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Disposition: attachment; filename=raw.txt\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9\r\n" +
+	"--frontier--\r\n"
+
+func TestTextPartsAreUTF8(t *testing.T) {
+	tree, err := GetMimeTree(strings.NewReader(latin1Msg), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inline := tree.Child
+	if inline == nil || inline.Next == nil {
+		t.Fatal("Unexpected tree")
+	}
+	if got := inline.Buf.String(); got != "café" {
+		t.Errorf("Expected the inline part to be converted, got %q", got)
+	}
+	if inline.Params["charset"] != "utf-8" {
+		t.Errorf("Unexpected charset: %q", inline.Params["charset"])
+	}
+	/* attachments are saved as sent */
+	raw, _ := ioutil.ReadAll(inline.Next.Buf)
+	if string(raw) != "caf\xe9" {
+		t.Errorf("Expected the attachment to be left alone, got %q", raw)
+	}
+}
@@ -17,6 +17,7 @@ type MimePart struct {
 	MimeType           MimeType
 	ContentDisposition ContentDisposition
 	Name               string
+	Params             map[string]string // the Content-Type parameters
 	Next, Prev         *MimePart
 	Child, Parent      *MimePart
 	Buf                *bytes.Buffer
@@ -45,9 +46,13 @@ func buildMimeTree(pc *ParserContext, path []int, r io.Reader, pd PartDescr) err
 	mtb = pc.Ctx.(*MimeTreeBuilder)
 	mp := MimePart{}
 	name, ok := pd.CDParams["filename"]
+	if !ok {
+		name, ok = pd.Params["name"]
+	}
 	if ok {
 		mp.Name = name
 	}
+	mp.Params = pd.Params
 	mp.ContentDisposition = pd.ContentDisposition
 	if mtb.root == nil {
 		mtb.root = &mp
@@ -306,5 +311,12 @@ retry:
 		}
 		return err
 	}
+	if strings.HasPrefix(mediaType, "text/") && contentDisposition != CDAttachment {
+		decodedBuf = ToUTF8(params["charset"], decodedBuf)
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params["charset"] = "utf-8"
+	}
 	return parse(pc, path, bytes.NewBuffer(decodedBuf), PartDescr{mediaType, params, contentDisposition, cdParams})
 }
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	gomime "mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The envelope of a queued message, kept in its headers as the Bcc
+// recipients aren't in the other ones. It's removed before sending.
+type envelope struct {
+	from       string
+	to         []string
+	fcc        string       // the maildir the message is saved to once sent, if any
+	parent     string       // the path of the message it replies to or forwards, if any
+	parentFlag MessageFlags // Replied or Passed, set on parent once sent
+}
+
+const (
+	envelopeFromHeader   = "X-Amua-Envelope-From"
+	envelopeToHeader     = "X-Amua-Envelope-To"
+	envelopeFccHeader    = "X-Amua-Fcc"
+	envelopeParentHeader = "X-Amua-Parent"
+)
+
+// How long to wait before trying to send a message again, after the
+// first failure. The delay doubles with each failure, up to outboxMaxRetry.
+const (
+	outboxRetry    = time.Minute
+	outboxMaxRetry = time.Hour
+)
+
+// The messages waiting to be sent. They're delivered to the outbox
+// maildir first, so that they survive a crash, then sent in the
+// background by run. The ones that can't be sent are tried again later.
+type outbox struct {
+	path   string
+	t      transport
+	notify func(sent int, err error) // called by run after sending, if set
+
+	lock  sync.Mutex
+	state map[string]*queued // by maildir key, for the messages that were tried or are held
+	wake  chan bool
+}
+
+// What's known of a queued message
+type queued struct {
+	attempts int
+	next     time.Time // when it's tried again
+	err      error     // why the last attempt failed
+	held     bool      // not sent while it's edited
+	sending  bool
+}
+
+// A summary of the outbox, shown in the sidebar
+type outboxStatus struct {
+	queued  int
+	sending bool
+	failing int       // the messages whose last attempt failed
+	next    time.Time // the next retry, if some are failing
+	err     error     // the last error
+}
+
+func newOutbox(path string, t transport) (*outbox, error) {
+	err := makeMaildir(path)
+	if err != nil {
+		return nil, err
+	}
+	return &outbox{
+		path:  path,
+		t:     t,
+		state: make(map[string]*queued),
+		wake:  make(chan bool, 1),
+	}, nil
+}
+
+// Returns the headers of the envelope, the recipients being folded one
+// per line
+func (e *envelope) headers() []byte {
+	var buf bytes.Buffer
+	writeHeader(&buf, envelopeFromHeader, e.from)
+	writeHeader(&buf, envelopeToHeader, strings.Join(e.to, ",\r\n "))
+	if e.fcc != "" {
+		writeHeader(&buf, envelopeFccHeader, e.fcc)
+	}
+	if e.parent != "" {
+		writeHeader(&buf, envelopeParentHeader, flagsToFile(e.parentFlag)+" "+e.parent)
+	}
+	return buf.Bytes()
+}
+
+func (e *envelope) set(name string, value string) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(name, envelopeFromHeader):
+		e.from = value
+	case strings.EqualFold(name, envelopeToHeader):
+		for _, a := range strings.Split(value, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				e.to = append(e.to, a)
+			}
+		}
+	case strings.EqualFold(name, envelopeFccHeader):
+		e.fcc = value
+	case strings.EqualFold(name, envelopeParentHeader):
+		if i := strings.Index(value, " "); i != -1 {
+			e.parentFlag = parseFlags(value[:i])
+			e.parent = value[i+1:]
+		}
+	}
+}
+
+func isEnvelopeHeader(name string) bool {
+	for _, h := range []string{envelopeFromHeader, envelopeToHeader, envelopeFccHeader, envelopeParentHeader} {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a queued message into its envelope and the message to send
+func splitEnvelope(buf []byte) (*envelope, []byte, error) {
+	e := &envelope{}
+	var out bytes.Buffer
+	r := bufio.NewReader(bytes.NewReader(buf))
+	var name, value string
+	flush := func() {
+		if name != "" {
+			e.set(name, value)
+		}
+		name, value = "", ""
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			/* the end of the headers */
+			flush()
+			out.WriteString(line)
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if name != "" {
+				value += line
+				continue
+			}
+		} else {
+			flush()
+			if i := strings.Index(line, ":"); i != -1 && isEnvelopeHeader(line[:i]) {
+				name, value = line[:i], line[i+1:]
+				continue
+			}
+		}
+		out.WriteString(line)
+		if err == io.EOF {
+			break
+		}
+	}
+	io.Copy(&out, r)
+	if e.from == "" || len(e.to) == 0 {
+		return nil, nil, fmt.Errorf("The queued message has no envelope")
+	}
+	return e, out.Bytes(), nil
+}
+
+// Delivers msg to the outbox, to be sent with the envelope e. Returns the
+// maildir key of the queued message.
+func (ob *outbox) Queue(e *envelope, msg []byte) (string, error) {
+	r := io.MultiReader(bytes.NewReader(e.headers()), bytes.NewReader(msg))
+	path, err := deliver(ob.path, r, Seen)
+	if err != nil {
+		return "", err
+	}
+	ob.kick()
+	return maildirKey(filepath.Base(path)), nil
+}
+
+func (ob *outbox) kick() {
+	select {
+	case ob.wake <- true:
+	default:
+	}
+}
+
+// Returns the paths of the queued messages, by maildir key
+func (ob *outbox) pending() (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, d := range []string{"new", "cur"} {
+		names, err := readDirNames(filepath.Join(ob.path, d))
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			ret[maildirKey(n)] = filepath.Join(ob.path, d, n)
+		}
+	}
+	return ret, nil
+}
+
+func retryDelay(attempts int) time.Duration {
+	d := outboxRetry
+	for i := 1; i < attempts && d < outboxMaxRetry; i++ {
+		d *= 2
+	}
+	if d > outboxMaxRetry {
+		d = outboxMaxRetry
+	}
+	return d
+}
+
+// Creates the maildir at path if it doesn't exist
+func makeMaildir(path string) error {
+	for _, d := range []string{"cur", "new", "tmp"} {
+		err := os.MkdirAll(filepath.Join(path, d), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds flag to the message file at path, found by its maildir key if it
+// was renamed or moved to cur/ since
+func addFileFlag(path string, flag MessageFlags) error {
+	mdPath := filepath.Dir(filepath.Dir(path))
+	key := maildirKey(filepath.Base(path))
+	for _, d := range []string{"cur", "new"} {
+		names, err := readDirNames(filepath.Join(mdPath, d))
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			if maildirKey(n) != key {
+				continue
+			}
+			flags := parseFlags(n[len(key):])
+			if d == "cur" && (flags&flag) != 0 {
+				return nil
+			}
+			dst := filepath.Join(mdPath, "cur", fmt.Sprintf("%s:2,%s", key, flagsToFile(flags|flag)))
+			return os.Rename(filepath.Join(mdPath, d, n), dst)
+		}
+	}
+	return fmt.Errorf("%s is gone", path)
+}
+
+// Saves the sent message to the maildir of its Fcc, marked as seen, and
+// flags the message it replied to or forwarded
+func (e *envelope) sent(msg []byte) error {
+	var ret error
+	if e.fcc != "" {
+		/* the saved copy has the local line endings */
+		msg = bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+		err := makeMaildir(e.fcc)
+		if err == nil {
+			_, err = deliver(e.fcc, bytes.NewReader(msg), Seen)
+		}
+		if err != nil {
+			ret = fmt.Errorf("Sent, but can't save it to %s: %s", e.fcc, err)
+		}
+	}
+	if e.parent != "" {
+		err := addFileFlag(e.parent, e.parentFlag)
+		if err != nil && ret == nil {
+			ret = fmt.Errorf("Sent, but can't flag the original message: %s", err)
+		}
+	}
+	return ret
+}
+
+// Sends the message at path, and removes it once it's sent. Returns
+// whether it was sent, as what follows might fail too.
+func (ob *outbox) sendQueued(path string) (bool, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	e, msg, err := splitEnvelope(buf)
+	if err != nil {
+		return false, err
+	}
+	err = ob.t.Send(e.from, e.to, msg)
+	if err != nil {
+		return false, err
+	}
+	/* it's never sent twice, even if it can't be saved */
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		/* its flags changed in the meantime */
+		paths, perr := ob.pending()
+		if perr != nil {
+			return true, perr
+		}
+		if p, ok := paths[maildirKey(filepath.Base(path))]; ok {
+			err = os.Remove(p)
+		}
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, e.sent(msg)
+}
+
+// Sends the queued messages that are due at now. Returns how many were
+// sent, when to try again, or the zero time if nothing is left to try,
+// and the last error.
+func (ob *outbox) process(now time.Time) (int, time.Time, error) {
+	paths, err := ob.pending()
+	if err != nil {
+		return 0, now.Add(outboxRetry), err
+	}
+	sent := 0
+	var last error
+	for key, path := range paths {
+		ob.lock.Lock()
+		q := ob.state[key]
+		if q == nil {
+			q = &queued{}
+			ob.state[key] = q
+		}
+		if q.held || q.next.After(now) {
+			ob.lock.Unlock()
+			continue
+		}
+		q.sending = true
+		ob.lock.Unlock()
+
+		ok, err := ob.sendQueued(path)
+
+		ob.lock.Lock()
+		q.sending = false
+		if ok {
+			delete(ob.state, key)
+			sent++
+			if err != nil {
+				last = err
+			}
+		} else {
+			q.attempts++
+			q.err = err
+			q.next = now.Add(retryDelay(q.attempts))
+			last = fmt.Errorf("Sending failed, will retry: %s", err)
+		}
+		ob.lock.Unlock()
+	}
+	/* the messages queued in the meantime might be held already */
+	if cur, err := ob.pending(); err == nil {
+		paths = cur
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	var next time.Time
+	for key, q := range ob.state {
+		if _, ok := paths[key]; !ok {
+			/* cancelled, or removed by hand */
+			delete(ob.state, key)
+			continue
+		}
+		if !q.held && (next.IsZero() || q.next.Before(next)) {
+			next = q.next
+		}
+	}
+	return sent, next, last
+}
+
+// Sends the queued messages, and the ones queued later on, forever
+func (ob *outbox) run() {
+	for {
+		sent, next, err := ob.process(time.Now())
+		if ob.notify != nil && (sent > 0 || err != nil) {
+			ob.notify(sent, err)
+		}
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(next.Sub(time.Now()))
+		}
+		select {
+		case <-ob.wake:
+		case <-timer:
+		}
+	}
+}
+
+// Tries to send all the queued messages now
+func (ob *outbox) Flush() {
+	ob.lock.Lock()
+	for _, q := range ob.state {
+		q.next = time.Time{}
+	}
+	ob.lock.Unlock()
+	ob.kick()
+}
+
+// Keeps the queued message key from being sent, so that it can be
+// edited. Returns its path.
+func (ob *outbox) Hold(key string) (string, error) {
+	paths, err := ob.pending()
+	if err != nil {
+		return "", err
+	}
+	path, ok := paths[key]
+	if !ok {
+		return "", fmt.Errorf("The message isn't queued anymore")
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	q := ob.state[key]
+	if q == nil {
+		q = &queued{}
+		ob.state[key] = q
+	}
+	if q.sending {
+		return "", fmt.Errorf("The message is being sent")
+	}
+	q.held = true
+	return path, nil
+}
+
+// Lets the held message key be sent again
+func (ob *outbox) Release(key string) {
+	ob.lock.Lock()
+	if q := ob.state[key]; q != nil {
+		q.held = false
+	}
+	ob.lock.Unlock()
+	ob.kick()
+}
+
+// Removes the queued message key, by moving it to the trash
+func (ob *outbox) Cancel(key string) error {
+	path, err := ob.Hold(key)
+	if err != nil {
+		return err
+	}
+	err = trashFile(ob.path, path)
+	if err != nil {
+		ob.Release(key)
+		return err
+	}
+	ob.lock.Lock()
+	delete(ob.state, key)
+	ob.lock.Unlock()
+	return nil
+}
+
+func (ob *outbox) Status() outboxStatus {
+	s := outboxStatus{}
+	paths, err := ob.pending()
+	if err != nil {
+		s.err = err
+		return s
+	}
+	s.queued = len(paths)
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	for key, q := range ob.state {
+		if _, ok := paths[key]; !ok {
+			continue
+		}
+		if q.sending {
+			s.sending = true
+		}
+		if q.err != nil && !q.held {
+			s.failing++
+			s.err = q.err
+			if s.next.IsZero() || q.next.Before(s.next) {
+				s.next = q.next
+			}
+		}
+	}
+	return s
+}
+
+// Returns the state shown in the sidebar: the number of queued messages,
+// then whether they're being sent or when they're tried again
+func (s outboxStatus) String(now time.Time) string {
+	switch {
+	case s.queued == 0:
+		return "(0)"
+	case s.sending:
+		return fmt.Sprintf("(%d, sending)", s.queued)
+	case s.failing > 0:
+		d := s.next.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return fmt.Sprintf("(%d, retry %s)", s.queued, relativeDate(now.Add(-d), now))
+	}
+	return fmt.Sprintf("(%d)", s.queued)
+}
+
+// Returns the message to edit out of a queued one
+func newMailFromQueued(buf []byte) (*NewMail, error) {
+	e, msg, err := splitEnvelope(buf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	nm := &NewMail{parent: e.parent, parentFlag: e.parentFlag}
+	shown := make(map[string]bool)
+	for _, h := range []struct {
+		name string
+		ads  *[]*mail.Address
+	}{{"To", &nm.to}, {"Cc", &nm.cc}} {
+		if m.Header.Get(h.name) == "" {
+			continue
+		}
+		*h.ads, err = m.Header.AddressList(h.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range *h.ads {
+			shown[a.Address] = true
+		}
+	}
+	for _, r := range e.to {
+		if !shown[r] {
+			nm.bcc = append(nm.bcc, &mail.Address{Address: r})
+		}
+	}
+	dec := new(gomime.WordDecoder)
+	nm.subject, err = dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		nm.subject = m.Header.Get("Subject")
+	}
+	nm.inReplyTo = m.Header.Get("In-Reply-To")
+	nm.references = strings.Fields(m.Header.Get("References"))
+	var body io.Reader = m.Body
+	if strings.EqualFold(m.Header.Get("Content-Transfer-Encoding"), "quoted-printable") {
+		body = quotedprintable.NewReader(body)
+	}
+	nm.body, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	nm.body = bytes.Replace(nm.body, []byte("\r\n"), []byte("\n"), -1)
+	return nm, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"amua/config"
+)
+
+// A transport that records what it sends, or fails with err
+type fakeTransport struct {
+	lock sync.Mutex
+	err  error
+	from []string
+	to   [][]string
+	msgs [][]byte
+}
+
+func (t *fakeTransport) Send(from string, to []string, msg []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.from = append(t.from, from)
+	t.to = append(t.to, to)
+	t.msgs = append(t.msgs, msg)
+	return nil
+}
+
+func (t *fakeTransport) String() string {
+	return "fake"
+}
+
+func newTestOutbox(t *testing.T) (*outbox, *fakeTransport) {
+	ft := &fakeTransport{}
+	ob, err := newOutbox(newTestMaildir(t), ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ob, ft
+}
+
+func TestOutbox(t *testing.T) {
+	defer withTrash(t)()
+	ob, ft := newTestOutbox(t)
+	defer os.RemoveAll(ob.path)
+	msg := []byte("Subject: one\r\n\r\nbody\r\n")
+	_, err := ob.Queue(&envelope{from: "me@example.com", to: []string{"a@example.com", "secret@example.com"}}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	sent, next, err := ob.process(now)
+	if err != nil || sent != 1 || !next.IsZero() {
+		t.Fatalf("Unexpected process: %d, %v, %v", sent, next, err)
+	}
+	if !bytes.Equal(ft.msgs[0], msg) || ft.from[0] != "me@example.com" || len(ft.to[0]) != 2 {
+		t.Errorf("Unexpected message %q from %s to %v", ft.msgs[0], ft.from[0], ft.to[0])
+	}
+	if s := ob.Status(); s.queued != 0 {
+		t.Errorf("Expected the outbox to be empty, got %d", s.queued)
+	}
+
+	/* a failure is retried later, waiting longer each time */
+	ft.err = errors.New("connection refused")
+	_, err = ob.Queue(&envelope{from: "me@example.com", to: []string{"a@example.com"}}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, next, err = ob.process(now)
+	if err == nil || sent != 0 || !next.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Unexpected process: %d, %v, %v", sent, next, err)
+	}
+	if s := ob.Status().String(now); s != "(1, retry 1m)" {
+		t.Errorf("Unexpected status %q", s)
+	}
+	sent, next, err = ob.process(now.Add(30 * time.Second))
+	if err != nil || sent != 0 || !next.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Unexpected process: %d, %v, %v", sent, next, err)
+	}
+	now = now.Add(time.Minute)
+	_, next, _ = ob.process(now)
+	if !next.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("Expected to wait twice as long, got %v", next.Sub(now))
+	}
+	ft.err = nil
+	ob.Flush()
+	sent, _, err = ob.process(now)
+	if err != nil || sent != 1 || len(ft.msgs) != 2 {
+		t.Fatalf("Unexpected process after the flush: %d, %v", sent, err)
+	}
+
+	/* held while edited, and cancelled */
+	key, err := ob.Queue(&envelope{from: "me@example.com", to: []string{"a@example.com"}}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ob.Hold(key); err != nil {
+		t.Fatal(err)
+	}
+	if sent, _, _ = ob.process(now); sent != 0 {
+		t.Error("The held message was sent")
+	}
+	if err := ob.Cancel(key); err != nil {
+		t.Fatal(err)
+	}
+	if s := ob.Status(); s.queued != 0 {
+		t.Errorf("The message wasn't cancelled")
+	}
+	trashLock.Lock()
+	entries, _ := readTrashJournal()
+	trashLock.Unlock()
+	if len(entries) != 1 {
+		t.Errorf("Expected the cancelled message in the trash, got %d entries", len(entries))
+	}
+	if _, err := ob.Hold(key); err == nil {
+		t.Error("Expected the cancelled message to be gone")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		if d := retryDelay(test.attempts); d != test.delay {
+			t.Errorf("Expected %v after %d attempts, got %v", test.delay, test.attempts, d)
+		}
+	}
+}
+
+func TestNewMailFromQueued(t *testing.T) {
+	ob, _ := newTestOutbox(t)
+	defer os.RemoveAll(ob.path)
+	nm := &NewMail{
+		to:         mustParseAddresses(t, "Jörg Müller <joerg@example.com>"),
+		cc:         mustParseAddresses(t, "carol@example.com"),
+		bcc:        mustParseAddresses(t, "secret@example.com"),
+		subject:    "Réunion demain",
+		inReplyTo:  "<1@example.com>",
+		references: []string{"<0@example.com>", "<1@example.com>"},
+		body:       []byte("Bonjour,\n\nà demain.\n"),
+	}
+	msg, err := buildMessage(nm, &mail.Address{Address: "me@example.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &envelope{
+		from:       "me@example.com",
+		to:         []string{"joerg@example.com", "carol@example.com", "secret@example.com"},
+		parent:     "/mail/cur/1.a:2,S",
+		parentFlag: Replied,
+	}
+	key, err := ob.Queue(e, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := ob.Hold(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := newMailFromQueued(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.to) != 1 || got.to[0].Name != "Jörg Müller" || len(got.cc) != 1 {
+		t.Errorf("Unexpected recipients %v %v", got.to, got.cc)
+	}
+	if len(got.bcc) != 1 || got.bcc[0].Address != "secret@example.com" {
+		t.Errorf("Unexpected Bcc %v", got.bcc)
+	}
+	if got.subject != nm.subject || got.inReplyTo != nm.inReplyTo || len(got.references) != 2 {
+		t.Errorf("Unexpected headers %q %q %v", got.subject, got.inReplyTo, got.references)
+	}
+	if !bytes.Equal(got.body, nm.body) {
+		t.Errorf("Unexpected body %q", got.body)
+	}
+	if got.parent != e.parent || got.parentFlag != Replied {
+		t.Errorf("Unexpected parent %s %v", got.parent, got.parentFlag)
+	}
+}
+
+func TestFcc(t *testing.T) {
+	ob, ft := newTestOutbox(t)
+	defer os.RemoveAll(ob.path)
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	parent := deliverTestMessage(t, dir, "new", "1.a", "question")
+	e := &envelope{
+		from:       "me@example.com",
+		to:         []string{"a@example.com"},
+		fcc:        filepath.Join(dir, "Sent"),
+		parent:     parent,
+		parentFlag: Replied,
+	}
+	msg := []byte("Subject: Re: question\r\n\r\nanswer\r\n")
+	_, err := ob.Queue(e, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := ob.process(time.Now())
+	if err != nil || sent != 1 {
+		t.Fatalf("Unexpected process: %d, %v", sent, err)
+	}
+	if !bytes.Equal(ft.msgs[0], msg) {
+		t.Errorf("The envelope was sent: %q", ft.msgs[0])
+	}
+	names, _ := readDirNames(filepath.Join(dir, "Sent", "cur"))
+	if len(names) != 1 || !strings.HasSuffix(names[0], ":2,S") {
+		t.Fatalf("Expected a seen message in Sent, got %v", names)
+	}
+	buf, _ := ioutil.ReadFile(filepath.Join(dir, "Sent", "cur", names[0]))
+	if string(buf) != "Subject: Re: question\n\nanswer\n" {
+		t.Errorf("Unexpected saved message %q", buf)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "1.a:2,R")); err != nil {
+		t.Errorf("The original message wasn't flagged: %v", err)
+	}
+
+	/* what can't be saved is still sent once */
+	notMaildir := filepath.Join(dir, "file")
+	ioutil.WriteFile(notMaildir, nil, 0600)
+	e = &envelope{from: "me@example.com", to: []string{"a@example.com"}, fcc: notMaildir, parent: parent, parentFlag: Passed}
+	_, err = ob.Queue(e, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err = ob.process(time.Now())
+	if sent != 1 || err == nil || !strings.Contains(err.Error(), "can't save") {
+		t.Fatalf("Unexpected process: %d, %v", sent, err)
+	}
+	if s := ob.Status(); s.queued != 0 {
+		t.Errorf("The message is still queued")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "1.a:2,PR")); err != nil {
+		t.Errorf("The original message wasn't flagged: %v", err)
+	}
+}
+
+func TestParentUnsyncedFlags(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	read := deliverTestMessage(t, dir, "cur", "1.a:2,", "read, then replied to")
+	unflagged := deliverTestMessage(t, dir, "cur", "2.b:2,F", "unflagged, then forwarded")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* the user reads one and unflags the other, which isn't written
+	 * to disk until the changes are applied */
+	md.SetFlags(md.messageByKey("1.a"), Seen, 0)
+	md.SetFlags(md.messageByKey("2.b"), 0, Flagged)
+	for _, e := range []*envelope{
+		{parent: read, parentFlag: Replied},
+		{parent: unflagged, parentFlag: Passed},
+	} {
+		if err := e.sent(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := processCur(md); err != nil {
+		t.Fatal(err)
+	}
+	if f := md.messageByKey("1.a").Flags; f != Seen|Replied {
+		t.Errorf("Expected the message to be seen and replied, got %v", f)
+	}
+	if f := md.messageByKey("2.b").Flags; f != Passed {
+		t.Errorf("Expected the message to be passed only, got %v", f)
+	}
+	if err := md.ApplyChanges(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"1.a:2,RS", "2.b:2,P"} {
+		if _, err := os.Stat(filepath.Join(dir, "cur", name)); err != nil {
+			t.Errorf("The flags weren't saved: %v", err)
+		}
+	}
+}
+
+func TestFccMaildir(t *testing.T) {
+	defer func(s string, h []fccHook) { sentDir, fccHooks = s, h }(sentDir, fccHooks)
+	sentDir = "/mail/Sent"
+	var err error
+	fccHooks, err = compileFccHooks([]config.FccHook{
+		{From: "@work\\.example\\.com$", Maildir: "/mail/Work/Sent"},
+		{To: "@lists\\.", Maildir: "/mail/Lists"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		from     string
+		rcpts    []string
+		expected string
+	}{
+		{"me@example.com", []string{"a@example.com"}, "/mail/Sent"},
+		{"Me@Work.example.com", []string{"a@example.com"}, "/mail/Work/Sent"},
+		{"me@example.com", []string{"a@example.com", "dev@lists.example.org"}, "/mail/Lists"},
+	}
+	for _, test := range tests {
+		if md := fccMaildir(test.from, test.rcpts); md != test.expected {
+			t.Errorf("Expected %s for %s to %v, got %s", test.expected, test.from, test.rcpts, md)
+		}
+	}
+	if _, err := compileFccHooks([]config.FccHook{{To: "("}}); err == nil {
+		t.Error("Expected a bad pattern")
+	}
+}
@@ -0,0 +1,595 @@
+// Package query parses and evaluates the search language, where each
+// stage of a pipeline filters the messages let through by the previous
+// one:
+//
+//	from alice | contains urgent | before 1m
+//
+// The predicates are:
+//
+//	from, to, cc, subject TEXT         the field contains TEXT
+//	body TEXT                          each word of TEXT starts a word
+//	                                   of the body
+//	contains TEXT                      any of the above contains TEXT
+//	flag NAME                          seen, unread, replied, flagged,
+//	                                   trashed, draft, passed or tagged
+//	size [<|>|=]N[k|M|G]               the size of the message
+//	larger N, smaller N                shorthands for size > N, size < N
+//	before DATE, after DATE, on DATE   DATE is either 2006-01-02, or a
+//	                                   relative date: 3h, 2d, 1w, 6m, 1y
+//
+// TEXT is a word or a quoted string, matched case insensitively. A bare
+// word is taken as "contains" it. A word starting with '~' is matched
+// fuzzily against the words of the headers: "from ~smith" finds
+// "Schmitt" and "Smyth" too, see Closeness. Predicates can be negated with "not"
+// or "!", combined with "and" (or just juxtaposed), "or", and grouped
+// with parentheses. "|" binds the loosest.
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"amua/fuzzy"
+)
+
+// What the queries are evaluated against
+type Message interface {
+	Header(name string) string  // "from", "to", "cc" or "subject"
+	BodyContains(s string) bool // s is lower case
+	HasFlag(name string) bool   // one of Flags
+	Size() int64
+	Date() time.Time
+}
+
+// The flags a message can have
+var Flags = []string{"seen", "replied", "flagged", "trashed", "draft", "passed", "tagged"}
+
+// Other names for the flags, possibly negated
+var flagAliases = map[string]struct {
+	flag    string
+	negated bool
+}{
+	"unread":    {"seen", true},
+	"new":       {"seen", true},
+	"read":      {"seen", false},
+	"deleted":   {"trashed", false},
+	"important": {"flagged", false},
+	"forwarded": {"passed", false},
+}
+
+type Expr interface {
+	Match(m Message) bool
+}
+
+type andExpr struct{ l, r Expr }
+type orExpr struct{ l, r Expr }
+type notExpr struct{ e Expr }
+
+func (e *andExpr) Match(m Message) bool { return e.l.Match(m) && e.r.Match(m) }
+func (e *orExpr) Match(m Message) bool  { return e.l.Match(m) || e.r.Match(m) }
+func (e *notExpr) Match(m Message) bool { return !e.e.Match(m) }
+
+// field is a header name, "body", or "" for any of them
+type textExpr struct {
+	field string
+	s     string
+	fuzzy *fuzzy.Word // set if s is to be matched fuzzily
+}
+
+var headers = []string{"from", "to", "cc", "subject"}
+
+// Returns how close the closest word of the headers searched by e is
+func (e *textExpr) closeness(m Message) float64 {
+	fields := headers
+	if e.field != "" {
+		fields = []string{e.field}
+	}
+	ret := 0.0
+	for _, h := range fields {
+		if c := e.fuzzy.ClosenessIn(m.Header(h)); c > ret {
+			ret = c
+		}
+	}
+	return ret
+}
+
+func (e *textExpr) Match(m Message) bool {
+	if e.fuzzy != nil {
+		return e.closeness(m) > 0
+	}
+	switch e.field {
+	case "body":
+		return m.BodyContains(e.s)
+	case "":
+		for _, h := range headers {
+			if strings.Contains(strings.ToLower(m.Header(h)), e.s) {
+				return true
+			}
+		}
+		return m.BodyContains(e.s)
+	}
+	return strings.Contains(strings.ToLower(m.Header(e.field)), e.s)
+}
+
+type flagExpr struct{ flag string }
+
+func (e *flagExpr) Match(m Message) bool { return m.HasFlag(e.flag) }
+
+type sizeExpr struct {
+	op   byte
+	size int64
+}
+
+func (e *sizeExpr) Match(m Message) bool {
+	switch e.op {
+	case '<':
+		return m.Size() < e.size
+	case '>':
+		return m.Size() > e.size
+	}
+	return m.Size() == e.size
+}
+
+// Matches the dates in [from, to)
+type dateExpr struct {
+	from, to time.Time
+}
+
+func (e *dateExpr) Match(m Message) bool {
+	d := m.Date()
+	if !e.from.IsZero() && d.Before(e.from) {
+		return false
+	}
+	if !e.to.IsZero() && !d.Before(e.to) {
+		return false
+	}
+	return true
+}
+
+type SyntaxError struct {
+	Pos int // the offset of the error in the query
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at column %d", e.Msg, e.Pos+1)
+}
+
+// Returns how closely m matches e, from 0 if it doesn't to 1 if it does
+// exactly. Only the fuzzy words can match partially: a conjunction is as
+// close as its farthest part, a disjunction as its closest one.
+func Closeness(e Expr, m Message) float64 {
+	switch e := e.(type) {
+	case *andExpr:
+		l := Closeness(e.l, m)
+		if l == 0 {
+			return 0
+		}
+		r := Closeness(e.r, m)
+		if r < l {
+			return r
+		}
+		return l
+	case *orExpr:
+		l := Closeness(e.l, m)
+		if r := Closeness(e.r, m); r > l {
+			return r
+		}
+		return l
+	case *textExpr:
+		if e.fuzzy != nil {
+			return e.closeness(m)
+		}
+	}
+	if e.Match(m) {
+		return 1
+	}
+	return 0
+}
+
+// Returns true if e has fuzzy words, which makes ranking its matches
+// by Closeness worthwhile
+func IsFuzzy(e Expr) bool {
+	switch e := e.(type) {
+	case *andExpr:
+		return IsFuzzy(e.l) || IsFuzzy(e.r)
+	case *orExpr:
+		return IsFuzzy(e.l) || IsFuzzy(e.r)
+	case *textExpr:
+		return e.fuzzy != nil
+	}
+	return false
+}
+
+type token struct {
+	pos    int
+	s      string
+	quoted bool
+}
+
+const specials = "|()!"
+
+func tokenize(q string) ([]token, error) {
+	ret := []token{}
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte(specials, c) != -1:
+			ret = append(ret, token{pos: i, s: q[i : i+1]})
+			i++
+		case c == '"':
+			s := []byte{}
+			j := i + 1
+			for ; j < len(q) && q[j] != '"'; j++ {
+				if q[j] == '\\' && j+1 < len(q) {
+					j++
+				}
+				s = append(s, q[j])
+			}
+			if j == len(q) {
+				return nil, &SyntaxError{i, "unterminated string"}
+			}
+			ret = append(ret, token{pos: i, s: string(s), quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(q) && q[j] != ' ' && q[j] != '\t' && q[j] != '"' && strings.IndexByte(specials, q[j]) == -1 {
+				j++
+			}
+			ret = append(ret, token{pos: i, s: q[i:j]})
+			i = j
+		}
+	}
+	return ret, nil
+}
+
+type parser struct {
+	q      string
+	tokens []token
+	cur    int
+	now    time.Time
+}
+
+func (p *parser) peek() *token {
+	if p.cur == len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.cur]
+}
+
+// Returns true if the next token is the unquoted keyword s
+func (p *parser) at(s string) bool {
+	t := p.peek()
+	return t != nil && !t.quoted && strings.ToLower(t.s) == s
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	pos := len(p.q)
+	if t := p.peek(); t != nil {
+		pos = t.pos
+	}
+	return &SyntaxError{pos, fmt.Sprintf(format, args...)}
+}
+
+// Parses a query, the relative dates are relative to now
+func Parse(q string, now time.Time) (Expr, error) {
+	tokens, err := tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{q: q, tokens: tokens, now: now}
+	e, err := p.pipeline()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t != nil {
+		return nil, p.errorf("unexpected %q", t.s)
+	}
+	return e, nil
+}
+
+func (p *parser) pipeline() (Expr, error) {
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	for p.at("|") {
+		p.cur++
+		r, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		e = &andExpr{e, r}
+	}
+	return e, nil
+}
+
+func (p *parser) or() (Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.at("or") {
+		p.cur++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		e = &orExpr{e, r}
+	}
+	return e, nil
+}
+
+// Returns true if the next token can start a predicate
+func (p *parser) atPredicate() bool {
+	t := p.peek()
+	if t == nil {
+		return false
+	}
+	return t.quoted || (t.s != "|" && t.s != ")" && !p.at("or"))
+}
+
+func (p *parser) and() (Expr, error) {
+	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.at("and") {
+			p.cur++
+		} else if !p.atPredicate() {
+			return e, nil
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		e = &andExpr{e, r}
+	}
+}
+
+func (p *parser) unary() (Expr, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, p.errorf("missing expression")
+	}
+	if p.at("not") || p.at("!") {
+		p.cur++
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e}, nil
+	}
+	if p.at("(") {
+		p.cur++
+		e, err := p.pipeline()
+		if err != nil {
+			return nil, err
+		}
+		if !p.at(")") {
+			return nil, p.errorf("missing )")
+		}
+		p.cur++
+		return e, nil
+	}
+	return p.predicate()
+}
+
+// Returns the next token as an argument of the keyword at kw
+func (p *parser) arg(kw *token) (*token, error) {
+	t := p.peek()
+	if t == nil || (!t.quoted && strings.IndexByte(specials, t.s[0]) != -1) {
+		return nil, p.errorf("%s needs an argument", kw.s)
+	}
+	p.cur++
+	return t, nil
+}
+
+func (p *parser) predicate() (Expr, error) {
+	kw := p.peek()
+	if kw.quoted {
+		p.cur++
+		return &textExpr{s: strings.ToLower(kw.s)}, nil
+	}
+	if strings.IndexByte(specials, kw.s[0]) != -1 {
+		return nil, p.errorf("unexpected %q", kw.s)
+	}
+	name := strings.ToLower(kw.s)
+	switch name {
+	case "from", "to", "cc", "subject", "body", "contains":
+		p.cur++
+		t, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		if name == "contains" {
+			name = ""
+		}
+		return p.text(name, t)
+	case "flag":
+		p.cur++
+		t, err := p.arg(kw)
+		if err != nil {
+			return nil, err
+		}
+		flag := strings.ToLower(t.s)
+		if a, ok := flagAliases[flag]; ok {
+			if a.negated {
+				return &notExpr{&flagExpr{a.flag}}, nil
+			}
+			return &flagExpr{a.flag}, nil
+		}
+		for _, f := range Flags {
+			if f == flag {
+				return &flagExpr{flag}, nil
+			}
+		}
+		p.cur--
+		return nil, p.errorf("unknown flag %q", t.s)
+	case "size", "larger", "smaller":
+		p.cur++
+		return p.size(kw)
+	case "before", "after", "on":
+		p.cur++
+		return p.date(kw)
+	}
+	/* a bare word */
+	p.cur++
+	return p.text("", kw)
+}
+
+func (p *parser) text(field string, t *token) (Expr, error) {
+	s := strings.ToLower(t.s)
+	if t.quoted || len(s) < 2 || s[0] != '~' {
+		return &textExpr{field: field, s: s}, nil
+	}
+	if field == "body" {
+		p.cur--
+		return nil, p.errorf("the body can't be matched fuzzily")
+	}
+	return &textExpr{field: field, s: s[1:], fuzzy: fuzzy.NewWord(s[1:])}, nil
+}
+
+func (p *parser) size(kw *token) (Expr, error) {
+	t, err := p.arg(kw)
+	if err != nil {
+		return nil, err
+	}
+	s := t.s
+	var op byte
+	switch strings.ToLower(kw.s) {
+	case "larger":
+		op = '>'
+	case "smaller":
+		op = '<'
+	default:
+		op = '='
+		if s == "<" || s == ">" || s == "=" {
+			/* "size > 1M" */
+			t, err = p.arg(kw)
+			if err != nil {
+				return nil, err
+			}
+			op = s[0]
+			s = t.s
+		} else if s[0] == '<' || s[0] == '>' || s[0] == '=' {
+			op = s[0]
+			s = s[1:]
+		}
+	}
+	size, ok := parseSize(s)
+	if !ok {
+		p.cur--
+		return nil, p.errorf("invalid size %q", t.s)
+	}
+	return &sizeExpr{op, size}, nil
+}
+
+func parseSize(s string) (int64, bool) {
+	mult := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1024
+		case 'm', 'M':
+			mult = 1024 * 1024
+		case 'g', 'G':
+			mult = 1024 * 1024 * 1024
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return int64(n * float64(mult)), true
+}
+
+// Parses either an absolute date, or a date relative to now
+func parseDate(s string, now time.Time) (time.Time, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t, true
+	}
+	if len(s) < 2 {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, false
+	}
+	switch s[len(s)-1] {
+	case 'h':
+		return now.Add(-time.Duration(n) * time.Hour), true
+	case 'd':
+		return now.AddDate(0, 0, -n), true
+	case 'w':
+		return now.AddDate(0, 0, -7*n), true
+	case 'm':
+		return now.AddDate(0, -n, 0), true
+	case 'y':
+		return now.AddDate(-n, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+func (p *parser) date(kw *token) (Expr, error) {
+	t, err := p.arg(kw)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := parseDate(t.s, p.now)
+	if !ok {
+		p.cur--
+		return nil, p.errorf("invalid date %q", t.s)
+	}
+	switch strings.ToLower(kw.s) {
+	case "before":
+		return &dateExpr{to: d}, nil
+	case "after":
+		return &dateExpr{from: d}, nil
+	}
+	day := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, d.Location())
+	return &dateExpr{from: day, to: day.AddDate(0, 0, 1)}, nil
+}
+
+// Returns the query a full-text index can run to find the messages
+// matching e, in the syntax of amua/index. ok is false if e isn't just a
+// conjunction of text predicates. The index matches words, not
+// substrings, so its results can only be an approximation of e's.
+func IndexQuery(e Expr) (q string, ok bool) {
+	switch e := e.(type) {
+	case *andExpr:
+		l, ok := IndexQuery(e.l)
+		if !ok {
+			return "", false
+		}
+		r, ok := IndexQuery(e.r)
+		if !ok {
+			return "", false
+		}
+		return l + " " + r, true
+	case *textExpr:
+		if e.fuzzy != nil {
+			if e.field != "" {
+				return e.field + ":~" + e.s, true
+			}
+			return "~" + e.s, true
+		}
+		words := []string{}
+		for _, w := range strings.Fields(e.s) {
+			if e.field != "" {
+				w = e.field + ":" + w
+			}
+			words = append(words, w+"*")
+		}
+		return strings.Join(words, " "), len(words) > 0
+	}
+	return "", false
+}
@@ -0,0 +1,192 @@
+package query
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	headers map[string]string
+	body    string
+	flags   []string
+	size    int64
+	date    time.Time
+}
+
+func (m *testMessage) Header(name string) string { return m.headers[name] }
+func (m *testMessage) BodyContains(s string) bool {
+	return strings.Contains(strings.ToLower(m.body), s)
+}
+func (m *testMessage) Size() int64     { return m.size }
+func (m *testMessage) Date() time.Time { return m.date }
+func (m *testMessage) HasFlag(name string) bool {
+	for _, f := range m.flags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+var now = time.Date(2016, 6, 15, 12, 0, 0, 0, time.UTC)
+
+var msg = &testMessage{
+	headers: map[string]string{
+		"from":    "Alice <alice@example.com>",
+		"to":      "Bob <bob@example.com>",
+		"cc":      "carol@example.org",
+		"subject": "URGENT: the build is broken",
+	},
+	body:  "Please fix it before the release.",
+	flags: []string{"flagged", "replied"},
+	size:  3 * 1024,
+	date:  time.Date(2016, 6, 1, 9, 30, 0, 0, time.UTC),
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected bool
+	}{
+		{"from alice", true},
+		{"from bob", false},
+		{"to BOB", true},
+		{"cc example.org", true},
+		{"subject urgent", true},
+		{`subject "the build"`, true},
+		{`subject "build the"`, false},
+		{"body release", true},
+		{"body urgent", false},
+		{"contains urgent", true},
+		{"contains release", true},
+		{"urgent", true},
+		{"urgent release", true},
+		{"urgent nothing", false},
+		{"from alice | contains urgent | before 1w", true},
+		{"from alice | contains urgent | after 1w", false},
+		{"from bob or subject build", true},
+		{"from bob or subject nothing", false},
+		{"not from bob", true},
+		{"!from alice", false},
+		{"!(from bob or from carol) and flag flagged", true},
+		{"flag flagged", true},
+		{"flag unread", true},
+		{"flag seen", false},
+		{"flag important and not flag deleted", true},
+		{"size > 2k", true},
+		{"size >2k", true},
+		{"size <2k", false},
+		{"size 3072", true},
+		{"larger 1M", false},
+		{"smaller 0.5M", true},
+		{"before 2016-06-02", true},
+		{"before 2016-06-01", false},
+		{"after 2016-05-31", true},
+		{"on 2016-06-01", true},
+		{"on 2016-06-02", false},
+		{"on 14d", true},
+		{"after 1m", true},
+		{"before 1y", false},
+		{"after 3h", false},
+		{"from alice | (before 1d | size < 1k) or flag replied", true},
+		{"from ~alise", true},
+		{"from ~allyce", true},
+		{"~bobb", true},
+		{"to ~alice", false},
+		{"~relese", false},
+		{`"~alice"`, false},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.q, now)
+		if err != nil {
+			t.Errorf("%q: %v", tt.q, err)
+			continue
+		}
+		if got := e.Match(msg); got != tt.expected {
+			t.Errorf("%q: expected %v, got %v", tt.q, tt.expected, got)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		q   string
+		pos int
+		msg string
+	}{
+		{"", 0, "missing expression"},
+		{"from", 4, "from needs an argument"},
+		{"from alice |", 12, "missing expression"},
+		{"(from alice", 11, "missing )"},
+		{"from alice)", 10, `unexpected ")"`},
+		{"flag purple", 5, `unknown flag "purple"`},
+		{"size >lots", 5, `invalid size ">lots"`},
+		{"before yesterday", 7, `invalid date "yesterday"`},
+		{`subject "oops`, 8, "unterminated string"},
+		{"from | alice", 5, "from needs an argument"},
+		{"body ~release", 5, "the body can't be matched fuzzily"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.q, now)
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("%q: expected a syntax error, got %v", tt.q, err)
+			continue
+		}
+		if se.Pos != tt.pos || se.Msg != tt.msg {
+			t.Errorf("%q: expected %q at %d, got %q at %d", tt.q, tt.msg, tt.pos, se.Msg, se.Pos)
+		}
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected string
+		ok       bool
+	}{
+		{"urgent", "urgent*", true},
+		{`from alice | subject "build broken"`, "from:alice* subject:build* subject:broken*", true},
+		{"from alice or from bob", "", false},
+		{"urgent flag seen", "", false},
+		{"from ~alise | urgent", "from:~alise urgent*", true},
+		{"~alise", "~alise", true},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.q, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := IndexQuery(e)
+		if got != tt.expected || ok != tt.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", tt.q, tt.expected, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestCloseness(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected float64
+	}{
+		{"from alice", 1},
+		{"from bob", 0},
+		{"from ~alice", 1},
+		{"from ~alice | to ~bob", 1},
+		{"from ~alise | to ~bob", 1 - 1.0/6},
+		{"from ~alise | to ~zed", 0},
+		{"from ~alise or to ~bob", 1},
+		{"not from ~zed", 1},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.q, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Closeness(e, msg); math.Abs(got-tt.expected) > 1e-9 {
+			t.Errorf("%q: expected %v, got %v", tt.q, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"amua/config"
+	"amua/query"
+)
+
+// A query saved in the config, shown in the sidebar as a virtual maildir
+// holding the matching messages of its source maildirs. The messages
+// are the sources' own, or copies of them for the sources that aren't
+// loaded: the flags set on them, the deletions and the moves all end up
+// in the sources, and the virtual maildir is refreshed when their
+// monitors report changes.
+type savedSearch struct {
+	query   string
+	sources []*Maildir
+}
+
+// Returns the virtual maildirs of the saved searches, picking their
+// sources among the known maildirs
+func initSavedSearches(searches []config.SearchConfig, known []knownMaildir) ([]knownMaildir, error) {
+	ret := make([]knownMaildir, 0, len(searches))
+	for _, sc := range searches {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("A saved search has no name")
+		}
+		_, err := query.Parse(sc.Query, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("Invalid query for the saved search %q: %s", sc.Name, err.Error())
+		}
+		s := &savedSearch{query: sc.Query}
+		if len(sc.Maildirs) == 0 {
+			for _, km := range known {
+				s.sources = append(s.sources, km.maildir)
+			}
+		}
+		for _, path := range sc.Maildirs {
+			found := false
+			for _, km := range known {
+				if km.path == path {
+					s.sources = append(s.sources, km.maildir)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("The saved search %q uses %s, which is not a known maildir", sc.Name, path)
+			}
+		}
+		ret = append(ret, knownMaildir{
+			maildir: &Maildir{path: sc.Name, search: s},
+			path:    sc.Name,
+			name:    "[" + sc.Name + "]",
+		})
+	}
+	return ret, nil
+}
+
+func (km *knownMaildir) isVirtual() bool {
+	return km.maildir.search != nil
+}
+
+// Returns the maildir m comes from: md itself, unless md is virtual
+func (md *Maildir) Owner(m *Message) *Maildir {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if o, ok := md.owners[m]; ok {
+		return o
+	}
+	return md
+}
+
+// Returns true if the messages of md come from src
+func (md *Maildir) dependsOn(src *Maildir) bool {
+	if md.search == nil {
+		return false
+	}
+	for _, s := range md.sources() {
+		if s == src {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the messages of the maildir at path are found in md
+func (md *Maildir) covers(path string) bool {
+	if md.path == path && md.search == nil {
+		return true
+	}
+	for _, s := range md.sources() {
+		if s.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops looking for messages in src, a maildir that's gone
+func (md *Maildir) dropSource(src *Maildir) {
+	if md.search == nil {
+		return
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	sources := []*Maildir{}
+	for _, s := range md.search.sources {
+		if s != src {
+			sources = append(sources, s)
+		}
+	}
+	md.search.sources = sources
+}
+
+func (md *Maildir) sources() []*Maildir {
+	if md.search == nil {
+		return nil
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	return md.search.sources
+}
+
+// Returns copies of the messages of md, with their headers: read from
+// the header cache when possible, leaving md as it is
+func (md *Maildir) parsedCopies() []*Message {
+	msgs := md.Messages()
+	ret := make([]*Message, 0, len(msgs))
+	for _, m := range msgs {
+		nm, err := md.loadMessage(m.path, true)
+		if err != nil {
+			/* gone since */
+			continue
+		}
+		nm.Flags = m.Flags
+		ret = append(ret, nm)
+	}
+	return ret
+}
+
+// Returns the maildir m comes from, and the message it holds for m: the
+// messages of the sources that aren't loaded are copies, see loadSearch
+func (md *Maildir) sourceMessage(m *Message) (*Maildir, *Message) {
+	o := md.Owner(m)
+	if om := o.messageByKey(messageKey(m)); om != nil {
+		return o, om
+	}
+	return o, m
+}
+
+// Runs the query against the sources. The sources that only know the
+// paths of their messages are left that way: the query is run against
+// copies of their messages, which only the virtual maildir holds. The
+// relative dates are relative to the time of the refresh. A refresh
+// started in the meantime supersedes this one.
+func (md *Maildir) loadSearch() error {
+	md.lock.Lock()
+	md.loadSeq++
+	seq := md.loadSeq
+	md.lock.Unlock()
+	expr, err := query.Parse(md.search.query, time.Now())
+	if err != nil {
+		return err
+	}
+	msgs := []*Message{}
+	owners := make(map[*Message]*Maildir)
+	for _, src := range md.sources() {
+		var candidates []*Message
+		if src.IsActive() {
+			candidates = src.Messages()
+		} else {
+			candidates = src.parsedCopies()
+		}
+		qm := newQueryMatcher(src, expr)
+		for _, m := range candidates {
+			if qm.Match(m) {
+				msgs = append(msgs, m)
+				owners[m] = src
+			}
+		}
+	}
+	sort.Sort(ByPath(msgs))
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	if md.loadSeq != seq {
+		return nil
+	}
+	md.messages = msgs
+	md.owners = owners
+	md.active = true
+	md.gen++
+	return nil
+}
+
+// Applies the changes to the sources, then runs the query again as the
+// messages might not match anymore
+func (md *Maildir) applySearchChanges() error {
+	var ret error
+	for _, src := range md.sources() {
+		err := src.ApplyChanges()
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	err := md.loadSearch()
+	if ret == nil {
+		ret = err
+	}
+	return ret
+}
+
+func (md *Maildir) removeFromSearch(m *Message) error {
+	o, om := md.sourceMessage(m)
+	err := o.Remove(om)
+	if err != nil {
+		return err
+	}
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	for i, cur := range md.messages {
+		if cur == m {
+			md.messages = append(md.messages[:i], md.messages[i+1:]...)
+			delete(md.owners, m)
+			md.gen++
+			break
+		}
+	}
+	return nil
+}
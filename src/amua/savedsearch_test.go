@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"amua/config"
+)
+
+func TestSavedSearch(t *testing.T) {
+	inbox := newTestMaildir(t)
+	defer os.RemoveAll(inbox)
+	archive := newTestMaildir(t)
+	defer os.RemoveAll(archive)
+	deliverTestMessage(t, inbox, "cur", "1.a:2,FS", "flagged in the inbox")
+	deliverTestMessage(t, inbox, "cur", "2.b:2,S", "not flagged")
+	deliverTestMessage(t, archive, "cur", "3.c:2,F", "flagged in the archive")
+
+	known := []knownMaildir{}
+	for _, path := range []string{inbox, archive} {
+		md, err := LoadMaildir(path, path == inbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		known = append(known, knownMaildir{maildir: md, path: path})
+	}
+	searches, err := initSavedSearches([]config.SearchConfig{
+		{Name: "flagged", Query: "flag flagged"},
+	}, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := searches[0].maildir
+	err = md.Load(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 2 {
+		t.Fatalf("Expected 2 messages, got %d", md.Len())
+	}
+	if !md.covers(archive) || md.covers("flagged") {
+		t.Error("The saved search doesn't cover its sources")
+	}
+
+	/* the changes go to the sources */
+	var fromArchive *Message
+	for _, m := range md.Messages() {
+		if md.Owner(m) == known[1].maildir {
+			fromArchive = m
+		}
+	}
+	if fromArchive == nil || fromArchive.Subject != "flagged in the archive" {
+		t.Fatal("The message doesn't come from its source")
+	}
+	/* the archive wasn't loaded, the query ran on copies */
+	if known[1].maildir.IsActive() {
+		t.Error("The search loaded its source")
+	}
+	md.SetFlags(fromArchive, 0, Flagged)
+	err = md.ApplyChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(archive, "cur", "3.c:2,")); err != nil {
+		t.Errorf("The flag wasn't cleared on disk: %s", err)
+	}
+	if md.Len() != 1 {
+		t.Errorf("Expected 1 message after the refresh, got %d", md.Len())
+	}
+	err = md.Remove(md.Message(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 0 || known[0].maildir.Len() != 1 {
+		t.Errorf("The message wasn't removed: %d, %d", md.Len(), known[0].maildir.Len())
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "cur", "1.a:2,FS")); !os.IsNotExist(err) {
+		t.Errorf("The file wasn't removed: %v", err)
+	}
+
+	/* what the monitors pick up shows up after a refresh */
+	deliverTestMessage(t, archive, "new", "4.d", "new")
+	processNew(known[1].maildir)
+	known[1].maildir.SetFlags(known[1].maildir.Message(1), Flagged, 0)
+	if !md.dependsOn(known[1].maildir) {
+		t.Fatal("The saved search doesn't depend on its sources")
+	}
+	err = md.Load(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 1 {
+		t.Errorf("Expected the new message, got %d messages", md.Len())
+	}
+
+	/* the headers of the messages of the archive are known */
+	searches, err = initSavedSearches([]config.SearchConfig{
+		{Name: "archived", Query: "subject archive"},
+	}, known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = searches[0].maildir.Load(true); err != nil {
+		t.Fatal(err)
+	}
+	if n := searches[0].maildir.Len(); n != 1 || known[1].maildir.IsActive() {
+		t.Errorf("Expected 1 message from the unloaded archive, got %d", n)
+	}
+
+	_, err = initSavedSearches([]config.SearchConfig{
+		{Name: "broken", Query: "from ("},
+	}, known)
+	if err == nil {
+		t.Error("Expected an error for an invalid query")
+	}
+	_, err = initSavedSearches([]config.SearchConfig{
+		{Name: "elsewhere", Query: "flag flagged", Maildirs: []string{"/nonexistent"}},
+	}, known)
+	if err == nil {
+		t.Error("Expected an error for an unknown maildir")
+	}
+}
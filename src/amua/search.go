@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"amua/index"
+	"amua/mime"
+	"amua/query"
+)
+
+// Keeps the full-text index of the known maildirs up to date. The
+// maildirs report the messages they gain and lose, and a goroutine
+// (re)indexes them in the background, so that neither the UI nor the
+// monitors wait on it.
+type indexer struct {
+	idx    *index.Index
+	lock   sync.Mutex
+	cond   *sync.Cond
+	jobs   []indexJob
+	closed bool
+	due    bool // the idle flush is due
+	done   chan bool
+}
+
+type indexJob struct {
+	maildir string
+	path    string // the message's path, or "" to sync the whole maildir
+	remove  bool
+}
+
+// The full-text index, nil if there's none
+var searchIndex *indexer
+
+// How many messages are indexed before they're written to disk
+const indexFlushEvery = 2000
+
+// How long the indexed messages stay in memory at most, when fewer than
+// indexFlushEvery come in. The messages trickling in are thus written in
+// batches, instead of one segment each.
+const indexFlushDelay = time.Minute
+
+func newIndexer(dir string) (*indexer, error) {
+	idx, err := index.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	ix := &indexer{idx: idx, done: make(chan bool)}
+	ix.cond = sync.NewCond(&ix.lock)
+	go ix.run()
+	return ix, nil
+}
+
+func (ix *indexer) queue(jobs ...indexJob) {
+	if ix == nil || len(jobs) == 0 {
+		return
+	}
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	ix.jobs = append(ix.jobs, jobs...)
+	ix.cond.Signal()
+}
+
+// Called when messages are delivered to the maildir at mdPath
+func (ix *indexer) added(mdPath string, msgs []*Message) {
+	jobs := make([]indexJob, len(msgs))
+	for i, m := range msgs {
+		jobs[i] = indexJob{maildir: mdPath, path: m.path}
+	}
+	ix.queue(jobs...)
+}
+
+// Called when messages are removed from the maildir at mdPath
+func (ix *indexer) removed(mdPath string, msgs []*Message) {
+	jobs := make([]indexJob, len(msgs))
+	for i, m := range msgs {
+		jobs[i] = indexJob{maildir: mdPath, path: m.path, remove: true}
+	}
+	ix.queue(jobs...)
+}
+
+// Indexes the messages of the maildir at mdPath that aren't yet, and
+// forgets the ones that are gone
+func (ix *indexer) sync(mdPath string) {
+	ix.queue(indexJob{maildir: mdPath})
+}
+
+func (ix *indexer) isClosed() bool {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	return ix.closed
+}
+
+func (ix *indexer) run() {
+	defer close(ix.done)
+	var timer *time.Timer
+	for {
+		ix.lock.Lock()
+		if len(ix.jobs) == 0 && timer == nil && ix.idx.Pending() > 0 {
+			timer = time.AfterFunc(indexFlushDelay, func() {
+				ix.lock.Lock()
+				ix.due = true
+				ix.cond.Signal()
+				ix.lock.Unlock()
+			})
+		}
+		for len(ix.jobs) == 0 && !ix.closed && !ix.due {
+			ix.cond.Wait()
+		}
+		if ix.closed {
+			ix.lock.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if ix.due {
+			ix.due = false
+			timer = nil
+			ix.lock.Unlock()
+			ix.idx.Flush()
+			continue
+		}
+		job := ix.jobs[0]
+		ix.jobs = ix.jobs[1:]
+		ix.lock.Unlock()
+		switch {
+		case job.path == "":
+			ix.doSync(job.maildir)
+		case job.remove:
+			ix.idx.Remove(index.Doc{Maildir: job.maildir, Key: maildirKey(filepath.Base(job.path))})
+		default:
+			ix.doAdd(job.maildir, job.path)
+		}
+	}
+}
+
+func (ix *indexer) doAdd(mdPath string, path string) {
+	doc := index.Doc{Maildir: mdPath, Key: maildirKey(filepath.Base(path))}
+	if ix.idx.Has(doc) {
+		return
+	}
+	fields, err := messageFields(path)
+	if os.IsNotExist(err) {
+		/* its flags changed since */
+		matches, _ := filepath.Glob(filepath.Join(mdPath, "cur", doc.Key+":2,*"))
+		if len(matches) == 0 {
+			return
+		}
+		fields, err = messageFields(matches[0])
+	}
+	if err != nil {
+		return
+	}
+	ix.idx.Add(doc, fields)
+	if ix.idx.Pending() >= indexFlushEvery {
+		ix.idx.Flush()
+	}
+}
+
+func (ix *indexer) doSync(mdPath string) {
+	curdir := filepath.Join(mdPath, "cur")
+	names, err := readDirNames(curdir)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	/* a maildir that's gone is emptied */
+	indexed := ix.idx.Keys(mdPath)
+	for _, n := range names {
+		key := maildirKey(n)
+		if indexed[key] {
+			delete(indexed, key)
+			continue
+		}
+		if ix.isClosed() {
+			return
+		}
+		ix.doAdd(mdPath, filepath.Join(curdir, n))
+	}
+	for key := range indexed {
+		ix.idx.Remove(index.Doc{Maildir: mdPath, Key: key})
+	}
+}
+
+// Stops indexing and closes the index. What's left to index will be
+// picked up by the next sync.
+func (ix *indexer) Close() error {
+	if ix == nil {
+		return nil
+	}
+	ix.lock.Lock()
+	ix.closed = true
+	ix.cond.Signal()
+	ix.lock.Unlock()
+	<-ix.done
+	return ix.idx.Close()
+}
+
+// Returns the text of the indexed fields of a message
+func messageFields(path string) (map[string]string, error) {
+	m, err := LoadMessage(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mtree, err := mime.GetMimeTree(f, 10)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	for _, b := range traverse(mtree, false) {
+		body.Write(b.Bytes())
+		body.WriteByte('\n')
+	}
+	return map[string]string{
+		"from":    m.From,
+		"to":      m.To,
+		"cc":      m.CCs,
+		"subject": m.Subject,
+		"body":    body.String(),
+	}, nil
+}
+
+// Searches the index, returns the keys of the matching messages by
+// maildir
+func (ix *indexer) search(query string) (map[string]map[string]bool, error) {
+	ret := make(map[string]map[string]bool)
+	if ix == nil {
+		return ret, nil
+	}
+	docs, err := ix.idx.Search(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range docs {
+		keys, ok := ret[d.Maildir]
+		if !ok {
+			keys = make(map[string]bool)
+			ret[d.Maildir] = keys
+		}
+		keys[d.Key] = true
+	}
+	return ret, nil
+}
+
+// Returns true if the message with key in the maildir at mdPath is
+// indexed
+func (ix *indexer) has(mdPath string, key string) bool {
+	if ix == nil {
+		return false
+	}
+	return ix.idx.Has(index.Doc{Maildir: mdPath, Key: key})
+}
+
+// Evaluates a query against the messages of a maildir. The body
+// predicates are answered by the full-text index for the messages it
+// knows, and by reading the others.
+type queryMatcher struct {
+	md       *Maildir
+	expr     query.Expr
+	bodyHits map[string]map[string]map[string]bool // the index hits by searched text, then by maildir
+}
+
+func newQueryMatcher(md *Maildir, expr query.Expr) *queryMatcher {
+	return &queryMatcher{md: md, expr: expr, bodyHits: make(map[string]map[string]map[string]bool)}
+}
+
+func (qm *queryMatcher) Match(m *Message) bool {
+	return qm.expr.Match(&queryMessage{qm, m})
+}
+
+// Returns how closely m matches, see query.Closeness
+func (qm *queryMatcher) Closeness(m *Message) float64 {
+	return query.Closeness(qm.expr, &queryMessage{qm, m})
+}
+
+// A message of a view matching a fuzzy query
+type rankedMatch struct {
+	idx       int // in the view
+	closeness float64
+}
+
+type byCloseness []rankedMatch
+
+func (r byCloseness) Len() int           { return len(r) }
+func (r byCloseness) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byCloseness) Less(i, j int) bool { return r[i].closeness > r[j].closeness }
+
+// Returns the messages of mv matching qm, the closest first, in the
+// order of the view otherwise
+func rankMatches(mv *MaildirView, qm *queryMatcher) []rankedMatch {
+	ret := []rankedMatch{}
+	for i, m := range mv.Messages() {
+		if c := qm.Closeness(m); c > 0 {
+			ret = append(ret, rankedMatch{i, c})
+		}
+	}
+	sort.Stable(byCloseness(ret))
+	return ret
+}
+
+type queryMessage struct {
+	qm *queryMatcher
+	m  *Message
+}
+
+func (qm *queryMessage) Header(name string) string {
+	switch name {
+	case "from":
+		return qm.m.From
+	case "to":
+		return qm.m.To
+	case "cc":
+		return qm.m.CCs
+	case "subject":
+		return qm.m.Subject
+	}
+	return ""
+}
+
+// Tells whether the body has, for each of the words of s, a word starting
+// with it: that's what the index can answer, so the messages that aren't
+// indexed yet are matched the same way. s is matched as a substring if
+// none of its words is long enough to be indexed.
+func (qm *queryMessage) BodyContains(s string) bool {
+	terms := index.Tokenize(s)
+	key := maildirKey(filepath.Base(qm.m.path))
+	/* the messages of a virtual maildir are indexed in their own */
+	mdPath := qm.qm.md.Owner(qm.m).path
+	if len(terms) > 0 && searchIndex.has(mdPath, key) {
+		hits, ok := qm.qm.bodyHits[s]
+		if !ok {
+			q := ""
+			for _, w := range terms {
+				q += " body:" + w + "*"
+			}
+			hits, _ = searchIndex.search(q)
+			qm.qm.bodyHits[s] = hits
+		}
+		return hits[mdPath][key]
+	}
+	fields, err := messageFields(qm.m.path)
+	if err != nil {
+		return false
+	}
+	if len(terms) == 0 {
+		return strings.Contains(strings.ToLower(fields["body"]), s)
+	}
+	return hasPrefixes(index.Tokenize(fields["body"]), terms)
+}
+
+// Tells whether each of the prefixes starts one of the words
+func hasPrefixes(words []string, prefixes []string) bool {
+	for _, p := range prefixes {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, p) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+var queryFlags = map[string]MessageFlags{
+	"seen":    Seen,
+	"replied": Replied,
+	"flagged": Flagged,
+	"trashed": Trashed,
+	"draft":   Draft,
+	"passed":  Passed,
+	"tagged":  Tagged,
+}
+
+func (qm *queryMessage) HasFlag(name string) bool {
+	return (qm.m.Flags & queryFlags[name]) != 0
+}
+
+func (qm *queryMessage) Size() int64 {
+	return qm.m.size
+}
+
+func (qm *queryMessage) Date() time.Time {
+	return qm.m.Date
+}
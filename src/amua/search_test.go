@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"amua/query"
+)
+
+// Waits for the indexer to find, or not, the messages matching q in
+// the maildir at mdPath
+func waitForHits(t *testing.T, q string, mdPath string, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hits, err := searchIndex.search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits[mdPath]) == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q: expected %d hits, got %v", q, expected, hits)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIndexUpdates(t *testing.T) {
+	indexDir, err := ioutil.TempDir("", "amuaindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.old:2,S", "an old one")
+
+	searchIndex, err = newIndexer(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		searchIndex.Close()
+		searchIndex = nil
+	}()
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchIndex.sync(dir)
+	waitForHits(t, "subject:old", dir, 1)
+
+	deliverTestMessage(t, dir, "new", "2.new", "a new one")
+	processNew(md)
+	waitForHits(t, "new body", dir, 1)
+
+	os.Remove(filepath.Join(dir, "cur", "1.old:2,S"))
+	processCur(md)
+	waitForHits(t, "old", dir, 0)
+	waitForHits(t, "body", dir, 1)
+}
+
+func TestQueryMatcher(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "lunch")
+	deliverTestMessage(t, dir, "cur", "2.b:2,F", "report")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		q        string
+		expected int
+	}{
+		{"lunch", 1},
+		{"from a@example.com | body body", 2},
+		{"flag unread", 1},
+		{"flag flagged | subject report", 1},
+		{"not body body", 0},
+		{"larger 1k", 0},
+	}
+	for _, tt := range tests {
+		expr, err := query.Parse(tt.q, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		qm := newQueryMatcher(md, expr)
+		n := 0
+		for _, m := range md.Messages() {
+			if qm.Match(m) {
+				n++
+			}
+		}
+		if n != tt.expected {
+			t.Errorf("%q: expected %d matches, got %d", tt.q, tt.expected, n)
+		}
+	}
+}
+
+func TestBodyContains(t *testing.T) {
+	indexDir, err := ioutil.TempDir("", "amuaindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(indexDir)
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	msg := "From: a@example.com\r\nSubject: lunch\r\n\r\nLunch at noon, then a quick review.\r\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "cur", "1.a:2,S"), []byte(msg), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		q        string
+		expected bool
+	}{
+		{"body lun", true},
+		{"body unch", false},
+		{"body \"review noon\"", true},
+		{"body \"then a\"", true},
+		{"body \"then a lunch\"", true},
+		{"body dinner", false},
+		/* too short to be indexed */
+		{"body a", true},
+		{"body z", false},
+	}
+	check := func(indexed bool) {
+		for _, tt := range tests {
+			expr, err := query.Parse(tt.q, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := md.Messages()[0]
+			if got := newQueryMatcher(md, expr).Match(m); got != tt.expected {
+				t.Errorf("%q, indexed %v: expected %v, got %v", tt.q, indexed, tt.expected, got)
+			}
+		}
+	}
+	check(false)
+
+	searchIndex, err = newIndexer(indexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		searchIndex.Close()
+		searchIndex = nil
+	}()
+	searchIndex.sync(dir)
+	waitForHits(t, "body:lunch", dir, 1)
+	check(true)
+}
+
+func TestRankMatches(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,S", "Meeting with Schmitt")
+	deliverTestMessage(t, dir, "cur", "2.b:2,S", "Lunch")
+	deliverTestMessage(t, dir, "cur", "3.c:2,S", "Meeting with Smyth")
+	deliverTestMessage(t, dir, "cur", "4.d:2,S", "Meeting with Smith")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mv := &MaildirView{md: md}
+	mv.Sort()
+	expr, err := query.Parse("subject ~smith", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranked := rankMatches(mv, newQueryMatcher(md, expr))
+	got := []string{}
+	for _, r := range ranked {
+		got = append(got, mv.Message(r.idx).Subject)
+	}
+	expected := []string{"Meeting with Smith", "Meeting with Smyth", "Meeting with Schmitt"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
@@ -1,68 +1,236 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	gomime "mime"
+	"mime/quotedprintable"
 	"net/mail"
-	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"amua/config"
-	"amua/util"
 )
 
 // Holds values while a new email is being edited
 type NewMail struct {
-	to      []*mail.Address
-	cc      []*mail.Address
-	bcc     []*mail.Address
-	subject string
-	body    []byte
+	to         []*mail.Address
+	cc         []*mail.Address
+	bcc        []*mail.Address
+	subject    string
+	inReplyTo  string
+	references []string
+	body       []byte
+	outboxKey  string       // the queued message being edited, replaced once this one is queued
+	parent     string       // the path of the message replied to or forwarded, if any
+	parentFlag MessageFlags // set on parent once sent
 }
 
-func sendMail(addr, hello, tlsServerName string, a smtp.Auth, from string, to []string, msg []byte) error {
-	c, err := smtp.Dial(addr)
-	if err != nil {
-		return err
+// RFC 5322 says lines must not be longer than 998 characters, excluding
+// the CRLF
+const maxLineLen = 998
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
 	}
-	defer c.Close()
-	if err = c.Hello(hello); err != nil {
-		return err
+	return true
+}
+
+// Returns true if buf can be sent as is, with a 7bit transfer encoding
+func is7bit(buf []byte) bool {
+	if !isASCII(buf) {
+		return false
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: tlsServerName}
-		if err = c.StartTLS(config); err != nil {
-			return err
+	for _, l := range bytes.Split(buf, []byte("\n")) {
+		if len(l) > maxLineLen {
+			return false
 		}
 	}
-	if a != nil {
-		if err = c.Auth(a); err != nil {
-			return err
-		}
+	return true
+}
+
+// Returns a copy of buf, with all line endings converted to CRLF
+func toCRLF(buf []byte) []byte {
+	buf = bytes.Replace(buf, []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(buf, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// Generates a globally unique Message-ID, using the domain of the sender
+// as the right hand side
+func newMessageId(from *mail.Address, now time.Time) (string, error) {
+	domain := ""
+	if i := strings.LastIndex(from.Address, "@"); i != -1 {
+		domain = from.Address[i+1:]
 	}
-	if err = c.Mail(from); err != nil {
-		return err
+	if domain == "" {
+		domain, _ = os.Hostname()
 	}
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
-		}
+	if domain == "" {
+		domain = "localhost"
 	}
-	w, err := c.Data()
+	rnd := make([]byte, 8)
+	_, err := rand.Read(rnd)
 	if err != nil {
-		return err
+		return "", err
 	}
-	_, err = w.Write(msg)
+	return fmt.Sprintf("<%d.%x@%s>", now.UnixNano(), rnd, domain), nil
+}
+
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+}
+
+// Folds the address list on several lines, so that we don't exceed the
+// maximum line length on long lists of recipients
+func formatAddresses(ads []*mail.Address) string {
+	strs := make([]string, len(ads))
+	for i, a := range ads {
+		strs[i] = a.String()
+	}
+	return strings.Join(strs, ",\r\n ")
+}
+
+// Builds an RFC 5322 message out of nm: the headers are RFC 2047 encoded
+// when needed, and the body is sent as text/plain in utf-8. The Bcc
+// recipients are intentionally left out of the headers.
+func buildMessage(nm *NewMail, from *mail.Address, date time.Time) ([]byte, error) {
+	if len(nm.to) == 0 && len(nm.cc) == 0 && len(nm.bcc) == 0 {
+		return nil, fmt.Errorf("No recipients")
+	}
+	buf := &bytes.Buffer{}
+	writeHeader(buf, "Date", date.Format(time.RFC1123Z))
+	writeHeader(buf, "From", from.String())
+	if len(nm.to) > 0 {
+		writeHeader(buf, "To", formatAddresses(nm.to))
+	}
+	if len(nm.cc) > 0 {
+		writeHeader(buf, "Cc", formatAddresses(nm.cc))
+	}
+	writeHeader(buf, "Subject", gomime.QEncoding.Encode("utf-8", nm.subject))
+	msgId, err := newMessageId(from, date)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	writeHeader(buf, "Message-ID", msgId)
+	if nm.inReplyTo != "" {
+		writeHeader(buf, "In-Reply-To", nm.inReplyTo)
+	}
+	if len(nm.references) > 0 {
+		writeHeader(buf, "References", strings.Join(nm.references, "\r\n "))
+	}
+	writeHeader(buf, "MIME-Version", "1.0")
+	writeHeader(buf, "Content-Type", "text/plain; charset=utf-8")
+
+	body := toCRLF(nm.body)
+	if is7bit(body) {
+		writeHeader(buf, "Content-Transfer-Encoding", "7bit")
+		buf.WriteString("\r\n")
+		buf.Write(body)
+		return buf.Bytes(), nil
 	}
-	err = w.Close()
+	writeHeader(buf, "Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+	qpw := quotedprintable.NewWriter(buf)
+	if _, err := qpw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := qpw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the bare addresses, as expected by the MAIL and RCPT commands
+func envelopeAddresses(ads []*mail.Address) []string {
+	ret := []string{}
+	for _, a := range ads {
+		ret = append(ret, a.Address)
+	}
+	return ret
+}
+
+func parseMe(me string) *mail.Address {
+	from, err := mail.ParseAddress(me)
 	if err != nil {
-		return err
+		return &mail.Address{Address: me}
+	}
+	return from
+}
+
+// The maildir the sent messages are saved to, if any
+var sentDir string
+
+type fccHook struct {
+	from    *regexp.Regexp
+	to      *regexp.Regexp
+	maildir string
+}
+
+// The hooks overriding sentDir
+var fccHooks []fccHook
+
+func compileFccHooks(hooks []config.FccHook) ([]fccHook, error) {
+	ret := make([]fccHook, len(hooks))
+	for i, h := range hooks {
+		var err error
+		ret[i].from, err = regexp.Compile("(?i)" + h.From)
+		if err != nil {
+			return nil, fmt.Errorf("Bad From in the Fcc hook of %s: %s", h.Maildir, err)
+		}
+		ret[i].to, err = regexp.Compile("(?i)" + h.To)
+		if err != nil {
+			return nil, fmt.Errorf("Bad To in the Fcc hook of %s: %s", h.Maildir, err)
+		}
+		ret[i].maildir = h.Maildir
+	}
+	return ret, nil
+}
+
+// Returns the maildir a message sent from the address from to the ones in
+// rcpts is saved to: the one of the first matching hook, or sentDir
+func fccMaildir(from string, rcpts []string) string {
+	for _, h := range fccHooks {
+		if !h.from.MatchString(from) {
+			continue
+		}
+		for _, r := range rcpts {
+			if h.to.MatchString(r) {
+				return h.maildir
+			}
+		}
 	}
-	return c.Quit()
+	return sentDir
 }
 
-func send(nm *NewMail, cfg *config.Config) error {
-	rcpts := append(util.AddressesToString(nm.to), util.AddressesToString(nm.cc)...)
-	rcpts = append(rcpts, util.AddressesToString(nm.bcc)...)
-	return sendMail(cfg.SMTPConfig.Host, "localhost", "", nil, cfg.AmuaConfig.Me, rcpts, nm.body)
+// Builds the message out of nm and queues it in the outbox, it's sent in
+// the background
+func send(nm *NewMail, cfg *config.Config, ob *outbox) error {
+	from := parseMe(cfg.AmuaConfig.Me)
+	msg, err := buildMessage(nm, from, time.Now())
+	if err != nil {
+		return err
+	}
+	rcpts := append(envelopeAddresses(nm.to), envelopeAddresses(nm.cc)...)
+	rcpts = append(rcpts, envelopeAddresses(nm.bcc)...)
+	e := &envelope{
+		from:       from.Address,
+		to:         rcpts,
+		fcc:        fccMaildir(from.Address, rcpts),
+		parent:     nm.parent,
+		parentFlag: nm.parentFlag,
+	}
+	_, err = ob.Queue(e, msg)
+	if err != nil {
+		return err
+	}
+	if nm.outboxKey != "" {
+		return ob.Cancel(nm.outboxKey)
+	}
+	return nil
 }
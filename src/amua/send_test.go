@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	gomime "mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseAddresses(t *testing.T, s string) []*mail.Address {
+	ads, err := mail.ParseAddressList(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ads
+}
+
+func TestBuildMessage(t *testing.T) {
+	nm := &NewMail{
+		to:      mustParseAddresses(t, "Jörg Müller <joerg@example.com>, bob@example.com"),
+		cc:      mustParseAddresses(t, "carol@example.com"),
+		bcc:     mustParseAddresses(t, "secret@example.com"),
+		subject: "Réunion demain",
+		body:    []byte("Bonjour,\n\nà demain.\n"),
+	}
+	from := &mail.Address{Name: "Me", Address: "me@example.org"}
+	date := time.Date(2016, 7, 14, 10, 0, 0, 0, time.UTC)
+	buf, err := buildMessage(nm, from, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf, []byte("secret@example.com")) {
+		t.Error("Bcc recipient leaked in the headers")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := msg.Header.Date()
+	if err != nil || !d.Equal(date) {
+		t.Errorf("Unexpected date: %v (%v)", d, err)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Jörg Müller" {
+		t.Errorf("Unexpected To: %v (%v)", to, err)
+	}
+	cc, err := msg.Header.AddressList("Cc")
+	if err != nil || len(cc) != 1 || cc[0].Address != "carol@example.com" {
+		t.Errorf("Unexpected Cc: %v (%v)", cc, err)
+	}
+	rawSubj := msg.Header.Get("Subject")
+	if isASCII([]byte(rawSubj)) == false {
+		t.Errorf("Subject is not encoded: %q", rawSubj)
+	}
+	subj, err := new(gomime.WordDecoder).DecodeHeader(rawSubj)
+	if err != nil || subj != nm.subject {
+		t.Errorf("Unexpected subject: %q (%v)", subj, err)
+	}
+	mid := msg.Header.Get("Message-Id")
+	if !strings.HasPrefix(mid, "<") || !strings.HasSuffix(mid, "@example.org>") {
+		t.Errorf("Unexpected Message-ID: %q", mid)
+	}
+	if msg.Header.Get("Mime-Version") != "1.0" {
+		t.Error("Missing MIME-Version")
+	}
+	if msg.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type: %q", msg.Header.Get("Content-Type"))
+	}
+	if msg.Header.Get("Content-Transfer-Encoding") != "quoted-printable" {
+		t.Errorf("Unexpected Content-Transfer-Encoding: %q", msg.Header.Get("Content-Transfer-Encoding"))
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Bonjour,\r\n\r\nà demain.\r\n" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+func TestBuildMessage7bit(t *testing.T) {
+	nm := &NewMail{
+		to:         mustParseAddresses(t, "bob@example.com"),
+		subject:    "Hello",
+		inReplyTo:  "<2@x>",
+		references: []string{"<1@x>", "<2@x>"},
+		body:       []byte("Hi Bob\n"),
+	}
+	buf, err := buildMessage(nm, &mail.Address{Address: "me@example.org"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Subject") != "Hello" {
+		t.Errorf("ASCII subject should be left alone: %q", msg.Header.Get("Subject"))
+	}
+	if msg.Header.Get("Content-Transfer-Encoding") != "7bit" {
+		t.Errorf("Unexpected Content-Transfer-Encoding: %q", msg.Header.Get("Content-Transfer-Encoding"))
+	}
+	if msg.Header.Get("In-Reply-To") != "<2@x>" {
+		t.Errorf("Unexpected In-Reply-To: %q", msg.Header.Get("In-Reply-To"))
+	}
+	if refs := parseMessageIds(msg.Header.Get("References")); len(refs) != 2 {
+		t.Errorf("Unexpected References: %v", refs)
+	}
+	if msg.Header.Get("Cc") != "" {
+		t.Error("Empty Cc should be omitted")
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	if string(body) != "Hi Bob\r\n" {
+		t.Errorf("Unexpected body: %q", body)
+	}
+}
+
+func TestBuildMessageNoRecipients(t *testing.T) {
+	_, err := buildMessage(&NewMail{}, &mail.Address{Address: "me@example.org"}, time.Now())
+	if err == nil {
+		t.Error("Expected an error for a mail without recipients")
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"amua/config"
+)
+
+const smtpDialTimeout = 30 * time.Second
+
+// How long a whole SMTP session may take, so that a server that stops
+// answering fails the attempt instead of blocking the outbox
+var smtpTimeout = 5 * time.Minute
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// The LOGIN mechanism, which net/smtp lacks: the user then the password
+// are sent when the server asks for them
+type loginAuth struct {
+	user, passwd string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, fmt.Errorf("Refusing to send the password over an unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.passwd), nil
+	}
+	return nil, fmt.Errorf("Unexpected LOGIN challenge %q", fromServer)
+}
+
+// The XOAUTH2 mechanism of Gmail and Outlook, the password being an
+// OAuth2 access token
+type xoauth2Auth struct {
+	user, token string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, fmt.Errorf("Refusing to send the token over an unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		/* the server sent the details of the error, an empty
+		 * response gets us the final error */
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// The passwords fetched with PasswdCommand or read from PasswdFile, kept
+// for the session
+var passwdCache = struct {
+	sync.Mutex
+	passwds map[string]string
+}{passwds: make(map[string]string)}
+
+func passwdCacheKey(sc *config.SMTPConfig) string {
+	if sc.PasswdCommand != "" {
+		return "command:" + sc.PasswdCommand
+	}
+	return "file:" + sc.PasswdFile
+}
+
+// Returns the first line of buf, which holds the password
+func firstLine(buf []byte) string {
+	if i := bytes.IndexByte(buf, '\n'); i != -1 {
+		buf = buf[:i]
+	}
+	return strings.TrimSuffix(string(buf), "\r")
+}
+
+// Reads the password file at path, refusing it if it's readable by
+// everyone, like NewConfig does for a config holding the password
+func readPasswdFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the SMTP password: %s", err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the SMTP password: %s", err)
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		return nil, fmt.Errorf("%s holds the SMTP password but is readable by everyone: make it private", path)
+	}
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the SMTP password: %s", err)
+	}
+	return buf, nil
+}
+
+// Returns the password of sc: Passwd, or the first line printed by
+// PasswdCommand or of PasswdFile. Those are only run or read the first
+// time, when sending.
+func smtpPasswd(sc *config.SMTPConfig) (string, error) {
+	if sc.PasswdCommand == "" && sc.PasswdFile == "" {
+		return sc.Passwd, nil
+	}
+	passwdCache.Lock()
+	defer passwdCache.Unlock()
+	key := passwdCacheKey(sc)
+	if p, ok := passwdCache.passwds[key]; ok {
+		return p, nil
+	}
+	var buf []byte
+	var err error
+	if sc.PasswdCommand != "" {
+		var stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", sc.PasswdCommand)
+		cmd.Stderr = &stderr
+		buf, err = cmd.Output()
+		if err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			if msg == "" {
+				msg = err.Error()
+			}
+			return "", fmt.Errorf("Can't get the SMTP password: %s", msg)
+		}
+	} else {
+		buf, err = readPasswdFile(sc.PasswdFile)
+		if err != nil {
+			return "", err
+		}
+	}
+	p := firstLine(buf)
+	if p == "" {
+		return "", fmt.Errorf("The SMTP password is empty")
+	}
+	passwdCache.passwds[key] = p
+	return p, nil
+}
+
+// Forgets the password of sc, so that it's fetched again next time
+func forgetPasswd(sc *config.SMTPConfig) {
+	passwdCache.Lock()
+	delete(passwdCache.passwds, passwdCacheKey(sc))
+	passwdCache.Unlock()
+}
+
+// Returns the smtp.Auth configured by sc for host, or nil if there's no
+// user to authenticate as
+func smtpAuth(sc *config.SMTPConfig, host string) (smtp.Auth, error) {
+	if sc.User == "" {
+		return nil, nil
+	}
+	passwd, err := smtpPasswd(sc)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(sc.Auth) {
+	case "", "plain":
+		return smtp.PlainAuth("", sc.User, passwd, host), nil
+	case "login":
+		return &loginAuth{user: sc.User, passwd: passwd}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(sc.User, passwd), nil
+	case "xoauth2":
+		return &xoauth2Auth{user: sc.User, token: passwd}, nil
+	}
+	return nil, fmt.Errorf("Unknown SMTP authentication %q", sc.Auth)
+}
+
+// Returns the address of the server, with the default port of the TLS
+// mode if there's none, and its host name
+func smtpAddr(sc *config.SMTPConfig) (string, string) {
+	host, _, err := net.SplitHostPort(sc.Host)
+	if err == nil {
+		return sc.Host, host
+	}
+	port := "25"
+	if strings.ToLower(sc.TLS) == "implicit" {
+		port = "465"
+	}
+	return net.JoinHostPort(sc.Host, port), sc.Host
+}
+
+func smtpTLSConfig(sc *config.SMTPConfig, host string) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: sc.InsecureSkipVerify,
+	}
+	if sc.CAFile != "" {
+		pem, err := ioutil.ReadFile(sc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", sc.CAFile)
+		}
+	}
+	return tc, nil
+}
+
+func smtpHelo(sc *config.SMTPConfig) string {
+	if sc.Helo != "" {
+		return sc.Helo
+	}
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "localhost"
+	}
+	return name
+}
+
+// Connects to the server configured by sc, says hello and gets the
+// connection encrypted and authenticated as configured
+func dialSMTP(sc *config.SMTPConfig) (*smtp.Client, error) {
+	addr, host := smtpAddr(sc)
+	tc, err := smtpTLSConfig(sc, host)
+	if err != nil {
+		return nil, err
+	}
+	a, err := smtpAuth(sc, host)
+	if err != nil {
+		return nil, err
+	}
+	mode := strings.ToLower(sc.TLS)
+	var conn net.Conn
+	switch mode {
+	case "implicit":
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: smtpDialTimeout}, "tcp", addr, tc)
+	case "", "starttls", "none":
+		conn, err = net.DialTimeout("tcp", addr, smtpDialTimeout)
+	default:
+		return nil, fmt.Errorf("Unknown SMTP TLS mode %q", sc.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = c.Hello(smtpHelo(sc))
+	if err == nil && mode != "implicit" {
+		ok, _ := c.Extension("STARTTLS")
+		switch {
+		case ok && mode != "none":
+			err = c.StartTLS(tc)
+		case sc.RequireTLS:
+			err = fmt.Errorf("%s doesn't support STARTTLS", host)
+		}
+	}
+	if err == nil && a != nil {
+		err = c.Auth(a)
+		if err != nil {
+			/* it might have changed */
+			forgetPasswd(sc)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sends msg from the envelope address from to the ones in to, through the
+// server configured by sc
+func sendMail(sc *config.SMTPConfig, from string, to []string, msg []byte) error {
+	c, err := dialSMTP(sc)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
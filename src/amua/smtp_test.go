@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"amua/config"
+)
+
+// Returns a self-signed certificate for 127.0.0.1, and its PEM encoding
+func testCertificate(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// An SMTP server that accepts the mail of whoever knows passwd, and
+// records the last one
+type fakeSMTP struct {
+	l        net.Listener
+	cert     tls.Certificate
+	implicit bool // TLS from the start
+	startTLS bool // offers STARTTLS
+	passwd   string
+
+	lock   sync.Mutex
+	helo   string
+	mech   string
+	user   string
+	from   string
+	to     []string
+	data   string
+	secure bool // the mail was sent over TLS
+}
+
+func newFakeSMTP(t *testing.T, cert tls.Certificate, implicit bool, startTLS bool) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{l: l, cert: cert, implicit: implicit, startTLS: startTLS, passwd: "secret"}
+	if implicit {
+		s.l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+	go func() {
+		for {
+			conn, err := s.l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeSMTP) Close() {
+	s.l.Close()
+}
+
+// Sends the challenge c, and returns the decoded response
+func challenge(tp *textproto.Conn, c string) (string, error) {
+	tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(c)))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(line)
+	return string(b), err
+}
+
+func (s *fakeSMTP) authenticate(tp *textproto.Conn, arg string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return fmt.Errorf("no mechanism")
+	}
+	var initial string
+	if len(fields) > 1 {
+		b, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return err
+		}
+		initial = string(b)
+	}
+	s.lock.Lock()
+	want := s.passwd
+	s.lock.Unlock()
+	var user, passwd string
+	var err error
+	switch fields[0] {
+	case "PLAIN":
+		parts := strings.Split(initial, "\x00")
+		if len(parts) != 3 {
+			return fmt.Errorf("bad PLAIN response")
+		}
+		user, passwd = parts[1], parts[2]
+	case "LOGIN":
+		user, err = challenge(tp, "Username:")
+		if err == nil {
+			passwd, err = challenge(tp, "Password:")
+		}
+	case "CRAM-MD5":
+		const c = "<1.2@fake>"
+		var resp string
+		resp, err = challenge(tp, c)
+		if i := strings.LastIndex(resp, " "); err == nil && i != -1 {
+			user = resp[:i]
+			d := hmac.New(md5.New, []byte(want))
+			d.Write([]byte(c))
+			if resp[i+1:] == hex.EncodeToString(d.Sum(nil)) {
+				passwd = want
+			}
+		}
+	case "XOAUTH2":
+		for _, f := range strings.Split(initial, "\x01") {
+			if strings.HasPrefix(f, "user=") {
+				user = f[len("user="):]
+			} else if strings.HasPrefix(f, "auth=Bearer ") {
+				passwd = f[len("auth=Bearer "):]
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported mechanism")
+	}
+	if err != nil {
+		return err
+	}
+	if passwd != want {
+		return fmt.Errorf("authentication failed")
+	}
+	s.lock.Lock()
+	s.mech, s.user = fields[0], user
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	secure := s.implicit
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			verb, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			s.lock.Lock()
+			s.helo = arg
+			s.lock.Unlock()
+			tp.PrintfLine("250-fake")
+			if s.startTLS && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2")
+		case "STARTTLS":
+			tp.PrintfLine("220 Go ahead")
+			conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+			tp = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			if err := s.authenticate(tp, arg); err != nil {
+				tp.PrintfLine("535 %s", err)
+				continue
+			}
+			tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			s.lock.Lock()
+			s.from, s.to = arg, nil
+			s.lock.Unlock()
+			tp.PrintfLine("250 Ok")
+		case "RCPT":
+			s.lock.Lock()
+			s.to = append(s.to, arg)
+			s.lock.Unlock()
+			tp.PrintfLine("250 Ok")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.data, s.secure = string(data), secure
+			s.lock.Unlock()
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Unknown command")
+		}
+	}
+}
+
+func TestSendMail(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+	f, err := ioutil.TempFile("", "amuaca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(certPEM)
+	f.Close()
+
+	tests := []struct {
+		implicit bool
+		startTLS bool
+		sc       config.SMTPConfig
+		mech     string
+		secure   bool
+	}{
+		{false, true, config.SMTPConfig{User: "me", Passwd: "secret", CAFile: f.Name()}, "PLAIN", true},
+		{false, true, config.SMTPConfig{User: "me", Passwd: "secret", Auth: "login", CAFile: f.Name()}, "LOGIN", true},
+		{true, false, config.SMTPConfig{User: "me", Passwd: "secret", Auth: "cram-md5", TLS: "implicit", InsecureSkipVerify: true}, "CRAM-MD5", true},
+		{true, false, config.SMTPConfig{User: "me", Passwd: "secret", Auth: "xoauth2", TLS: "implicit", CAFile: f.Name()}, "XOAUTH2", true},
+		{false, true, config.SMTPConfig{TLS: "none"}, "", false},
+		{false, false, config.SMTPConfig{}, "", false},
+	}
+	for i, test := range tests {
+		s := newFakeSMTP(t, cert, test.implicit, test.startTLS)
+		sc := test.sc
+		sc.Host = s.Addr()
+		sc.Helo = "client.example.com"
+		err := sendMail(&sc, "me@example.com", []string{"a@example.com", "b@example.com"}, []byte("Subject: hi\r\n\r\nHello\r\n"))
+		s.Close()
+		if err != nil {
+			t.Errorf("%d: can't send: %s", i, err)
+			continue
+		}
+		s.lock.Lock()
+		if s.mech != test.mech || (s.mech != "" && s.user != "me") {
+			t.Errorf("%d: unexpected authentication %q as %q", i, s.mech, s.user)
+		}
+		if s.secure != test.secure {
+			t.Errorf("%d: expected TLS to be %v", i, test.secure)
+		}
+		if s.helo != "client.example.com" || s.from != "FROM:<me@example.com>" || len(s.to) != 2 {
+			t.Errorf("%d: unexpected envelope %q %q %v", i, s.helo, s.from, s.to)
+		}
+		if !strings.Contains(s.data, "Subject: hi") {
+			t.Errorf("%d: unexpected data %q", i, s.data)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func TestSendMailErrors(t *testing.T) {
+	cert, _ := testCertificate(t)
+	tests := []struct {
+		startTLS bool
+		sc       config.SMTPConfig
+	}{
+		/* the certificate can't be checked */
+		{true, config.SMTPConfig{}},
+		/* no STARTTLS */
+		{false, config.SMTPConfig{RequireTLS: true}},
+		{true, config.SMTPConfig{User: "me", Passwd: "wrong", Auth: "login", InsecureSkipVerify: true}},
+		{true, config.SMTPConfig{User: "me", Passwd: "secret", Auth: "digest-md5", InsecureSkipVerify: true}},
+		{true, config.SMTPConfig{TLS: "sometimes"}},
+		{true, config.SMTPConfig{CAFile: "/nonexistent"}},
+	}
+	for i, test := range tests {
+		s := newFakeSMTP(t, cert, false, test.startTLS)
+		sc := test.sc
+		sc.Host = s.Addr()
+		err := sendMail(&sc, "me@example.com", []string{"a@example.com"}, []byte("\r\n"))
+		s.Close()
+		if err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+		s.lock.Lock()
+		if s.data != "" {
+			t.Errorf("%d: the mail was sent", i)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		/* accepts, and never greets */
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		<-done
+		conn.Close()
+	}()
+	defer func(d time.Duration) { smtpTimeout = d }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+	sc := config.SMTPConfig{Host: l.Addr().String()}
+	start := time.Now()
+	err = sendMail(&sc, "me@example.com", []string{"a@example.com"}, []byte("\r\n"))
+	if err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("The timeout wasn't enforced: %v", time.Since(start))
+	}
+}
+
+func TestSMTPAddr(t *testing.T) {
+	tests := []struct {
+		sc   config.SMTPConfig
+		addr string
+		host string
+	}{
+		{config.SMTPConfig{Host: "mail.example.com:587"}, "mail.example.com:587", "mail.example.com"},
+		{config.SMTPConfig{Host: "mail.example.com"}, "mail.example.com:25", "mail.example.com"},
+		{config.SMTPConfig{Host: "mail.example.com", TLS: "implicit"}, "mail.example.com:465", "mail.example.com"},
+	}
+	for _, test := range tests {
+		addr, host := smtpAddr(&test.sc)
+		if addr != test.addr || host != test.host {
+			t.Errorf("Expected %s and %s, got %s and %s", test.addr, test.host, addr, host)
+		}
+	}
+}
+
+func TestSMTPPasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amuapasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	count := filepath.Join(dir, "count")
+	sc := &config.SMTPConfig{
+		User:          "me",
+		PasswdCommand: "echo run >> " + count + "; printf 'secret\\nurl: example.com\\n'",
+	}
+	defer forgetPasswd(sc)
+	for i := 0; i < 2; i++ {
+		p, err := smtpPasswd(sc)
+		if err != nil || p != "secret" {
+			t.Fatalf("Unexpected password %q: %v", p, err)
+		}
+	}
+	buf, _ := ioutil.ReadFile(count)
+	if string(buf) != "run\n" {
+		t.Errorf("Expected the command to run once, got %q", buf)
+	}
+
+	/* the cached password is used to send, and fetched again when it's
+	 * refused */
+	cert, _ := testCertificate(t)
+	s := newFakeSMTP(t, cert, false, true)
+	defer s.Close()
+	sc.Host = s.Addr()
+	sc.InsecureSkipVerify = true
+	if err := sendMail(sc, "me@example.com", []string{"a@example.com"}, []byte("\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	s.passwd = "changed"
+	s.lock.Unlock()
+	if err := sendMail(sc, "me@example.com", []string{"a@example.com"}, []byte("\r\n")); err == nil {
+		t.Fatal("Expected the password to be refused")
+	}
+	smtpPasswd(sc)
+	buf, _ = ioutil.ReadFile(count)
+	if string(buf) != "run\nrun\n" {
+		t.Errorf("Expected the command to run again, got %q", buf)
+	}
+
+	file := filepath.Join(dir, "passwd")
+	ioutil.WriteFile(file, []byte("from a file\r\n"), 0600)
+	fsc := &config.SMTPConfig{PasswdFile: file}
+	defer forgetPasswd(fsc)
+	if p, err := smtpPasswd(fsc); err != nil || p != "from a file" {
+		t.Errorf("Unexpected password %q: %v", p, err)
+	}
+	public := filepath.Join(dir, "public")
+	ioutil.WriteFile(public, []byte("secret\n"), 0644)
+	os.Chmod(public, 0644)
+	psc := &config.SMTPConfig{PasswdFile: public}
+	defer forgetPasswd(psc)
+	if _, err := smtpPasswd(psc); err == nil || !strings.Contains(err.Error(), "readable by everyone") {
+		t.Errorf("Expected the world readable file to be refused, got %v", err)
+	}
+
+	bad := &config.SMTPConfig{PasswdCommand: "echo locked >&2; exit 1"}
+	if _, err := smtpPasswd(bad); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Expected the error of the command, got %v", err)
+	}
+}
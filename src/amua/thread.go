@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Threading of messages, following https://www.jwz.org/doc/threading.html
+
+type container struct {
+	msg      *Message
+	parent   *container
+	children []*container
+}
+
+func (c *container) hasDescendant(o *container) bool {
+	if c == o {
+		return true
+	}
+	for _, child := range c.children {
+		if child.hasDescendant(o) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) removeChild(o *container) {
+	for i, child := range c.children {
+		if child == o {
+			c.children = append(c.children[:i], c.children[i+1:]...)
+			break
+		}
+	}
+	o.parent = nil
+}
+
+func (c *container) addChild(o *container) {
+	if o.parent != nil {
+		o.parent.removeChild(o)
+	}
+	o.parent = c
+	c.children = append(c.children, o)
+}
+
+// The date of a thread is the date of its most recent message
+func (c *container) date() time.Time {
+	var ret time.Time
+	if c.msg != nil {
+		ret = c.msg.Date
+	}
+	for _, child := range c.children {
+		if d := child.date(); d.After(ret) {
+			ret = d
+		}
+	}
+	return ret
+}
+
+// The date used to sort siblings: the container's own message, or its
+// first child's if the container is empty
+func (c *container) firstDate() time.Time {
+	if c.msg != nil {
+		return c.msg.Date
+	}
+	if len(c.children) > 0 {
+		return c.children[0].firstDate()
+	}
+	return time.Time{}
+}
+
+func (c *container) subject() string {
+	if c.msg != nil {
+		return c.msg.Subject
+	}
+	if len(c.children) > 0 {
+		return c.children[0].subject()
+	}
+	return ""
+}
+
+var replyPrefixRe = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv)(\[\d+\])?\s*:\s*)+`)
+
+func isReplySubject(s string) bool {
+	return replyPrefixRe.MatchString(s)
+}
+
+// Strips the "Re:", "Fwd:" prefixes and surrounding spaces from a subject
+func baseSubject(s string) string {
+	return strings.ToLower(strings.TrimSpace(replyPrefixRe.ReplaceAllString(s, "")))
+}
+
+// Removes empty containers: the ones without children are dropped, the
+// ones with children are replaced by their children, unless this would
+// promote several children to the root set
+func pruneEmpty(cs []*container, isRoot bool) []*container {
+	ret := make([]*container, 0, len(cs))
+	for _, c := range cs {
+		c.children = pruneEmpty(c.children, false)
+		if c.msg != nil {
+			ret = append(ret, c)
+			continue
+		}
+		switch {
+		case len(c.children) == 0:
+		case !isRoot || len(c.children) == 1:
+			for _, child := range c.children {
+				child.parent = c.parent
+				ret = append(ret, child)
+			}
+		default:
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Gathers the root threads sharing the same base subject
+func groupBySubject(roots []*container) []*container {
+	bySubject := make(map[string]*container)
+	for _, c := range roots {
+		s := baseSubject(c.subject())
+		if s == "" {
+			continue
+		}
+		o, ok := bySubject[s]
+		if !ok || (o.msg != nil && isReplySubject(o.msg.Subject) && c.msg != nil && !isReplySubject(c.msg.Subject)) {
+			bySubject[s] = c
+		}
+	}
+	ret := make([]*container, 0, len(roots))
+	for _, c := range roots {
+		s := baseSubject(c.subject())
+		o, ok := bySubject[s]
+		if !ok || o == c {
+			ret = append(ret, c)
+			continue
+		}
+		o.addChild(c)
+	}
+	return ret
+}
+
+// Root threads are sorted newest first, like ByDate, replies are sorted
+// in chronological order
+type byThreadDate struct {
+	cs          []*container
+	newestFirst bool
+}
+
+func (a byThreadDate) Len() int      { return len(a.cs) }
+func (a byThreadDate) Swap(i, j int) { a.cs[i], a.cs[j] = a.cs[j], a.cs[i] }
+func (a byThreadDate) Less(i, j int) bool {
+	if a.newestFirst {
+		return a.cs[i].date().After(a.cs[j].date())
+	}
+	return a.cs[i].firstDate().Before(a.cs[j].firstDate())
+}
+
+func sortContainers(cs []*container, newestFirst bool) {
+	sort.Stable(byThreadDate{cs, newestFirst})
+	for _, c := range cs {
+		sortContainers(c.children, false)
+	}
+}
+
+func flattenThreads(cs []*container, prefix string, depth int, msgs []*Message, tree map[*Message]string) []*Message {
+	for i, c := range cs {
+		last := i == len(cs)-1
+		cur := ""
+		next := prefix
+		if depth > 0 {
+			if last {
+				cur = prefix + "`-> "
+				next = prefix + "    "
+			} else {
+				cur = prefix + "|-> "
+				next = prefix + "|   "
+			}
+		}
+		if c.msg == nil {
+			/* empty containers aren't displayed, their children
+			 * take their place */
+			msgs = flattenThreads(c.children, prefix, depth, msgs, tree)
+			continue
+		}
+		msgs = append(msgs, c.msg)
+		tree[c.msg] = cur
+		msgs = flattenThreads(c.children, next, depth+1, msgs, tree)
+	}
+	return msgs
+}
+
+// Sorts msgs by thread: returns the messages in display order, along
+// with the tree prefix to display in front of each message's subject.
+// Threads are sorted most recent first, and messages within a thread are
+// sorted by date.
+func threadMessages(msgs []*Message) ([]*Message, map[*Message]string) {
+	ids := make(map[string]*container)
+	all := make([]*container, 0, len(msgs))
+	for i, m := range msgs {
+		id := m.MessageId
+		c, ok := ids[id]
+		if id == "" || (ok && c.msg != nil) {
+			/* missing or duplicate id, make up a unique one */
+			id = fmt.Sprintf("<amua-%d-%p>", i, m)
+			c, ok = nil, false
+		}
+		if !ok {
+			c = &container{}
+			ids[id] = c
+			all = append(all, c)
+		}
+		c.msg = m
+
+		refs := m.References
+		if len(refs) == 0 && m.InReplyTo != "" {
+			refs = []string{m.InReplyTo}
+		}
+		var prev *container
+		for _, ref := range refs {
+			rc, ok := ids[ref]
+			if !ok {
+				rc = &container{}
+				ids[ref] = rc
+				all = append(all, rc)
+			}
+			if prev != nil && rc.parent == nil && !rc.hasDescendant(prev) {
+				prev.addChild(rc)
+			}
+			prev = rc
+		}
+		if prev != nil && !c.hasDescendant(prev) {
+			prev.addChild(c)
+		} else if prev == nil && c.parent != nil {
+			c.parent.removeChild(c)
+		}
+	}
+
+	roots := make([]*container, 0)
+	for _, c := range all {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = pruneEmpty(roots, true)
+	roots = groupBySubject(roots)
+	sortContainers(roots, true)
+
+	tree := make(map[*Message]string)
+	return flattenThreads(roots, "", 0, make([]*Message, 0, len(msgs)), tree), tree
+}
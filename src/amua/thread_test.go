@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThreadMessages(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2016, 7, d, 0, 0, 0, 0, time.UTC)
+	}
+	root := &Message{Headers: Headers{Subject: "Release plan", MessageId: "<1@x>", Date: day(1)}}
+	reply1 := &Message{Headers: Headers{Subject: "Re: Release plan", MessageId: "<2@x>", InReplyTo: "<1@x>", References: []string{"<1@x>"}, Date: day(2)}}
+	reply2 := &Message{Headers: Headers{Subject: "Re: Release plan", MessageId: "<3@x>", InReplyTo: "<2@x>", References: []string{"<1@x>", "<2@x>"}, Date: day(4)}}
+	reply3 := &Message{Headers: Headers{Subject: "Re: Release plan", MessageId: "<4@x>", InReplyTo: "<1@x>", Date: day(3)}}
+	/* its parent is missing, and it has no References: subject fallback */
+	orphan := &Message{Headers: Headers{Subject: "RE: release plan", MessageId: "<5@x>", Date: day(5)}}
+	other := &Message{Headers: Headers{Subject: "Lunch?", MessageId: "<6@x>", Date: day(3)}}
+	/* the parent is missing: the two replies are gathered under an
+	 * empty container that isn't displayed */
+	lost1 := &Message{Headers: Headers{Subject: "Re: lost", MessageId: "<7@x>", References: []string{"<missing@x>"}, Date: day(1)}}
+	lost2 := &Message{Headers: Headers{Subject: "Re: lost", MessageId: "<8@x>", References: []string{"<missing@x>"}, Date: day(2)}}
+
+	msgs, tree := threadMessages([]*Message{reply2, other, lost2, reply1, orphan, root, reply3, lost1})
+	expected := []struct {
+		m      *Message
+		prefix string
+	}{
+		{root, ""},
+		{reply1, "|-> "},
+		{reply2, "|   `-> "},
+		{reply3, "|-> "},
+		{orphan, "`-> "},
+		{other, ""},
+		{lost1, ""},
+		{lost2, ""},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expected %d messages, got %d", len(expected), len(msgs))
+	}
+	for i, e := range expected {
+		if msgs[i] != e.m {
+			t.Errorf("%d: expected %q (%s), got %q (%s)", i, e.m.Subject, e.m.MessageId, msgs[i].Subject, msgs[i].MessageId)
+		}
+		if tree[msgs[i]] != e.prefix {
+			t.Errorf("%d: expected prefix %q, got %q", i, e.prefix, tree[msgs[i]])
+		}
+	}
+}
+
+func TestThreadMessagesLoop(t *testing.T) {
+	/* broken References creating a loop must not hang or drop messages */
+	a := &Message{Headers: Headers{Subject: "a", MessageId: "<a@x>", References: []string{"<b@x>"}}}
+	b := &Message{Headers: Headers{Subject: "b", MessageId: "<b@x>", References: []string{"<a@x>"}}}
+	c := &Message{Headers: Headers{Subject: "c", MessageId: "<a@x>"}}
+	msgs, _ := threadMessages([]*Message{a, b, c})
+	if len(msgs) != 3 {
+		t.Errorf("Expected 3 messages, got %d", len(msgs))
+	}
+}
+
+func TestBuildReferences(t *testing.T) {
+	m := &Message{Headers: Headers{MessageId: "<3@x>", InReplyTo: "<2@x>"}}
+	refs := buildReferences(m)
+	if len(refs) != 2 || refs[0] != "<2@x>" || refs[1] != "<3@x>" {
+		t.Errorf("Unexpected references: %v", refs)
+	}
+	m.References = []string{"<1@x>", "<2@x>"}
+	refs = buildReferences(m)
+	if len(refs) != 3 || refs[0] != "<1@x>" || refs[2] != "<3@x>" {
+		t.Errorf("Unexpected references: %v", refs)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"amua/config"
+)
+
+// Hands a finished message over for delivery
+type transport interface {
+	Send(from string, to []string, msg []byte) error
+	// Where the messages go, shown once sent
+	String() string
+}
+
+// Sends over SMTP, see sendMail
+type smtpTransport struct {
+	sc *config.SMTPConfig
+}
+
+func (t *smtpTransport) Send(from string, to []string, msg []byte) error {
+	return sendMail(t.sc, from, to, msg)
+}
+
+func (t *smtpTransport) String() string {
+	return t.sc.Host
+}
+
+// Pipes the message to a local command, such as "/usr/sbin/sendmail -oi"
+// or msmtp. The envelope sender is passed with -f, and the recipients as
+// arguments after "--", as the Bcc ones aren't in the headers: a
+// recipient starting with a dash can't be taken as an option. The
+// command can't use -t, which would make sendmail ignore them.
+type sendmailTransport struct {
+	command string
+}
+
+func (t *sendmailTransport) Send(from string, to []string, msg []byte) error {
+	/* the recipients are passed as is to the command run by the
+	 * shell, without having to quote them */
+	args := []string{"-c", t.command + ` "$@"`, "sh"}
+	if from != "" {
+		args = append(args, "-f", from)
+	}
+	args = append(args, "--")
+	args = append(args, to...)
+	cmd := exec.Command("/bin/sh", args...)
+	/* a local command expects the local line endings */
+	cmd.Stdin = bytes.NewReader(bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		msg := strings.Join(strings.Fields(stderr.String()), " ")
+		if msg == "" {
+			return fmt.Errorf("%s failed: %s", t, err)
+		}
+		return fmt.Errorf("%s failed: %s: %s", t, err, msg)
+	}
+	return nil
+}
+
+func (t *sendmailTransport) String() string {
+	return strings.Fields(t.command)[0]
+}
+
+// Returns the transport selected by cfg
+func newTransport(cfg *config.Config) (transport, error) {
+	switch strings.ToLower(cfg.AmuaConfig.Transport) {
+	case "", "smtp":
+		return &smtpTransport{sc: &cfg.SMTPConfig}, nil
+	case "sendmail":
+		command := cfg.AmuaConfig.SendmailCommand
+		if strings.TrimSpace(command) == "" {
+			command = defaultSendmailCommand
+		}
+		for _, f := range strings.Fields(command) {
+			if f == "-t" {
+				return nil, fmt.Errorf("The sendmail command can't use -t, the recipients are passed as arguments")
+			}
+		}
+		return &sendmailTransport{command: command}, nil
+	}
+	return nil, fmt.Errorf("Unknown transport %q", cfg.AmuaConfig.Transport)
+}
+
+const defaultSendmailCommand = "/usr/sbin/sendmail -oi"
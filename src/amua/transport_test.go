@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"amua/config"
+)
+
+func TestSendmailTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "amuasendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "sendmail")
+	err = ioutil.WriteFile(script, []byte(`#!/bin/sh
+out=$(dirname "$0")
+for a in "$@"; do echo "$a"; done > "$out/args"
+cat > "$out/msg"
+if grep -q fail "$out/msg"; then
+	echo "sendmail: fatal: no such user" >&2
+	exit 67
+fi
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{}
+	cfg.AmuaConfig.Transport = "sendmail"
+	cfg.AmuaConfig.SendmailCommand = script + " -oi"
+	tr, err := newTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Send("me@example.com", []string{"a@example.com", "Weird Name <b@example.com>", "-X/tmp/log@example.com"}, []byte("Subject: hi\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* the recipients come after --, so that none is taken as an option */
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if string(args) != "-oi\n-f\nme@example.com\n--\na@example.com\nWeird Name <b@example.com>\n-X/tmp/log@example.com\n" {
+		t.Errorf("Unexpected arguments %q", args)
+	}
+	msg, _ := ioutil.ReadFile(filepath.Join(dir, "msg"))
+	if string(msg) != "Subject: hi\n\nHello\n" {
+		t.Errorf("Unexpected message %q", msg)
+	}
+
+	err = tr.Send("me@example.com", []string{"a@example.com"}, []byte("Subject: fail\r\n\r\n"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 67") || !strings.Contains(err.Error(), "no such user") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	cfg.AmuaConfig.SendmailCommand = script + " -oi -t"
+	if _, err := newTransport(cfg); err == nil {
+		t.Error("Expected -t to be refused")
+	}
+	cfg.AmuaConfig.Transport = "carrier pigeon"
+	if _, err := newTransport(cfg); err == nil {
+		t.Error("Expected an unknown transport")
+	}
+	cfg.AmuaConfig.Transport = ""
+	if tr, _ := newTransport(cfg); tr.String() != cfg.SMTPConfig.Host {
+		t.Errorf("Expected SMTP by default, got %s", tr)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Where the removed messages are moved to, so that their removal can be
+// undone. They're removed for good if it's empty.
+var trashDir string
+
+// Protects the trash journal
+var trashLock sync.Mutex
+
+// A message in the trash, as recorded in the journal
+type trashEntry struct {
+	Time    time.Time
+	Maildir string // the path of the maildir it was removed from
+	Name    string // its file name in cur/
+	File    string // its file name in the trash
+}
+
+const trashJournal = "journal"
+
+// Moves src to dst, copying it if they're on different filesystems
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if _, serr := os.Stat(src); serr != nil {
+		return serr
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Removes the message file at path, from the maildir at mdPath, by moving
+// it to the trash
+func trashFile(mdPath string, path string) error {
+	if trashDir == "" {
+		return os.Remove(path)
+	}
+	trashLock.Lock()
+	defer trashLock.Unlock()
+	err := os.MkdirAll(trashDir, 0700)
+	if err != nil {
+		return err
+	}
+	e := trashEntry{
+		Time:    time.Now(),
+		Maildir: mdPath,
+		Name:    filepath.Base(path),
+	}
+	e.File = fmt.Sprintf("%d.%s", e.Time.UnixNano(), maildirKey(e.Name))
+	err = moveFile(path, filepath.Join(trashDir, e.File))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(trashDir, trashJournal), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(&e)
+}
+
+// Returns the entries of the journal whose file is still in the trash,
+// with the lock held
+func readTrashJournal() ([]*trashEntry, error) {
+	f, err := os.Open(filepath.Join(trashDir, trashJournal))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	ret := []*trashEntry{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &trashEntry{}
+		if json.Unmarshal(s.Bytes(), e) != nil {
+			/* a partial write */
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(trashDir, e.File)); err == nil {
+			ret = append(ret, e)
+		}
+	}
+	return ret, s.Err()
+}
+
+// Moves the message key of the maildir at mdPath back from the trash,
+// with the flags it had when removed, and returns its path. The latest
+// removal is undone if the message was removed more than once.
+func restoreTrashed(mdPath string, key string) (string, error) {
+	if trashDir == "" {
+		return "", fmt.Errorf("The message is gone, there's no trash")
+	}
+	trashLock.Lock()
+	defer trashLock.Unlock()
+	entries, err := readTrashJournal()
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Maildir != mdPath || maildirKey(e.Name) != key {
+			continue
+		}
+		path := filepath.Join(mdPath, "cur", fmt.Sprintf("%s:2,%s", key, flagsToFile(pathFlags(e.Name)&^Trashed)))
+		err := moveFile(filepath.Join(trashDir, e.File), path)
+		if err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("The message isn't in the trash anymore")
+}
+
+// Removes the messages trashed more than maxAge ago, and rewrites the
+// journal with the ones that are left
+func purgeTrash(maxAge time.Duration) error {
+	if trashDir == "" {
+		return nil
+	}
+	trashLock.Lock()
+	defer trashLock.Unlock()
+	entries, err := readTrashJournal()
+	if err != nil || entries == nil {
+		return err
+	}
+	journal := filepath.Join(trashDir, trashJournal)
+	tmp := journal + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	limit := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		if e.Time.Before(limit) {
+			os.Remove(filepath.Join(trashDir, e.File))
+			continue
+		}
+		err = enc.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, journal)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// A change made by an action of the index, that can be undone then
+// redone. The messages are found by their maildir key, as the Message
+// itself is replaced when the maildir is reloaded.
+type change interface {
+	undo() error
+	redo() error
+}
+
+// What a single command changed, undone at once
+type action []change
+
+// How many actions can be undone
+const maxUndo = 100
+
+// The actions that were done, and the ones that were undone since, which
+// can be redone until a new action is done. Only used by the UI.
+type undoStack struct {
+	done   []action
+	undone []action
+}
+
+func (s *undoStack) push(a action) {
+	if len(a) == 0 {
+		return
+	}
+	s.done = append(s.done, a)
+	if len(s.done) > maxUndo {
+		s.done = s.done[len(s.done)-maxUndo:]
+	}
+	s.undone = nil
+}
+
+// Undoes the last action, and returns how many changes it made
+func (s *undoStack) Undo() (int, error) {
+	if len(s.done) == 0 {
+		return 0, fmt.Errorf("Nothing to undo")
+	}
+	a := s.done[len(s.done)-1]
+	s.done = s.done[:len(s.done)-1]
+	s.undone = append(s.undone, a)
+	var ret error
+	for i := len(a) - 1; i >= 0; i-- {
+		err := a[i].undo()
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return len(a), ret
+}
+
+// Redoes the last action that was undone, and returns how many changes
+// it made
+func (s *undoStack) Redo() (int, error) {
+	if len(s.undone) == 0 {
+		return 0, fmt.Errorf("Nothing to redo")
+	}
+	a := s.undone[len(s.undone)-1]
+	s.undone = s.undone[:len(s.undone)-1]
+	s.done = append(s.done, a)
+	var ret error
+	for _, c := range a {
+		err := c.redo()
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return len(a), ret
+}
+
+func messageKey(m *Message) string {
+	return maildirKey(filepath.Base(m.path))
+}
+
+// Returns the message whose maildir key is key, or nil
+func (md *Maildir) messageByKey(key string) *Message {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	for _, m := range md.messages {
+		if maildirKey(filepath.Base(m.path)) == key {
+			return m
+		}
+	}
+	return nil
+}
+
+// The flags set and cleared on a message. Only those are undone, so
+// that the flags changed since are kept. Setting Trashed only removes the
+// message when the changes are applied, so undoing it might bring the
+// message back from the trash.
+type flagChange struct {
+	md           *Maildir
+	key          string
+	set, cleared MessageFlags
+}
+
+func (c *flagChange) setFlags(set MessageFlags, clear MessageFlags) error {
+	m := c.md.messageByKey(c.key)
+	if m == nil {
+		if (set & Trashed) != 0 {
+			/* gone already */
+			return nil
+		}
+		path, err := restoreTrashed(c.md.path, c.key)
+		if err != nil {
+			return err
+		}
+		m, err = c.md.loadMessage(path, c.md.IsActive())
+		if err != nil {
+			return err
+		}
+		c.md.add([]*Message{m})
+	}
+	c.md.SetFlags(m, set, clear)
+	return nil
+}
+
+func (c *flagChange) undo() error {
+	return c.setFlags(c.cleared, c.set)
+}
+
+func (c *flagChange) redo() error {
+	return c.setFlags(c.set, c.cleared)
+}
+
+// Sets then clears the passed flags on msgs, messages of md, and returns
+// the changes made
+func changeFlags(md *Maildir, msgs []*Message, set MessageFlags, clear MessageFlags) action {
+	ret := action{}
+	for _, m := range msgs {
+		old := m.Flags
+		md.SetFlags(m, set, clear)
+		if m.Flags != old {
+			ret = append(ret, &flagChange{
+				md:      md.Owner(m),
+				key:     messageKey(m),
+				set:     m.Flags &^ old,
+				cleared: old &^ m.Flags,
+			})
+		}
+	}
+	return ret
+}
+
+// A message moved from a maildir to another
+type moveChange struct {
+	from, to       *Maildir
+	fromKey, toKey string
+}
+
+func (c *moveChange) undo() error {
+	m := c.to.messageByKey(c.toKey)
+	if m == nil {
+		return fmt.Errorf("The moved message is gone")
+	}
+	nm, err := c.to.MoveTo(m, c.from)
+	if err != nil {
+		return err
+	}
+	c.fromKey = messageKey(nm)
+	return nil
+}
+
+func (c *moveChange) redo() error {
+	m := c.from.messageByKey(c.fromKey)
+	if m == nil {
+		return fmt.Errorf("The message is gone")
+	}
+	nm, err := c.from.MoveTo(m, c.to)
+	if err != nil {
+		return err
+	}
+	c.toKey = messageKey(nm)
+	return nil
+}
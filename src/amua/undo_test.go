@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withTrash(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "amuatrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashDir = dir
+	return func() {
+		trashDir = ""
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUndoFlags(t *testing.T) {
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	deliverTestMessage(t, dir, "cur", "1.a:2,", "one")
+	deliverTestMessage(t, dir, "cur", "2.b:2,S", "two")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s undoStack
+	s.push(changeFlags(md, md.Messages(), Seen|Flagged, 0))
+	/* nothing changed, nothing to undo */
+	s.push(changeFlags(md, md.Messages(), Seen, 0))
+	s.push(changeFlags(md, md.Messages()[:1], 0, Flagged))
+	if len(s.done) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(s.done))
+	}
+	n, err := s.Undo()
+	if err != nil || n != 1 || md.Message(0).Flags != Seen|Flagged {
+		t.Errorf("Unexpected undo: %d, %v, %v", n, err, md.Message(0).Flags)
+	}
+	n, err = s.Undo()
+	if err != nil || n != 2 || md.Message(0).Flags != 0 || md.Message(1).Flags != Seen {
+		t.Errorf("Unexpected undo: %d, %v, %v %v", n, err, md.Message(0).Flags, md.Message(1).Flags)
+	}
+	if _, err := s.Undo(); err == nil {
+		t.Error("Expected nothing to undo")
+	}
+	n, err = s.Redo()
+	if err != nil || n != 2 || md.Message(1).Flags != Seen|Flagged {
+		t.Errorf("Unexpected redo: %d, %v, %v", n, err, md.Message(1).Flags)
+	}
+	/* only what the action changed is undone */
+	md.SetFlags(md.Message(1), 0, Seen)
+	n, err = s.Undo()
+	if err != nil || n != 2 || md.Message(0).Flags != 0 || md.Message(1).Flags != 0 {
+		t.Errorf("Unexpected undo: %d, %v, %v %v", n, err, md.Message(0).Flags, md.Message(1).Flags)
+	}
+	s.Redo()
+	md.SetFlags(md.Message(1), Replied, 0)
+	s.Undo()
+	if md.Message(1).Flags != Replied {
+		t.Errorf("The flags set since the action were undone: %v", md.Message(1).Flags)
+	}
+	s.Redo()
+	/* a new action drops what could be redone */
+	s.push(changeFlags(md, md.Messages(), Tagged, 0))
+	if _, err := s.Redo(); err == nil {
+		t.Error("Expected nothing to redo")
+	}
+}
+
+func TestUndoAcrossSync(t *testing.T) {
+	defer withTrash(t)()
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	path := deliverTestMessage(t, dir, "cur", "1.a:2,S", "one")
+	deliverTestMessage(t, dir, "cur", "2.b:2,", "two")
+	md, err := LoadMaildir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s undoStack
+	s.push(changeFlags(md, md.Messages()[:1], Trashed, 0))
+	err = md.ApplyChanges()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("The message wasn't removed: %v", err)
+	}
+	if md.Len() != 1 {
+		t.Fatalf("Expected 1 message, got %d", md.Len())
+	}
+
+	/* the message comes back from the trash, and can be removed again */
+	_, err = s.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("The message wasn't restored: %v", err)
+	}
+	md.Sort(SortByFile)
+	if md.Len() != 2 || md.Message(0).Subject != "one" || md.Message(0).Flags != Seen {
+		t.Fatalf("Unexpected messages after the undo: %d", md.Len())
+	}
+	_, err = s.Redo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.ApplyChanges()
+	_, err = s.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.messageByKey("1.a") == nil {
+		t.Error("The message wasn't restored twice")
+	}
+
+	/* moves */
+	other := newTestMaildir(t)
+	defer os.RemoveAll(other)
+	omd, err := LoadMaildir(other, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md.messageByKey("2.b")
+	nm, err := md.MoveTo(m, omd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.push(action{&moveChange{from: md, to: omd, fromKey: "2.b", toKey: messageKey(nm)}})
+	/* the move undoes itself, the source isn't kept in the trash */
+	trashLock.Lock()
+	entries, _ := readTrashJournal()
+	trashLock.Unlock()
+	for _, e := range entries {
+		if maildirKey(e.Name) == "2.b" {
+			t.Error("The moved message was put in the trash")
+		}
+	}
+	_, err = s.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 2 || omd.Len() != 0 {
+		t.Errorf("The move wasn't undone: %d, %d", md.Len(), omd.Len())
+	}
+	_, err = s.Redo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Len() != 1 || omd.Len() != 1 {
+		t.Errorf("The move wasn't redone: %d, %d", md.Len(), omd.Len())
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	defer withTrash(t)()
+	dir := newTestMaildir(t)
+	defer os.RemoveAll(dir)
+	old := deliverTestMessage(t, dir, "cur", "1.a:2,", "old")
+	recent := deliverTestMessage(t, dir, "cur", "2.b:2,", "recent")
+	if err := trashFile(dir, old); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := trashFile(dir, recent); err != nil {
+		t.Fatal(err)
+	}
+	err := purgeTrash(25 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashLock.Lock()
+	entries, err := readTrashJournal()
+	trashLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "2.b:2," {
+		t.Fatalf("Expected only the recent message, got %d entries", len(entries))
+	}
+	files, _ := ioutil.ReadDir(trashDir)
+	if len(files) != 2 {
+		t.Errorf("Expected the journal and a message in the trash, got %d files", len(files))
+	}
+	if _, err := restoreTrashed(dir, "1.a"); err == nil {
+		t.Error("The purged message was restored")
+	}
+	path, err := restoreTrashed(dir, "2.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "cur", "2.b:2,") {
+		t.Errorf("Unexpected path %s", path)
+	}
+}
@@ -3,6 +3,9 @@ package util
 import (
 	"fmt"
 	"net/mail"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
 )
 
 func AddressesToString(ads []*mail.Address) []string {
@@ -41,10 +44,78 @@ func SiteToHuman(size int64) string {
 		return fmt.Sprintf("%d", size)
 	}
 }
+
+// Calls fn with each character of s, the combining marks and the
+// characters joined by a zero width joiner included, along with the
+// number of cells it takes on the screen. Stops if fn returns false.
+func eachCluster(s string, fn func(c string, width int) bool) {
+	start, width := -1, 0
+	joined := false
+	for i, r := range s {
+		w := runewidth.RuneWidth(r)
+		switch {
+		case start == -1:
+		case r == zwj:
+			joined = true
+			continue
+		case joined || w == 0:
+			joined = false
+			continue
+		default:
+			if !fn(s[start:i], width) {
+				return
+			}
+		}
+		start, width = i, w
+	}
+	if start != -1 {
+		fn(s[start:], width)
+	}
+}
+
+// The zero width joiner, as found in the emoji sequences
+const zwj = '\u200d'
+
+// Returns the number of cells s takes on the screen
+func StringWidth(s string) int {
+	ret := 0
+	eachCluster(s, func(c string, width int) bool {
+		ret += width
+		return true
+	})
+	return ret
+}
+
+// Returns the beginning of s that fits in maxLen cells, without cutting
+// a character in half
 func TruncateString(s string, maxLen int) string {
-	if len(s) > maxLen {
-		return s[:maxLen]
+	ret := 0
+	cells := 0
+	eachCluster(s, func(c string, width int) bool {
+		if cells+width > maxLen {
+			return false
+		}
+		cells += width
+		ret += len(c)
+		return true
+	})
+	return s[:ret]
+}
+
+// Truncates s to width cells, then pads it with spaces on the right
+func PadRight(s string, width int) string {
+	s = TruncateString(s, width)
+	if width <= 0 {
+		return s
 	}
-	return s
+	return s + strings.Repeat(" ", width-StringWidth(s))
+}
 
+// Truncates s to width cells, then pads it with spaces on the left
+func PadLeft(s string, width int) string {
+	s = TruncateString(s, width)
+	if width <= 0 {
+		return s
+	}
+	return strings.Repeat(" ", width-StringWidth(s)) + s
 }
@@ -0,0 +1,75 @@
+package util
+
+import "testing"
+
+func TestStringWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"André", 5},
+		/* a combining acute accent */
+		{"Andre\u0301", 5},
+		{"日本語", 6},
+		{"a\U0001f600b", 4},
+		/* a family: three emojis joined by zero width joiners */
+		{"\U0001f468\u200d\U0001f469\u200d\U0001f467!", 3},
+	}
+	for _, test := range tests {
+		if w := StringWidth(test.s); w != test.width {
+			t.Errorf("Expected %d cells for %q, got %d", test.width, test.s, w)
+		}
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		s        string
+		max      int
+		expected string
+	}{
+		{"abcdef", 3, "abc"},
+		{"abc", 10, "abc"},
+		{"abc", 0, ""},
+		{"André Example", 5, "André"},
+		{"Andre\u0301 Example", 5, "Andre\u0301"},
+		/* a wide character that doesn't fit is dropped */
+		{"日本語", 5, "日本"},
+		{"ab日", 3, "ab"},
+		{"\U0001f600\U0001f600", 3, "\U0001f600"},
+		{"\U0001f468\u200d\U0001f469 family", 2, "\U0001f468\u200d\U0001f469"},
+	}
+	for _, test := range tests {
+		if s := TruncateString(test.s, test.max); s != test.expected {
+			t.Errorf("Expected %q for %q truncated to %d, got %q", test.expected, test.s, test.max, s)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	tests := []struct {
+		s           string
+		width       int
+		right, left string
+	}{
+		{"ab", 4, "ab  ", "  ab"},
+		{"日本", 5, "日本 ", " 日本"},
+		{"日本語", 5, "日本 ", " 日本"},
+		{"e\u0301te\u0301", 4, "e\u0301te\u0301 ", " e\u0301te\u0301"},
+		{"abc", 0, "", ""},
+		{"abc", -1, "", ""},
+	}
+	for _, test := range tests {
+		if s := PadRight(test.s, test.width); s != test.right {
+			t.Errorf("Expected %q for %q padded to %d, got %q", test.right, test.s, test.width, s)
+		}
+		if s := PadLeft(test.s, test.width); s != test.left {
+			t.Errorf("Expected %q for %q padded to %d, got %q", test.left, test.s, test.width, s)
+		}
+		if w := StringWidth(PadRight(test.s, test.width)); test.width > 0 && w != test.width {
+			t.Errorf("Expected %d cells, got %d", test.width, w)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// Watches the new/ and cur/ directories of a maildir using inotify
+type maildirWatcher struct {
+	f      *os.File
+	events chan struct{} // one event per read(2) from the inotify fd
+	errors chan error
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+func newMaildirWatcher(mdPath string) (*maildirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"new", "cur"} {
+		_, err := syscall.InotifyAddWatch(fd, filepath.Join(mdPath, d), watchMask)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	w := &maildirWatcher{
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+		errors: make(chan error, 1),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+func (w *maildirWatcher) readEvents() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			w.errors <- err
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				/* we lost events, a full rescan will pick them up */
+				break
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				w.errors <- fmt.Errorf("%s: watch removed", w.f.Name())
+				return
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+			/* an event is already pending */
+		}
+	}
+}
+
+func (w *maildirWatcher) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+// There's no inotify outside of linux, the maildirs are polled instead
+type maildirWatcher struct {
+	events chan struct{}
+	errors chan error
+}
+
+func newMaildirWatcher(mdPath string) (*maildirWatcher, error) {
+	return nil, fmt.Errorf("inotify is not available")
+}
+
+func (w *maildirWatcher) Close() error {
+	return nil
+}